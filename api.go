@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	sqldb "ctlog/db"
+	"ctlog/match"
+	"ctlog/verify"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const API_DEFAULT_LIMIT = 100
+const API_MAX_LIMIT = 1000
+
+// Certificates of a query read for one page at most, pages of rarely matched queries can hold fewer certificates
+const API_MAX_SCAN = 10 * API_MAX_LIMIT
+
+// Format of the times of the stored certificates, in UTC
+const certTimeLayout = "2006-01-02 15:04:05"
+
+// A certificate as returned by the API
+type apiCertificate struct {
+	ID             int64    `json:"id"`
+	CN             string   `json:"cn"`
+	UnicodeCN      string   `json:"unicode_cn"`
+	DN             string   `json:"dn"`
+	SerialNumber   string   `json:"serial_number"`
+	Fingerprint    string   `json:"fingerprint"`
+	SAN            []string `json:"san"`
+	UnicodeSAN     []string `json:"unicode_san"`
+	NotBefore      string   `json:"not_before"`
+	NotAfter       string   `json:"not_after"`
+	Issuer         string   `json:"issuer"`
+	AuthorityKeyID string   `json:"authority_key_id"`
+	SPKIHash       string   `json:"spki_hash"`
+	Organization   []string `json:"organization"`
+	Lint           []string `json:"lint"`
+	IPAddresses    []string `json:"ip_addresses"`
+	EmailAddresses []string `json:"email_addresses"`
+	URIs           []string `json:"uris"`
+}
+
+type apiPage struct {
+	Certificates []apiCertificate `json:"certificates"`
+	// Cursor of the next page, empty on the last page
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// Serves the API on the address in the background until the context is cancelled
+func serveAPI(ctx context.Context, addr string, publicURL string, store sqldb.Store, unsubscriber *sqldb.Unsubscriber) {
+	server := &http.Server{Addr: addr, Handler: apiHandler(store, publicURL, &verify.Verifier{}, unsubscriber)}
+
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("API server failed", "addr", addr, "err", err)
+		}
+	}()
+	context.AfterFunc(ctx, func() {
+		server.Shutdown(context.Background())
+	})
+}
+
+func apiHandler(store sqldb.Store, publicURL string, verifier *verify.Verifier, unsubscriber *sqldb.Unsubscriber) http.Handler {
+	publicURL = strings.TrimSuffix(publicURL, "/")
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/certificates", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
+			return
+		}
+		email, ok := authenticateCaller(w, r, store)
+		if !ok {
+			return
+		}
+		searchCertificates(w, r, store, email)
+	})
+	handleMonitorAPI(mux, store, publicURL, verifier)
+	handleWebUI(mux, store, publicURL, unsubscriber)
+	return mux
+}
+
+// Returns the email of the session of the web interface or of the bearer API key, answers 401 if there is neither
+func authenticateCaller(w http.ResponseWriter, r *http.Request, store sqldb.Store) (string, bool) {
+	email, err := sessionEmail(r, store)
+	if err != nil {
+		slog.Error("Failed authenticating session", "err", err)
+		writeJSONError(w, http.StatusInternalServerError, "authentication failed")
+		return "", false
+	}
+	if email != "" {
+		return email, true
+	}
+	return authenticate(w, r, store)
+}
+
+// Answers GET /api/certificates with the certificates matched by the monitors of the email, newest certificates first
+func searchCertificates(w http.ResponseWriter, r *http.Request, store sqldb.Store, email string) {
+	q, err := parseCertificateQuery(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	certs, next, err := sqldb.SearchMatches(r.Context(), email, q, API_MAX_SCAN, store)
+	if err != nil {
+		slog.Error("Failed searching certificates", "err", err)
+		writeJSONError(w, http.StatusInternalServerError, "search failed")
+		return
+	}
+
+	page := apiPage{Certificates: make([]apiCertificate, 0, len(certs))}
+	if next > 0 {
+		page.NextCursor = strconv.FormatInt(next, 10)
+	}
+	for _, c := range certs {
+		page.Certificates = append(page.Certificates, apiCertificate{
+			ID:             c.ID,
+			CN:             c.CN,
+			UnicodeCN:      c.UnicodeCN,
+			DN:             c.DN,
+			SerialNumber:   c.SerialNumber,
+			Fingerprint:    c.Fingerprint,
+			SAN:            c.SAN,
+			UnicodeSAN:     c.UnicodeSAN,
+			NotBefore:      apiTime(c.NotBefore),
+			NotAfter:       apiTime(c.NotAfter),
+			Issuer:         c.Issuer,
+			AuthorityKeyID: c.AuthorityKeyID,
+			SPKIHash:       c.SPKIHash,
+			Organization:   c.Organization,
+			Lint:           c.Lint,
+			IPAddresses:    c.IPAddresses,
+			EmailAddresses: c.EmailAddresses,
+			URIs:           c.URIs,
+		})
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// Parses the query parameters: domain, match (exact or subdomain), issuer, serial, fingerprint,
+// valid_from, valid_to, limit and cursor
+func parseCertificateQuery(r *http.Request) (sqldb.CertificateQuery, error) {
+	params := r.URL.Query()
+	q := sqldb.CertificateQuery{Limit: API_DEFAULT_LIMIT}
+
+	if domain := params.Get("domain"); domain != "" {
+		ascii, _, err := match.ParseDomain(domain)
+		if err != nil {
+			return q, fmt.Errorf("invalid domain %q: %v", domain, err)
+		}
+		q.Domain = ascii
+	}
+	switch params.Get("match") {
+	case "", "exact":
+	case "subdomain":
+		q.Subdomains = true
+	default:
+		return q, fmt.Errorf("invalid match %q, expected exact or subdomain", params.Get("match"))
+	}
+
+	if issuer := params.Get("issuer"); issuer != "" {
+		value, err := match.ParseValue(match.KindIssuer, issuer)
+		if err != nil {
+			return q, err
+		}
+		q.Issuer = value
+	}
+
+	if serial := params.Get("serial"); serial != "" {
+		// Stored as big.Int.Text(16)
+		s := strings.TrimLeft(strings.ToLower(strings.ReplaceAll(serial, ":", "")), "0")
+		if s == "" {
+			s = "0"
+		}
+		if _, err := hex.DecodeString(strings.Repeat("0", len(s)%2) + s); err != nil {
+			return q, fmt.Errorf("serial %q is not hex", serial)
+		}
+		q.SerialNumber = s
+	}
+
+	if fingerprint := params.Get("fingerprint"); fingerprint != "" {
+		f := strings.ToLower(strings.ReplaceAll(fingerprint, ":", ""))
+		if _, err := hex.DecodeString(f); err != nil || len(f) != 64 {
+			return q, fmt.Errorf("fingerprint %q is not a hex SHA-256 hash", fingerprint)
+		}
+		q.Fingerprint = f
+	}
+
+	for _, t := range []struct {
+		name  string
+		value *string
+	}{{"valid_from", &q.ValidFrom}, {"valid_to", &q.ValidTo}} {
+		if v := params.Get(t.name); v != "" {
+			parsed, err := parseAPITime(v)
+			if err != nil {
+				return q, fmt.Errorf("invalid %s %q, expected RFC 3339 or YYYY-MM-DD", t.name, v)
+			}
+			*t.value = parsed.UTC().Format(certTimeLayout)
+		}
+	}
+
+	if limit := params.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > API_MAX_LIMIT {
+			return q, fmt.Errorf("invalid limit %q, expected 1 to %d", limit, API_MAX_LIMIT)
+		}
+		q.Limit = n
+	}
+	if cursor := params.Get("cursor"); cursor != "" {
+		n, err := strconv.ParseInt(cursor, 10, 64)
+		if err != nil || n < 1 {
+			return q, fmt.Errorf("invalid cursor %q", cursor)
+		}
+		q.After = n
+	}
+	return q, nil
+}
+
+func parseAPITime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", s)
+}
+
+// Converts a stored time to RFC 3339, an unparsable time is returned as it is
+func apiTime(s string) string {
+	t, err := time.Parse(certTimeLayout, s)
+	if err != nil {
+		return s
+	}
+	return t.Format(time.RFC3339)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Debug("Failed writing API response", "err", err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
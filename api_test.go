@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	sqldb "ctlog/db"
+	"ctlog/match"
+	"ctlog/verify"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+// Saves a certificate of the names with the serial, IDs grow with the serials saved
+func saveTestCert(t *testing.T, store sqldb.Store, serial int, names ...string) {
+	t.Helper()
+	_, err := store.SaveCertificate(context.Background(), sqldb.CertInfo{
+		CN:           names[0],
+		UnicodeCN:    names[0],
+		DN:           "CN=" + names[0],
+		SerialNumber: strconv.Itoa(serial),
+		SAN:          names,
+		UnicodeSAN:   names,
+		NotBefore:    "2026-01-01 00:00:00",
+		NotAfter:     "2026-04-01 00:00:00",
+		Issuer:       "CN=Test CA",
+		Fingerprint:  strconv.Itoa(serial),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Saves an API key of the email
+func saveTestKey(t *testing.T, store sqldb.Store, key string, email string) {
+	t.Helper()
+	if err := store.SaveAPIKey(context.Background(), sqldb.HashToken(key), email); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Sends the request to the handler and decodes the JSON answer into v
+func serveTestRequest(t *testing.T, h http.Handler, r *http.Request, v any) int {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if v != nil && w.Code < 300 {
+		if err := json.NewDecoder(w.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code
+}
+
+func TestSearchCertificatesAuthentication(t *testing.T) {
+	store := newTestStore(t)
+	h := apiHandler(store, "", &verify.Verifier{}, nil)
+	saveTestKey(t, store, "key", "user@example.com")
+
+	r := httptest.NewRequest(http.MethodGet, "/api/certificates", nil)
+	if code := serveTestRequest(t, h, r, nil); code != http.StatusUnauthorized {
+		t.Errorf("without a key: %d, want %d", code, http.StatusUnauthorized)
+	}
+	r.Header.Set("Authorization", "Bearer wrong")
+	if code := serveTestRequest(t, h, r, nil); code != http.StatusUnauthorized {
+		t.Errorf("with a wrong key: %d, want %d", code, http.StatusUnauthorized)
+	}
+	r.Header.Set("Authorization", "Bearer key")
+	if code := serveTestRequest(t, h, r, nil); code != http.StatusOK {
+		t.Errorf("with a key: %d, want %d", code, http.StatusOK)
+	}
+}
+
+func TestSearchCertificatesOfCaller(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	h := apiHandler(store, "", &verify.Verifier{}, nil)
+	if err := sqldb.AddMonitor(ctx, "user@example.com", match.KindDomain, []string{"example.com"}, match.DefaultMode, match.Off, store); err != nil {
+		t.Fatal(err)
+	}
+	if err := sqldb.AddMonitor(ctx, "other@example.org", match.KindDomain, []string{"example.org"}, match.DefaultMode, match.Off, store); err != nil {
+		t.Fatal(err)
+	}
+	saveTestKey(t, store, "user", "user@example.com")
+	saveTestKey(t, store, "other", "other@example.org")
+	saveTestKey(t, store, "none", "none@example.net")
+	for i, name := range []string{"a.example.com", "a.example.org", "b.example.com", "c.example.com", "b.example.org"} {
+		saveTestCert(t, store, i+1, name)
+	}
+
+	search := func(key string, query string) apiPage {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodGet, "/api/certificates?"+query, nil)
+		r.Header.Set("Authorization", "Bearer "+key)
+		var page apiPage
+		if code := serveTestRequest(t, h, r, &page); code != http.StatusOK {
+			t.Fatalf("GET /api/certificates?%s: %d", query, code)
+		}
+		return page
+	}
+	cns := func(page apiPage) []string {
+		var cns []string
+		for _, c := range page.Certificates {
+			cns = append(cns, c.CN)
+		}
+		return cns
+	}
+
+	if got := cns(search("user", "")); !slices.Equal(got, []string{"c.example.com", "b.example.com", "a.example.com"}) {
+		t.Errorf("certificates of user@example.com %v", got)
+	}
+	if got := cns(search("other", "domain=a.example.com")); len(got) != 0 {
+		t.Errorf("other@example.org got certificates of example.com %v", got)
+	}
+	if got := cns(search("none", "")); len(got) != 0 {
+		t.Errorf("an email without monitors got certificates %v", got)
+	}
+
+	// Pages skip the certificates of other monitors
+	first := search("user", "limit=2")
+	if got := cns(first); !slices.Equal(got, []string{"c.example.com", "b.example.com"}) || first.NextCursor == "" {
+		t.Fatalf("first page %v, cursor %q", got, first.NextCursor)
+	}
+	second := search("user", "limit=2&cursor="+first.NextCursor)
+	if got := cns(second); !slices.Equal(got, []string{"a.example.com"}) || second.NextCursor != "" {
+		t.Errorf("second page %v, cursor %q", got, second.NextCursor)
+	}
+}
+
+func TestParseCertificateQuery(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    sqldb.CertificateQuery
+		wantErr bool
+	}{
+		{"", sqldb.CertificateQuery{Limit: API_DEFAULT_LIMIT}, false},
+		{"domain=WWW.%C4%8Ce%C5%A1tina.cz&match=subdomain", sqldb.CertificateQuery{Domain: "www.xn--etina-gya30d.cz", Subdomains: true, Limit: API_DEFAULT_LIMIT}, false},
+		{"serial=00:0A:bc", sqldb.CertificateQuery{SerialNumber: "abc", Limit: API_DEFAULT_LIMIT}, false},
+		{"serial=00", sqldb.CertificateQuery{SerialNumber: "0", Limit: API_DEFAULT_LIMIT}, false},
+		{"valid_from=2026-01-02&valid_to=2026-01-03T04:05:06%2B02:00", sqldb.CertificateQuery{ValidFrom: "2026-01-02 00:00:00", ValidTo: "2026-01-03 02:05:06", Limit: API_DEFAULT_LIMIT}, false},
+		{"limit=1000&cursor=42", sqldb.CertificateQuery{Limit: 1000, After: 42}, false},
+		{"domain=not%20a%20domain", sqldb.CertificateQuery{}, true},
+		{"match=regex", sqldb.CertificateQuery{}, true},
+		{"serial=xyz", sqldb.CertificateQuery{}, true},
+		{"fingerprint=abcd", sqldb.CertificateQuery{}, true},
+		{"valid_from=yesterday", sqldb.CertificateQuery{}, true},
+		{"limit=0", sqldb.CertificateQuery{}, true},
+		{"limit=1001", sqldb.CertificateQuery{}, true},
+		{"cursor=-1", sqldb.CertificateQuery{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseCertificateQuery(httptest.NewRequest(http.MethodGet, "/api/certificates?"+tt.query, nil))
+		if (err != nil) != tt.wantErr || (!tt.wantErr && got != tt.want) {
+			t.Errorf("parseCertificateQuery(%q) = %+v, %v, want %+v, error %v", tt.query, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
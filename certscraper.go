@@ -1,26 +1,83 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
-	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
-)
 
-var Wd sync.WaitGroup
-var Wp sync.WaitGroup
-var Wo sync.WaitGroup
-var Wg sync.WaitGroup
+	"golang.org/x/sync/errgroup"
+)
 
 var httpClient *http.Client
 
+// Ranges of a log are split into batches of at least this many entries, the most a log usually returns at once
+const MIN_BATCH_SIZE = 256
+
+// Batches of ranges over this many entries are started 500ms apart, so a log is not hit by every downloader at once.
+// Smaller ranges, like the new entries the watch mode polls, start right away.
+const SPACED_RANGE = 10000
+
+// Counters of a log within a run, updated atomically, and the progress of its batches
+type logStats struct {
+	downloaded    int64
+	parseFailures int64
+	// First error of a batch, set once all batches are done
+	err error
+
+	mu      sync.Mutex
+	batches map[int64]*batchProgress
+}
+
+// Progress of a batch keyed by its first index, next is the first index not yet sent to the parsers
+type batchProgress struct {
+	end  int64
+	next int64
+}
+
+// Registers a batch before it starts downloading
+func (s *logStats) addBatch(start int64, end int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.batches == nil {
+		s.batches = make(map[int64]*batchProgress)
+	}
+	s.batches[start] = &batchProgress{end: end, next: start}
+}
+
+// Records that the entries of the batch before next were sent to the parsers
+func (s *logStats) advance(start int64, next int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.batches[start].next = next
+}
+
+// Returns the last index after previousIndex up to which every entry was sent to the parsers
+func (s *logStats) completedHead(previousIndex int64) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	head := previousIndex
+	for {
+		b, ok := s.batches[head+1]
+		if !ok {
+			return head
+		}
+		if b.next <= b.end {
+			return b.next - 1
+		}
+		head = b.end
+	}
+}
+
 // Information needed for a download of a batch of entries
 type CTBatchData struct {
 	Url        string
@@ -32,6 +89,12 @@ type CTBatchData struct {
 type CTEntry struct {
 	LeafInput []byte `json:"leaf_input"`
 	ExtraData []byte `json:"extra_data"`
+
+	// Where the entry comes from, filled in by the downloader
+	LogUrl string `json:"-"`
+	Index  int64  `json:"-"`
+	// Whether the entry is being reprocessed from the quarantine
+	Quarantined bool `json:"-"`
 }
 
 // An array of entries
@@ -54,8 +117,9 @@ type CTHead struct {
 }
 
 // Downloads the entries as JSON.
-func downloadJSON(url string) ([]byte, error) {
-	req, err := http.NewRequest("GET", url, nil)
+// Failed requests are counted for the log.
+func downloadJSON(ctx context.Context, logurl string, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return []byte{}, err
 	}
@@ -64,11 +128,17 @@ func downloadJSON(url string) ([]byte, error) {
 
 	resp, err := httpClient.Do(req)
 	if err != nil {
+		metricHTTPErrors.WithLabelValues(logurl, "none").Inc()
 		return []byte{}, err
 	}
 
 	defer resp.Body.Close()
 
+	// The body is still returned, logs explain some errors in it
+	if resp.StatusCode != http.StatusOK {
+		metricHTTPErrors.WithLabelValues(logurl, strconv.Itoa(resp.StatusCode)).Inc()
+	}
+
 	content, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return []byte{}, err
@@ -78,11 +148,11 @@ func downloadJSON(url string) ([]byte, error) {
 }
 
 // Downloads entries and returns them.
-func DownloadEntries(url string) (CTEntries, error) {
+func DownloadEntries(ctx context.Context, logurl string, url string) (CTEntries, error) {
 	var entries CTEntries
 	var entriesError CTEntriesError
 
-	data, err := downloadJSON(url)
+	data, err := downloadJSON(ctx, logurl, url)
 	if err != nil {
 		return entries, err
 	}
@@ -100,10 +170,10 @@ func DownloadEntries(url string) (CTEntries, error) {
 }
 
 // Downloads the Tree Head of the log.
-func DownloadSTH(logurl string) (CTHead, error) {
+func DownloadSTH(ctx context.Context, logurl string) (CTHead, error) {
 	var sth CTHead
 	url := fmt.Sprintf("%sct/v1/get-sth", logurl)
-	data, err := downloadJSON(url)
+	data, err := downloadJSON(ctx, logurl, url)
 	if err != nil {
 		return sth, err
 	}
@@ -121,22 +191,40 @@ func CreateClient() {
 	httpClient = &http.Client{Transport: tr}
 }
 
+// Waits for the duration, returns false if the context is cancelled first
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
 // Download entries and send them to the parsers
 // Download in the maximum batch sizes
-func downloadBatch(start int64, end int64, logurl string, c_parse chan<- CTEntry) {
-	defer Wd.Done()
+// Stops when the downloads are stopped, the progress of the batch tells how far it got
+// Returns an error if the entries could not be downloaded
+func (p *Pipeline) downloadBatch(start int64, end int64, logurl string, stats *logStats) error {
+	ctx := p.downloadCtx
+	logger := p.logger.With("log_url", logurl, "start", start, "end", end)
 	cur := start
 	const RETRY_WAIT = 2
 
 	// We increase the index by the number of entries we got from the request
 	// That means the download speed will most likely not be linear
-	for cur <= end {
+	for cur <= end && ctx.Err() == nil {
 		url := fmt.Sprintf("%sct/v1/get-entries?start=%d&end=%d", logurl, cur, end)
-		entries, err := DownloadEntries(url)
+		entries, err := DownloadEntries(ctx, logurl, url)
 
 		attempts := 0
 		for err != nil {
-			time.Sleep(time.Duration(RETRY_WAIT*attempts) * time.Second)
+			if !sleepContext(ctx, time.Duration(RETRY_WAIT*attempts)*time.Second) {
+				return nil
+			}
 
 			// Common errors, we don't have to log them
 			// < = <null>
@@ -147,44 +235,74 @@ func downloadBatch(start int64, end int64, logurl string, c_parse chan<- CTEntry
 			//}
 
 			if attempts%5 == 0 {
-				log.Printf("[-] (%d) Failed to download entries for %s -> %s\n", attempts, url, err)
+				logger.Debug("Failed to download entries, retrying", "from", cur, "attempt", attempts, "err", err)
 			}
 
-			entries, err = DownloadEntries(url)
+			metricRetries.WithLabelValues(logurl).Inc()
+			entries, err = DownloadEntries(ctx, logurl, url)
 			attempts++
 			if attempts >= 20 {
-				log.Printf("[-] Failed to download entries for %s -> %s\n", url, err)
-				return
+				logger.Error("Failed to download entries", "from", cur, "attempt", attempts, "err", err)
+				return fmt.Errorf("downloading entries from %d -> %w", cur, err)
 			}
 		}
 
-		cur += int64(len(entries.Entries))
-
 		for i := range entries.Entries {
-			c_parse <- entries.Entries[i]
+			entries.Entries[i].LogUrl = logurl
+			entries.Entries[i].Index = cur + int64(i)
+			if !p.Queue(entries.Entries[i]) {
+				return nil
+			}
 		}
 
-		time.Sleep(time.Duration(1) * time.Second)
+		cur += int64(len(entries.Entries))
+		stats.advance(start, cur)
+		atomic.AddInt64(&stats.downloaded, int64(len(entries.Entries)))
+		metricDownloaded.WithLabelValues(logurl).Add(float64(len(entries.Entries)))
+
+		if cur <= end {
+			sleepContext(ctx, time.Duration(1)*time.Second)
+		}
 	}
+	return nil
 }
 
-// Launch for each log, split the log into chunks, launch goroutine for each chunk
-func distributeWork(previousIndex int64, newIndex int64, downloaderCount int64, logurl string, c_parse chan<- CTEntry, db *sql.DB) {
-	defer Wg.Done()
-
+// Split the log into chunks, download each chunk in its own goroutine and wait for them
+// No more chunks are launched once the downloads are stopped
+// The first error of a chunk is recorded in the stats of the log
+func (p *Pipeline) downloadLog(logurl string, previousIndex int64, newIndex int64, downloaderCount int64) {
+	stats := p.logs[logurl]
 	if previousIndex == newIndex {
 		return
 	}
 
-	batchSize := (newIndex - previousIndex + downloaderCount - 1) / downloaderCount
+	var g errgroup.Group
+	size := newIndex - previousIndex
+	batchSize := (size + downloaderCount - 1) / downloaderCount
+	if batchSize < MIN_BATCH_SIZE {
+		batchSize = MIN_BATCH_SIZE
+	}
 	for start := previousIndex + 1; start <= newIndex; start += batchSize {
 		end := start + batchSize - 1
 		if end > newIndex {
 			end = newIndex
 		}
 
-		go downloadBatch(start, end, logurl, c_parse)
-		Wd.Add(1)
-		time.Sleep(time.Duration(500) * time.Millisecond)
+		start := start
+		stats.addBatch(start, end)
+		g.Go(func() error {
+			return p.downloadBatch(start, end, logurl, stats)
+		})
+		if size <= SPACED_RANGE {
+			if p.downloadCtx.Err() != nil {
+				break
+			}
+			continue
+		}
+		if !sleepContext(p.downloadCtx, time.Duration(500)*time.Millisecond) {
+			break
+		}
 	}
+
+	stats.err = g.Wait()
 }
@@ -0,0 +1,136 @@
+package sqldb
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/stdlib"
+)
+
+// Session-local table the batches are copied into before they are merged into Downloaded,
+// IP addresses are cast to inet in the merge
+const stagingTable = `
+CREATE TEMP TABLE IF NOT EXISTS Staging (
+	CN             text,
+	DN             text,
+	SerialNumber   text,
+	SAN            text[],
+	UnicodeSAN     text[],
+	NotBefore      text,
+	NotAfter       text,
+	Issuer         text,
+	Raw            text,
+	Organization   text[],
+	AuthorityKeyID text,
+	SPKIHash       text,
+	Lint           text[],
+	IPAddresses    text[],
+	EmailAddresses text[],
+	URIs           text[],
+	UnicodeCN      text
+) ON COMMIT DELETE ROWS`
+
+var stagingColumns = []string{
+	"cn", "dn", "serialnumber", "san", "unicodesan", "notbefore", "notafter", "issuer", "raw",
+	"organization", "authoritykeyid", "spkihash", "lint", "ipaddresses", "emailaddresses", "uris", "unicodecn",
+}
+
+// Moves the staged certificates not downloaded yet into Downloaded.
+// Rows are taken in key order, so concurrent merges lock the same keys in the same order.
+const mergeStaging = `
+INSERT INTO Downloaded (CN, DN, SerialNumber, SAN, UnicodeSAN, NotBefore, NotAfter, Issuer, Raw,
+	Organization, AuthorityKeyID, SPKIHash, Lint, IPAddresses, EmailAddresses, URIs, UnicodeCN)
+SELECT DISTINCT ON (SerialNumber, Issuer) CN, DN, SerialNumber, SAN, UnicodeSAN, NotBefore, NotAfter, Issuer, Raw,
+	Organization, AuthorityKeyID, SPKIHash, Lint, IPAddresses::inet[], EmailAddresses, URIs, UnicodeCN
+FROM Staging
+ORDER BY SerialNumber, Issuer
+ON CONFLICT DO NOTHING`
+
+// Inserts a single certificate, used when a batch can not be merged
+const insertOne = `
+INSERT INTO Downloaded (CN, DN, SerialNumber, SAN, UnicodeSAN, NotBefore, NotAfter, Issuer, Raw,
+	Organization, AuthorityKeyID, SPKIHash, Lint, IPAddresses, EmailAddresses, URIs, UnicodeCN)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14::text[]::inet[], $15, $16, $17)
+ON CONFLICT DO NOTHING`
+
+// Writes downloaded certificates in batches. Every inserter holds a connection of its own with its staging table,
+// several inserters can write at once.
+type pgInserter struct {
+	conn *sql.Conn
+}
+
+// Takes a connection from the pool and creates its staging table.
+func (p *Postgres) NewInserter(ctx context.Context) (Inserter, error) {
+	conn, err := p.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.ExecContext(ctx, stagingTable); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &pgInserter{conn}, nil
+}
+
+// Returns the connection to the pool.
+func (i *pgInserter) Close() error {
+	return i.conn.Close()
+}
+
+// Copies the certificates into the staging table and merges them into Downloaded in one transaction,
+// duplicates are ignored. If the batch can not be merged, the certificates are inserted one by one and
+// the failing ones are logged. Returns the number of certificates written, duplicates are not counted.
+func (i *pgInserter) Insert(ctx context.Context, certs []CertInfo) (int, error) {
+	var merged int64
+	err := i.conn.Raw(func(driverConn interface{}) error {
+		var err error
+		merged, err = copyBatch(ctx, driverConn.(*stdlib.Conn).Conn(), certs)
+		return err
+	})
+	if err == nil {
+		return int(merged), nil
+	}
+	slog.Warn("Failed merging batch, inserting certificates one by one", "count", len(certs), "err", err)
+
+	written := 0
+	for _, c := range certs {
+		res, err := i.conn.ExecContext(ctx, insertOne, c.CN, c.DN, c.SerialNumber, c.SAN, c.UnicodeSAN, c.NotBefore, c.NotAfter,
+			c.Issuer, c.Raw, c.Organization, c.AuthorityKeyID, c.SPKIHash, c.Lint, c.IPAddresses, c.EmailAddresses, c.URIs, c.UnicodeCN)
+		if err != nil {
+			if ctx.Err() != nil {
+				return written, ctx.Err()
+			}
+			slog.Error("Failed saving certificate", "cn", c.CN, "dn", c.DN, "san", c.SAN, "serial", c.SerialNumber, "err", err)
+			continue
+		}
+		if n, err := res.RowsAffected(); err == nil {
+			written += int(n)
+		}
+	}
+	return written, nil
+}
+
+// Returns the number of certificates merged into Downloaded
+func copyBatch(ctx context.Context, conn *pgx.Conn, certs []CertInfo) (int64, error) {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	rows := make([][]interface{}, len(certs))
+	for n, c := range certs {
+		rows[n] = []interface{}{c.CN, c.DN, c.SerialNumber, c.SAN, c.UnicodeSAN, c.NotBefore, c.NotAfter, c.Issuer, c.Raw,
+			c.Organization, c.AuthorityKeyID, c.SPKIHash, c.Lint, c.IPAddresses, c.EmailAddresses, c.URIs, c.UnicodeCN}
+	}
+	if _, err := tx.CopyFrom(ctx, pgx.Identifier{"staging"}, stagingColumns, pgx.CopyFromRows(rows)); err != nil {
+		return 0, err
+	}
+	tag, err := tx.Exec(ctx, mergeStaging)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), tx.Commit(ctx)
+}
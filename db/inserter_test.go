@@ -0,0 +1,38 @@
+package sqldb
+
+import (
+	"context"
+	"testing"
+)
+
+// Like the merge of the PostgreSQL inserter, duplicates within a batch and certificates downloaded before are not counted
+func TestInserterCountsWritten(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t)
+	ins, err := s.NewInserter(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ins.Close()
+
+	precert := testCert(1, "www.example.com")
+	precert.CN = "precertificate"
+	batches := []struct {
+		certs []CertInfo
+		want  int
+	}{
+		{[]CertInfo{testCert(1, "www.example.com"), testCert(2, "mail.example.com"), precert}, 2},
+		{[]CertInfo{testCert(2, "mail.example.com"), testCert(3, "example.org")}, 1},
+		{[]CertInfo{testCert(3, "example.org")}, 0},
+	}
+	for i, b := range batches {
+		if n, err := ins.Insert(ctx, b.certs); err != nil || n != b.want {
+			t.Errorf("Insert() of batch %d = %d, %v, want %d", i, n, err, b.want)
+		}
+	}
+
+	count := 0
+	if err := s.EachDownloaded(ctx, func(CertInfo) error { count++; return nil }); err != nil || count != 3 {
+		t.Errorf("%d certificates downloaded, %v, want 3", count, err)
+	}
+}
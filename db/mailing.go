@@ -1,16 +1,21 @@
 package sqldb
 
 import (
+	"ctlog/match"
+	"ctlog/verify"
 	"gopkg.in/gomail.v2"
-	"log"
+	"html"
 	"os"
 	"os/exec"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 )
 
-const sendmail = "/usr/sbin/sendmail"
+// Program the emails are piped to, with the recipients read from the headers
+var Sendmail = "/usr/sbin/sendmail"
+
 const bodyStart = `
 	<head>
 		<style>
@@ -42,14 +47,14 @@ const bodyStart = `
 `
 
 const bodyEnd = `
-	<a href="pki.cesnet.cz">O službě</a>
-	<img src="https://www.cesnet.cz/wp-content/uploads/2018/01/cesnet-malelogo.jpg
+	<a href="https://pki.cesnet.cz">O službě</a>
+	<img src="https://www.cesnet.cz/wp-content/uploads/2018/01/cesnet-malelogo.jpg">
 </body>
 `
 
 // Use sendmail to send emails.
 func submitMail(m *gomail.Message) (err error) {
-	cmd := exec.Command(sendmail, "-t")
+	cmd := exec.Command(Sendmail, "-t")
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
@@ -82,35 +87,137 @@ func submitMail(m *gomail.Message) (err error) {
 }
 
 // Send out the certificate informations to the email monitoring them.
-func SendEmail(info MonitoredCerts) {
+// With a public URL the email carries RFC 8058 one-click List-Unsubscribe headers, which unsubscribe
+// from all monitors of the email, not only the ones in this email, and a footer with a link for each
+// monitor in the email and one for all.
+func SendEmail(info MonitoredCerts, u *Unsubscriber) error {
 	if info.Email == "" {
-		return
+		return nil
 	}
 
 	t := time.Now().Add(-24 * time.Hour)
 	date := strings.Join([]string{strconv.Itoa(t.Day()), strconv.Itoa(int(t.Month())), strconv.Itoa(t.Year())}, ".")
 
+	// Policy violations go first
+	sort.SliceStable(info.Certificates, func(i, j int) bool {
+		return info.Certificates[i].Reason.Priority() > info.Certificates[j].Reason.Priority()
+	})
+	violation := len(info.Certificates) > 0 && info.Certificates[0].Reason == match.ReasonPolicyViolation
+
 	m := gomail.NewMessage()
 	m.SetHeader("From", "no-reply@cesnet.cz")
 	m.SetHeader("To", info.Email)
-	m.SetHeader("Subject", "[CTLog] Nové certifikáty "+date)
+	if violation {
+		m.SetHeader("Subject", "[CTLog] Porušení politiky CA / CA policy violation "+date)
+		m.SetHeader("X-Priority", "1")
+		m.SetHeader("Importance", "high")
+	} else {
+		m.SetHeader("Subject", "[CTLog] Nové certifikáty "+date)
+	}
+	unsubscribeAll := u.AllLink(info.Email)
+	if unsubscribeAll != "" {
+		m.SetHeader("List-Unsubscribe", "<"+unsubscribeAll+">")
+		m.SetHeader("List-Unsubscribe-Post", "List-Unsubscribe=One-Click")
+	}
+
+	m.SetBody("text/html", emailBody(info, u, unsubscribeAll))
 
+	return submitMail(m)
+}
+
+// Returns the HTML body listing the certificates. Every value comes from a certificate or a monitor,
+// which anyone can put anything in, so all of them are escaped.
+func emailBody(info MonitoredCerts, u *Unsubscriber, unsubscribeAll string) string {
 	var sb strings.Builder
 
 	sb.WriteString(bodyStart)
 
+	item := func(label string, value string) {
+		sb.WriteString("<li>" + label + ": " + html.EscapeString(value) + "</li>")
+	}
 	for _, cur := range info.Certificates {
 		sb.WriteString("<ul>")
-		sb.WriteString(cur.CN)
-		sb.WriteString("<li>Subject DN: " + cur.DN + "</li>" +
-			"<li>Serial: " + cur.SerialNumber + "</li>" +
-			"<li>Names: " + cur.SAN + "</li>")
+		sb.WriteString(html.EscapeString(cur.UnicodeCN))
+		item("Subject DN", cur.DN)
+		item("Serial", cur.SerialNumber)
+		item("Issuer", cur.Issuer)
+		item("Names", strings.Join(cur.UnicodeSAN, ", "))
+		for _, san := range []struct {
+			label  string
+			values []string
+		}{{"IP", cur.IPAddresses}, {"Email", cur.EmailAddresses}, {"URI", cur.URIs}} {
+			if len(san.values) > 0 {
+				item(san.label, strings.Join(san.values, ", "))
+			}
+		}
+		if cur.Reason != match.ReasonMatch {
+			item("Důvod / Reason", string(cur.Reason))
+		}
+		for _, f := range cur.Lint {
+			item("Problém / Lint", f)
+		}
 		sb.WriteString("</ul>")
 	}
 
-	m.SetBody("text/html", sb.String())
+	if unsubscribeAll != "" {
+		sb.WriteString("<p>Odhlásit odběr / Unsubscribe: ")
+		for i, mon := range info.Monitors {
+			if i > 0 {
+				sb.WriteString(", ")
+			}
+			sb.WriteString(`<a href="` + html.EscapeString(u.Link(info.Email, []Monitor{mon})) + `">` + html.EscapeString(mon.Display) + "</a>")
+		}
+		sb.WriteString(`, <a href="` + html.EscapeString(unsubscribeAll) + `">všechny monitory / all monitors</a>`)
+		sb.WriteString("</p>")
+	}
+	sb.WriteString(bodyEnd)
+	return sb.String()
+}
+
+// Sends a new API key to its email with the link which signs in to the web interface by it.
+func SendAPIKey(email string, key string, loginLink string) error {
+	m := gomail.NewMessage()
+	m.SetHeader("From", "no-reply@cesnet.cz")
+	m.SetHeader("To", email)
+	m.SetHeader("Subject", "[CTLog] API klíč / API key")
+	m.SetBody("text/plain", "Dobrý den,\n\n"+
+		"pro správu monitorů adresy "+email+" přes API služby CTLog použijte hlavičku:\n"+
+		"To manage the monitors of "+email+" through the CTLog API, use the header:\n\n"+
+		"Authorization: Bearer "+key+"\n\n"+
+		"Přehled monitorů a nalezených certifikátů, odkaz platí 24 hodin /\n"+
+		"Overview of the monitors and found certificates, the link is valid for 24 hours:\n"+
+		loginLink+"\n\n"+
+		"Pokud jste o klíč nežádali, tento email ignorujte.\n"+
+		"If you did not ask for the key, ignore this email.\n")
+
+	return submitMail(m)
+}
 
-	if err := submitMail(m); err != nil {
-		log.Printf("[-] Failed sending email to %s -> %s", info.Email, err)
+// Asks the email of a monitor added through the API to confirm it by the link, and tells how to verify it.
+func SendConfirmation(monitor Monitor, link string) error {
+	m := gomail.NewMessage()
+	m.SetHeader("From", "no-reply@cesnet.cz")
+	m.SetHeader("To", monitor.Email)
+	m.SetHeader("Subject", "[CTLog] Potvrzení monitoru / Monitor confirmation "+monitor.Display)
+
+	var sb strings.Builder
+	sb.WriteString("Dobrý den,\n\n" +
+		"služba CTLog bude na tuto adresu posílat nové certifikáty (" + string(monitor.Kind) + " " + monitor.Display + ") po potvrzení odkazem:\n" +
+		"CTLog will send new certificates (" + string(monitor.Kind) + " " + monitor.Display + ") to this address once you confirm by the link:\n\n" +
+		link + "\n\n")
+	if monitor.VerifiedBy == "" {
+		if monitor.Kind == match.KindDomain {
+			sb.WriteString("Vlastnictví domény ověřte zveřejněním záznamu / Verify you own the domain by publishing the record\n\n" +
+				verify.Record(monitor.VerificationToken) + "\n\n" +
+				"v TXT záznamu / in a TXT record of " + verify.TXTLabel + "." + monitor.Value + "\n" +
+				"nebo na řádku / or on a line of http://" + monitor.Value + verify.WellKnownPath + "\n\n")
+		} else {
+			sb.WriteString("Monitor musí ověřit správce služby. / The monitor has to be verified by the administrator.\n\n")
+		}
 	}
+	sb.WriteString("Pokud jste o monitor nežádali, tento email ignorujte.\n" +
+		"If you did not ask for the monitor, ignore this email.\n")
+	m.SetBody("text/plain", sb.String())
+
+	return submitMail(m)
 }
@@ -0,0 +1,47 @@
+package sqldb
+
+import (
+	"context"
+	"ctlog/match"
+	"strings"
+	"testing"
+)
+
+func TestEmailBodyEscapes(t *testing.T) {
+	u, err := NewUnsubscriber(context.Background(), newTestStore(t), "https://ctlog.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := MonitoredCerts{
+		Email: "user@example.com",
+		Certificates: []MatchedCert{{
+			CertInfo: CertInfo{
+				UnicodeCN:      "<script>cn</script>",
+				DN:             "CN=<b>dn</b>",
+				SerialNumber:   "01",
+				Issuer:         `O="<i>issuer</i>"`,
+				UnicodeSAN:     []string{"<img src=x>.example.com"},
+				EmailAddresses: []string{"<a href='https://evil.example'>mail</a>"},
+				URIs:           []string{"https://example.com/?a=1&b=<2>"},
+				Lint:           []string{"malformed: <u>bad</u>"},
+			},
+			Reason: match.ReasonPolicyViolation,
+		}},
+		Monitors: []Monitor{
+			{Email: "user@example.com", Kind: match.KindOrganization, Value: "<o>", Display: "<o>"},
+			{Email: "user@example.com", Kind: match.KindDomain, Value: "example.com", Display: "example.com"},
+		},
+	}
+
+	body := emailBody(info, u, u.AllLink(info.Email))
+	for _, raw := range []string{"<script>", "<b>", "<i>", "<img src=x>", "<a href='https", "<2>", "<u>", "<o>"} {
+		if strings.Contains(body, raw) {
+			t.Errorf("the body contains %q unescaped", raw)
+		}
+	}
+	for _, escaped := range []string{"&lt;script&gt;cn&lt;/script&gt;", "CN=&lt;b&gt;dn&lt;/b&gt;", "a=1&amp;b=&lt;2&gt;", "&lt;o&gt;</a>"} {
+		if !strings.Contains(body, escaped) {
+			t.Errorf("the body does not contain %q", escaped)
+		}
+	}
+}
@@ -0,0 +1,462 @@
+package sqldb
+
+import (
+	"context"
+	"ctlog/match"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Returned when the monitor to change does not exist
+var ErrNoMonitor = errors.New("no such monitor")
+
+// Wrapped by the errors of monitored values and emails which are not valid
+var ErrInvalidMonitor = errors.New("invalid monitor")
+var ErrInvalidEmail = errors.New("invalid email")
+
+// Adds monitors of the values for the email.
+// Domains can be given in either IDNA form, mode and lookalike only apply to domain monitors.
+func AddMonitor(ctx context.Context, email string, kind match.Kind, values []string, mode match.Mode, lookalike match.Sensitivity, s Store) error {
+	if !emailRegex.MatchString(email) {
+		return fmt.Errorf("%w %q", ErrInvalidEmail, email)
+	}
+
+	for _, v := range values {
+		value, display, err := parseMonitorValue(kind, v)
+		if err != nil {
+			return err
+		}
+
+		err = s.SaveMonitor(ctx, Monitor{Email: email, Kind: kind, Value: value, Display: display, Mode: mode, Lookalike: lookalike})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Removes the monitor of the value for the email.
+func RemoveMonitor(ctx context.Context, email string, kind match.Kind, value string, s Store) error {
+	value, _, err := parseMonitorValue(kind, value)
+	if err != nil {
+		return err
+	}
+
+	found, err := s.DeleteMonitor(ctx, email, kind, value)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("%w: %s does not monitor %s %s", ErrNoMonitor, email, kind, value)
+	}
+	return nil
+}
+
+// Authorizes the CA, an issuer DN or a hex AKI, to issue certificates for the monitored domain of the email.
+// Certificates from any other CA are reported as policy violations.
+func AddAuthorizedCA(ctx context.Context, email string, domain string, ca string, s Store) error {
+	domain, _, err := parseMonitorValue(match.KindDomain, domain)
+	if err != nil {
+		return err
+	}
+	ca, err = match.ParseValue(match.KindIssuer, ca)
+	if err != nil {
+		return err
+	}
+
+	return s.SaveAuthorizedCA(ctx, email, domain, ca)
+}
+
+// Removes the CA from the authorized CAs of the monitored domain of the email.
+func RemoveAuthorizedCA(ctx context.Context, email string, domain string, ca string, s Store) error {
+	domain, _, err := parseMonitorValue(match.KindDomain, domain)
+	if err != nil {
+		return err
+	}
+	ca, err = match.ParseValue(match.KindIssuer, ca)
+	if err != nil {
+		return err
+	}
+
+	found, err := s.DeleteAuthorizedCA(ctx, email, domain, ca)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("%s does not authorize %s for %s", email, ca, domain)
+	}
+	return nil
+}
+
+// Returns the stored and the displayed form of a monitored value.
+func parseMonitorValue(kind match.Kind, value string) (string, string, error) {
+	if kind == match.KindDomain {
+		ascii, unicode, err := match.ParseDomain(value)
+		if err != nil {
+			return "", "", fmt.Errorf("%w: invalid domain %q -> %s", ErrInvalidMonitor, value, err)
+		}
+		return ascii, unicode, nil
+	}
+
+	v, err := match.ParseValue(kind, value)
+	if err != nil {
+		return "", "", fmt.Errorf("%w: %w", ErrInvalidMonitor, err)
+	}
+	return v, v, nil
+}
+
+// Key of the CA policy of a monitored domain of an email
+func policyKey(email string, domain string) string {
+	return email + "/" + domain
+}
+
+// A monitor a certificate was reported to
+type monitorHit struct {
+	// Index into the monitors of the matcher
+	monitor int
+	email   string
+	reason  match.Reason
+}
+
+// A domain monitor with lookalike detection, its domain is prepared once for all certificates
+type lookalikeMonitor struct {
+	monitor int
+	domain  match.LookalikeName
+}
+
+// Matches certificates against the monitors in memory while they are parsed, safe for concurrent use.
+// Domain monitors are looked up in a trie of their reversed labels, monitors of other kinds and lookalike
+// detection are checked one by one. Matched certificates are kept without their DER until SaveMatches saves them
+// in batches, NotifyMatches saves the rest and sends them out.
+type Matcher struct {
+	monitors []Monitor
+	// Indexes into monitors
+	domains    match.Trie
+	attributes []int
+	lookalikes []lookalikeMonitor
+	policies   map[string]match.Policy
+
+	mu    sync.Mutex
+	certs map[string]CertInfo
+	hits  map[string][]monitorHit
+	// Number of certificates saved by SaveMatches which were not saved before
+	saved int
+}
+
+// Loads the monitors and CA policies of the store into a matcher.
+func LoadMatcher(ctx context.Context, s Store) (*Matcher, error) {
+	monitors, err := s.Monitors(ctx)
+	if err != nil {
+		return nil, err
+	}
+	policies, err := s.Policies(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return newMatcher(monitors, policies), nil
+}
+
+func newMatcher(monitors []Monitor, policies map[string]match.Policy) *Matcher {
+	m := &Matcher{
+		monitors: monitors,
+		policies: policies,
+		certs:    make(map[string]CertInfo),
+		hits:     make(map[string][]monitorHit),
+	}
+	for i, mon := range monitors {
+		if mon.Kind != match.KindDomain {
+			m.attributes = append(m.attributes, i)
+			continue
+		}
+		m.domains.Add(mon.Value, i)
+		if mon.Lookalike != match.Off {
+			m.lookalikes = append(m.lookalikes, lookalikeMonitor{i, match.NewLookalikeName(mon.Value)})
+		}
+	}
+	return m
+}
+
+// Matches the certificate against the monitors and keeps it if any matched, reports whether one did.
+// Certificates from CAs a monitored domain does not authorize are policy violations.
+// annotate, if not nil, is called on a matched certificate before it is kept, so work needed
+// only for matched certificates is skipped for the rest.
+func (m *Matcher) Match(cert *CertInfo, annotate func(*CertInfo)) bool {
+	hits := m.hitsOf(*cert)
+	if len(hits) == 0 {
+		return false
+	}
+	if annotate != nil {
+		annotate(cert)
+	}
+
+	// A certificate comes from several logs and as a precertificate too, the first one is kept
+	key := cert.key()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.certs[key]; !ok {
+		kept := *cert
+		kept.Raw = ""
+		m.certs[key] = kept
+		m.hits[key] = hits
+	}
+	return true
+}
+
+// Saves the kept certificates with their recipients once at least batch of them are kept, and forgets them.
+// Certificates saved before are not notified again.
+func (m *Matcher) SaveMatches(ctx context.Context, s Store, batch int) error {
+	m.mu.Lock()
+	if len(m.certs) == 0 || len(m.certs) < batch {
+		m.mu.Unlock()
+		return nil
+	}
+	certs, hits := m.certs, m.hits
+	m.certs = make(map[string]CertInfo)
+	m.hits = make(map[string][]monitorHit)
+	m.mu.Unlock()
+
+	matches := make([]Match, 0, len(certs))
+	for key, cert := range certs {
+		matches = append(matches, Match{Cert: cert, Recipients: m.recipients(hits[key])})
+	}
+	saved, err := s.SaveMatches(ctx, matches)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.saved += saved
+	m.mu.Unlock()
+	return nil
+}
+
+// Returns the emails of the hits, each with its most urgent reason and the monitors which matched
+func (m *Matcher) recipients(hits []monitorHit) []Recipient {
+	var recipients []Recipient
+	// One certificate can match several monitors of the same email, it is reported for the most urgent reason
+	for email, reason := range mostUrgent(hits) {
+		r := Recipient{Email: email, Reason: reason}
+		seen := make(map[int]bool)
+		for _, h := range hits {
+			if h.email == email && !seen[h.monitor] {
+				seen[h.monitor] = true
+				r.Monitors = append(r.Monitors, m.monitors[h.monitor])
+			}
+		}
+		recipients = append(recipients, r)
+	}
+	return recipients
+}
+
+// Returns the monitors the certificate matches
+func (m *Matcher) hitsOf(cert CertInfo) []monitorHit {
+	var hits []monitorHit
+	names := cert.Names()
+
+	// The trie only narrows down the domain monitors, whether a name really matches is decided by the monitor's match mode
+	seen := make(map[int]bool)
+	for _, name := range names {
+		for _, i := range m.domains.Lookup(name) {
+			if seen[i] {
+				continue
+			}
+			seen[i] = true
+
+			mon := m.monitors[i]
+			rule := match.Rule{Domain: mon.Value, Mode: mon.Mode}
+			if !rule.Match(names) {
+				continue
+			}
+
+			reason := match.ReasonMatch
+			if !m.policies[policyKey(mon.Email, mon.Value)].Allows(cert.Attributes()) {
+				reason = match.ReasonPolicyViolation
+			}
+			hits = append(hits, monitorHit{i, mon.Email, reason})
+		}
+	}
+
+	if len(m.attributes) > 0 {
+		attributes := cert.Attributes()
+		for _, i := range m.attributes {
+			mon := m.monitors[i]
+			if reason, ok := attributes.Match(mon.Kind, mon.Value); ok {
+				hits = append(hits, monitorHit{i, mon.Email, reason})
+			}
+		}
+	}
+
+	if len(m.lookalikes) > 0 {
+		// The names are prepared once for all the monitors
+		prepared := make([]match.LookalikeName, len(names))
+		for i, name := range names {
+			prepared[i] = match.NewLookalikeName(name)
+		}
+		for _, l := range m.lookalikes {
+			mon := m.monitors[l.monitor]
+			if reason, ok := match.LookalikeNames(prepared, l.domain, mon.Lookalike); ok {
+				hits = append(hits, monitorHit{l.monitor, mon.Email, reason})
+			}
+		}
+	}
+	return hits
+}
+
+// Returns the most urgent reason each email was hit for
+func mostUrgent(hits []monitorHit) map[string]match.Reason {
+	reasons := make(map[string]match.Reason)
+	for _, h := range hits {
+		if r, ok := reasons[h.email]; !ok || h.reason.Priority() > r.Priority() {
+			reasons[h.email] = h.reason
+		}
+	}
+	return reasons
+}
+
+// Saves the certificates still kept by the matcher, then sends out the notifications not sent yet, grouped by email,
+// with links which unsubscribe from the monitors that matched. Notifications whose email failed are sent by the next run.
+// Returns the number of new matched certificates of the matcher and of emails sent
+func NotifyMatches(ctx context.Context, s Store, m *Matcher, u *Unsubscriber) (int, int, error) {
+	if err := m.SaveMatches(ctx, s, 0); err != nil {
+		return 0, 0, err
+	}
+	m.mu.Lock()
+	count := m.saved
+	m.mu.Unlock()
+
+	pending, err := s.PendingNotifications(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	slog.Info("Found new matched certificates", "count", count, "emails", len(pending))
+	sent := 0
+	for _, r := range pending {
+		if err := SendEmail(r, u); err != nil {
+			slog.Error("Failed sending email", "email", r.Email, "err", err)
+			continue
+		}
+		sent++
+
+		ids := make([]int64, len(r.Certificates))
+		for i, c := range r.Certificates {
+			ids[i] = c.ID
+		}
+		if err := s.MarkNotified(ctx, r.Email, ids); err != nil {
+			slog.Error("Failed marking email as sent", "email", r.Email, "err", err)
+		}
+	}
+	return count, sent, nil
+}
+
+// Returns the saved certificates matched by the confirmed and verified monitors of the email, newest first,
+// at most limit of them. Candidates are looked up by the domain and issuer monitors and matched like in a run,
+// certificates found only by other kinds of monitors or by lookalike detection are not looked up.
+func RecentMatches(ctx context.Context, email string, limit int, s Store) (MonitoredCerts, error) {
+	recent := MonitoredCerts{Email: email}
+
+	monitors, m, err := matcherOf(ctx, email, s)
+	if err != nil {
+		return recent, err
+	}
+	var queries []CertificateQuery
+	for _, mon := range monitors {
+		switch mon.Kind {
+		case match.KindDomain:
+			queries = append(queries, CertificateQuery{Domain: mon.Value, Subdomains: mon.Mode != match.Exact, Limit: limit})
+			// A wildcard name in the parent covers an exactly monitored domain
+			if _, parent, ok := strings.Cut(mon.Value, "."); ok && mon.Mode == match.Exact && strings.Contains(parent, ".") {
+				queries = append(queries, CertificateQuery{Domain: "*." + parent, Limit: limit})
+			}
+		case match.KindIssuer:
+			queries = append(queries, CertificateQuery{Issuer: mon.Value, Limit: limit})
+		}
+	}
+	candidates := make(map[int64]StoredCert)
+	for _, q := range queries {
+		certs, err := s.SearchCertificates(ctx, q)
+		if err != nil {
+			return recent, err
+		}
+		for _, c := range certs {
+			candidates[c.ID] = c
+		}
+	}
+
+	var ids []int64
+	for id := range candidates {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] > ids[j] })
+	for _, id := range ids {
+		if len(recent.Certificates) == limit {
+			break
+		}
+		cert := candidates[id].CertInfo
+		if reason, ok := mostUrgent(m.hitsOf(cert))[email]; ok {
+			recent.Certificates = append(recent.Certificates, MatchedCert{CertInfo: cert, Reason: reason})
+		}
+	}
+	return recent, nil
+}
+
+// Number of certificates SearchMatches reads at once
+const searchBatchSize = 1000
+
+// Returns the certificates of the query matched by the confirmed and verified monitors of the email, newest first,
+// at most q.Limit of them. At most scan certificates of the query are read, the returned cursor is the ID to continue
+// the query after, 0 once all certificates of the query were read.
+func SearchMatches(ctx context.Context, email string, q CertificateQuery, scan int, s Store) ([]StoredCert, int64, error) {
+	monitors, m, err := matcherOf(ctx, email, s)
+	if err != nil || len(monitors) == 0 {
+		return nil, 0, err
+	}
+
+	limit := q.Limit
+	var found []StoredCert
+	for scanned := 0; scanned < scan; {
+		q.Limit = min(searchBatchSize, scan-scanned)
+		certs, err := s.SearchCertificates(ctx, q)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, c := range certs {
+			scanned++
+			q.After = c.ID
+			if _, ok := mostUrgent(m.hitsOf(c.CertInfo))[email]; ok {
+				found = append(found, c)
+				if len(found) == limit {
+					return found, q.After, nil
+				}
+			}
+		}
+		if len(certs) < q.Limit {
+			return found, 0, nil
+		}
+	}
+	return found, q.After, nil
+}
+
+// Returns the confirmed and verified monitors of the email and a matcher of them
+func matcherOf(ctx context.Context, email string, s Store) ([]Monitor, *Matcher, error) {
+	all, err := s.MonitorsOf(ctx, email)
+	if err != nil {
+		return nil, nil, err
+	}
+	var monitors []Monitor
+	for _, mon := range all {
+		if mon.Confirmed && mon.VerifiedBy != "" {
+			monitors = append(monitors, mon)
+		}
+	}
+	policies, err := s.Policies(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return monitors, newMatcher(monitors, policies), nil
+}
@@ -0,0 +1,227 @@
+package sqldb
+
+import (
+	"context"
+	"ctlog/match"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Returns a certificate of the names valid in the first quarter of 2026
+func testCert(serial int, names ...string) CertInfo {
+	return CertInfo{
+		CN:           names[0],
+		DN:           "CN=" + names[0],
+		SerialNumber: strconv.Itoa(serial),
+		SAN:          names,
+		NotBefore:    "2026-01-01 00:00:00",
+		NotAfter:     "2026-04-01 00:00:00",
+		Issuer:       "CN=Test CA",
+	}
+}
+
+// Saves the certificate, IDs grow with the certificates saved
+func saveTestCert(t *testing.T, s Store, cert CertInfo) {
+	t.Helper()
+	if _, err := s.SaveCertificate(context.Background(), cert); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSearchMatchesScan(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t)
+	if err := AddMonitor(ctx, "user@example.com", match.KindDomain, []string{"example.com"}, match.DefaultMode, match.Off, s); err != nil {
+		t.Fatal(err)
+	}
+	saveTestCert(t, s, testCert(1, "www.example.com"))
+	for i := 2; i <= 6; i++ {
+		saveTestCert(t, s, testCert(i, "other.org"))
+	}
+
+	// The scan ends among the certificates of other.org, so the page is empty but continues
+	certs, next, err := SearchMatches(ctx, "user@example.com", CertificateQuery{Limit: 10}, 3, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 0 || next == 0 {
+		t.Fatalf("SearchMatches() = %d certificates, cursor %d, want none and a cursor", len(certs), next)
+	}
+	certs, next, err = SearchMatches(ctx, "user@example.com", CertificateQuery{Limit: 10, After: next}, 100, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 1 || certs[0].CN != "www.example.com" || next != 0 {
+		t.Errorf("SearchMatches() = %+v, cursor %d, want www.example.com and no cursor", certs, next)
+	}
+
+	// Unconfirmed or unverified monitors match nothing
+	certs, _, err = SearchMatches(ctx, "nobody@example.com", CertificateQuery{Limit: 10}, 100, s)
+	if err != nil || len(certs) != 0 {
+		t.Errorf("SearchMatches() of an email without monitors = %+v, %v", certs, err)
+	}
+}
+
+func TestSearchMatchesPages(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t)
+	if err := AddMonitor(ctx, "user@example.com", match.KindDomain, []string{"example.com"}, match.DefaultMode, match.Off, s); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 5; i++ {
+		saveTestCert(t, s, testCert(2*i, "www.example.com"))
+		saveTestCert(t, s, testCert(2*i+1, "other.org"))
+	}
+
+	// The certificates are read in batches larger than the page, the cursor is the last certificate returned
+	var serials []string
+	q := CertificateQuery{Limit: 2}
+	for page := 0; page < 5; page++ {
+		certs, next, err := SearchMatches(ctx, "user@example.com", q, 100, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range certs {
+			serials = append(serials, c.SerialNumber)
+		}
+		if next == 0 {
+			break
+		}
+		if next != certs[len(certs)-1].ID {
+			t.Errorf("cursor %d, want the ID of the last certificate %d", next, certs[len(certs)-1].ID)
+		}
+		q.After = next
+	}
+	if got := strings.Join(serials, ","); got != "10,8,6,4,2" {
+		t.Errorf("SearchMatches() pages = %s, want 10,8,6,4,2", got)
+	}
+}
+
+// Makes Sendmail a script which fails or which writes each email to a file of the returned directory
+func testSendmail(t *testing.T, fail bool) string {
+	t.Helper()
+	dir := t.TempDir()
+	body := "cat > \"$(mktemp " + dir + "/mail.XXXXXX)\"\n"
+	if fail {
+		body = "exit 1\n"
+	}
+	script := filepath.Join(dir, "sendmail")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\n"+body), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	sendmail := Sendmail
+	Sendmail = script
+	t.Cleanup(func() { Sendmail = sendmail })
+	return dir
+}
+
+func TestNotifyMatchesRetries(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t)
+	monitors := []Monitor{{Email: "user@example.com", Kind: match.KindDomain, Value: "example.com", Mode: match.DefaultMode}}
+	m := newMatcher(monitors, nil)
+
+	cert := testCert(1, "www.example.com")
+	cert.Raw = "3082"
+	if !m.Match(&cert, nil) {
+		t.Fatal("Match() = false")
+	}
+	if kept := m.certs[cert.key()]; kept.Raw != "" {
+		t.Errorf("kept certificate with its DER %q", kept.Raw)
+	}
+
+	// A batch is only saved once it is full
+	if err := m.SaveMatches(ctx, s, 2); err != nil || m.saved != 0 || len(m.certs) != 1 {
+		t.Fatalf("SaveMatches() of a partial batch = %v, saved %d, kept %d", err, m.saved, len(m.certs))
+	}
+
+	testSendmail(t, true)
+	count, sent, err := NotifyMatches(ctx, s, m, nil)
+	if err != nil || count != 1 || sent != 0 {
+		t.Fatalf("NotifyMatches() with a failing sendmail = %d, %d, %v, want 1, 0", count, sent, err)
+	}
+	pending, err := s.PendingNotifications(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || len(pending[0].Certificates) != 1 || len(pending[0].Monitors) != 1 ||
+		pending[0].Certificates[0].Reason != match.ReasonMatch || pending[0].Monitors[0].Value != "example.com" {
+		t.Fatalf("PendingNotifications() = %+v, want the certificate of example.com", pending)
+	}
+
+	// The next run matches the certificate again, it is not new but the email is sent
+	dir := testSendmail(t, false)
+	m = newMatcher(monitors, nil)
+	m.Match(&cert, nil)
+	count, sent, err = NotifyMatches(ctx, s, m, nil)
+	if err != nil || count != 0 || sent != 1 {
+		t.Fatalf("NotifyMatches() of the next run = %d, %d, %v, want 0, 1", count, sent, err)
+	}
+	if mails, _ := filepath.Glob(filepath.Join(dir, "mail.*")); len(mails) != 1 {
+		t.Errorf("%d emails sent, want 1", len(mails))
+	}
+	if pending, err := s.PendingNotifications(ctx); err != nil || len(pending) != 0 {
+		t.Errorf("PendingNotifications() after sending = %+v, %v, want none", pending, err)
+	}
+}
+
+func TestHitsOfPolicy(t *testing.T) {
+	monitors := []Monitor{{Email: "user@example.com", Kind: match.KindDomain, Value: "example.com", Mode: match.DefaultMode}}
+	cert := testCert(1, "www.example.com")
+
+	tests := []struct {
+		name   string
+		policy match.Policy
+		want   match.Reason
+	}{
+		{"no policy", nil, match.ReasonMatch},
+		{"an allowed CA", match.Policy{"CN=Other CA", "CN=Test CA"}, match.ReasonMatch},
+		{"a disallowed CA", match.Policy{"CN=Other CA"}, match.ReasonPolicyViolation},
+	}
+
+	for _, tt := range tests {
+		policies := map[string]match.Policy{}
+		if tt.policy != nil {
+			policies[policyKey("user@example.com", "example.com")] = tt.policy
+		}
+		hits := newMatcher(monitors, policies).hitsOf(cert)
+		if len(hits) != 1 || hits[0].reason != tt.want {
+			t.Errorf("hitsOf() with %s = %+v, want %s", tt.name, hits, tt.want)
+		}
+	}
+
+	// The policy of another email does not apply
+	policies := map[string]match.Policy{policyKey("other@example.com", "example.com"): {"CN=Other CA"}}
+	if hits := newMatcher(monitors, policies).hitsOf(cert); len(hits) != 1 || hits[0].reason != match.ReasonMatch {
+		t.Errorf("hitsOf() with a policy of another email = %+v, want %s", hits, match.ReasonMatch)
+	}
+}
+
+func TestMatchCIDR(t *testing.T) {
+	monitors := []Monitor{
+		{Email: "user@example.com", Kind: match.KindCIDR, Value: "192.0.2.0/24"},
+		// Monitors are parsed when they are added, a malformed one only matches nothing
+		{Email: "broken@example.com", Kind: match.KindCIDR, Value: "192.0.2.0/33"},
+	}
+	m := newMatcher(monitors, nil)
+
+	cert := testCert(1, "www.example.org")
+	cert.IPAddresses = []string{"198.51.100.1", "192.0.2.10"}
+	hits := m.hitsOf(cert)
+	if len(hits) != 1 || hits[0].email != "user@example.com" || hits[0].reason != match.ReasonCIDR {
+		t.Errorf("hitsOf() of an IP SAN in the range = %+v, want user@example.com for %s", hits, match.ReasonCIDR)
+	}
+
+	cert.IPAddresses = []string{"198.51.100.1"}
+	if hits := m.hitsOf(cert); len(hits) != 0 {
+		t.Errorf("hitsOf() of an IP SAN outside the range = %+v, want none", hits)
+	}
+
+	if _, _, err := parseMonitorValue(match.KindCIDR, "192.0.2.0/33"); !errors.Is(err, ErrInvalidMonitor) {
+		t.Errorf("parseMonitorValue() of a malformed range = %v, want %v", err, ErrInvalidMonitor)
+	}
+}
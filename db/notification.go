@@ -0,0 +1,113 @@
+package sqldb
+
+import (
+	"context"
+	"ctlog/match"
+	"database/sql"
+	"strings"
+)
+
+// A matched certificate to save with the emails to notify of it
+type Match struct {
+	Cert       CertInfo
+	Recipients []Recipient
+}
+
+// An email to notify of a matched certificate
+type Recipient struct {
+	Email string
+	// The most urgent reason of the monitors of the email which matched
+	Reason   match.Reason
+	Monitors []Monitor
+}
+
+// Runs queries of a database or of a transaction
+type querier interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// Saves the matches in one transaction, insert saves a certificate like insertPostgresCertificate.
+func (s *sqlStore) saveMatches(ctx context.Context, matches []Match, insert func(context.Context, querier, CertInfo) (int64, bool, error)) (int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	saved := 0
+	for _, m := range matches {
+		id, ok, err := insert(ctx, tx, m.Cert)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			continue
+		}
+		saved++
+
+		for _, r := range m.Recipients {
+			lines := make([]string, len(r.Monitors))
+			for i, mon := range r.Monitors {
+				lines[i] = monitorLine(mon)
+			}
+			_, err := tx.ExecContext(ctx, "INSERT INTO Notification (CertificateID, Email, Reason, Monitors) VALUES ($1, $2, $3, $4)",
+				id, r.Email, string(r.Reason), strings.Join(lines, "\n"))
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	return saved, tx.Commit()
+}
+
+// Reads the notifications not sent yet, joined to Certificate D of the dialect.
+func (s *sqlStore) pendingNotifications(ctx context.Context, d searchDialect) ([]MonitoredCerts, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT "+d.columns+", D.Fingerprint, "+d.id+", N.Email, N.Reason, N.Monitors"+
+		" FROM Notification N JOIN Certificate D ON "+d.id+" = N.CertificateID"+
+		" WHERE NOT N.Notified ORDER BY N.Email, "+d.id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pending []MonitoredCerts
+	var seen map[string]bool
+	for rows.Next() {
+		var c MatchedCert
+		var email, reason, monitors string
+		if err := scanCertInfo(rows, &c.CertInfo, &c.Fingerprint, &c.ID, &email, &reason, &monitors); err != nil {
+			return nil, err
+		}
+		c.Reason = match.Reason(reason)
+
+		if len(pending) == 0 || pending[len(pending)-1].Email != email {
+			pending = append(pending, MonitoredCerts{Email: email})
+			seen = make(map[string]bool)
+		}
+		r := &pending[len(pending)-1]
+		r.Certificates = append(r.Certificates, c)
+		for _, line := range strings.Split(monitors, "\n") {
+			if mon, ok := parseMonitorLine(email, line); ok && !seen[line] {
+				seen[line] = true
+				r.Monitors = append(r.Monitors, mon)
+			}
+		}
+	}
+	return pending, rows.Err()
+}
+
+func (s *sqlStore) MarkNotified(ctx context.Context, email string, ids []int64) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, id := range ids {
+		_, err := tx.ExecContext(ctx, "UPDATE Notification SET Notified = TRUE WHERE CertificateID = $1 AND Email = $2", id, email)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
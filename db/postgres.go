@@ -0,0 +1,131 @@
+package sqldb
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	_ "github.com/jackc/pgx/v4/stdlib"
+)
+
+// Store in a PostgreSQL database, downloaded certificates are copied in by batches.
+type Postgres struct {
+	sqlStore
+}
+
+// Creates a connection to the database and returns it.
+func ConnectToDatabase(ctx context.Context, database string) (*Postgres, error) {
+	db, err := sql.Open("pgx", database)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Postgres{sqlStore{db}}, nil
+}
+
+// Columns of Downloaded or Certificate aliased D, read by scanCertInfo
+const downloadedColumns = `D.CN, COALESCE(D.UnicodeCN, D.CN), D.DN, D.SerialNumber, array_to_json(D.SAN), array_to_json(D.UnicodeSAN),
+	D.NotBefore, D.NotAfter, D.Issuer, array_to_json(D.Organization), D.AuthorityKeyID, D.SPKIHash,
+	array_to_json(D.Lint), array_to_json(D.IPAddresses), array_to_json(D.EmailAddresses), array_to_json(D.URIs)`
+
+// Scans the columns of a certificate with its arrays in JSON, followed by any extra columns.
+func scanCertInfo(rows *sql.Rows, cert *CertInfo, extra ...interface{}) error {
+	var san, unicodeSAN, organization, lint, ips, emails, uris []byte
+	dest := append([]interface{}{
+		&cert.CN, &cert.UnicodeCN, &cert.DN, &cert.SerialNumber, &san, &unicodeSAN,
+		&cert.NotBefore, &cert.NotAfter, &cert.Issuer, &organization, &cert.AuthorityKeyID, &cert.SPKIHash,
+		&lint, &ips, &emails, &uris,
+	}, extra...)
+	if err := rows.Scan(dest...); err != nil {
+		return err
+	}
+
+	return unmarshalArrays(map[*[]string][]byte{
+		&cert.SAN:            san,
+		&cert.UnicodeSAN:     unicodeSAN,
+		&cert.Organization:   organization,
+		&cert.Lint:           lint,
+		&cert.IPAddresses:    ips,
+		&cert.EmailAddresses: emails,
+		&cert.URIs:           uris,
+	})
+}
+
+func (p *Postgres) EachDownloaded(ctx context.Context, fn func(CertInfo) error) error {
+	rows, err := p.db.QueryContext(ctx, "SELECT "+downloadedColumns+" FROM Downloaded D")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cert CertInfo
+		if err := scanCertInfo(rows, &cert); err != nil {
+			return err
+		}
+		if err := fn(cert); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (p *Postgres) SaveCertificate(ctx context.Context, cert CertInfo) (bool, error) {
+	_, saved, err := insertPostgresCertificate(ctx, p.db, cert)
+	return saved, err
+}
+
+func (p *Postgres) SaveMatches(ctx context.Context, matches []Match) (int, error) {
+	return p.saveMatches(ctx, matches, insertPostgresCertificate)
+}
+
+// Inserts the certificate, returns its ID and reports whether it was not saved before
+func insertPostgresCertificate(ctx context.Context, q querier, cert CertInfo) (int64, bool, error) {
+	var id int64
+	err := q.QueryRowContext(ctx, `
+	INSERT INTO Certificate (CN, DN, SerialNumber, SAN, UnicodeSAN, NotBefore, NotAfter, Issuer,
+		Organization, AuthorityKeyID, SPKIHash, Lint, IPAddresses, EmailAddresses, URIs, Fingerprint, UnicodeCN)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13::text[]::inet[], $14, $15, $16, $17)
+	ON CONFLICT DO NOTHING
+	RETURNING ID`,
+		cert.CN, cert.DN, cert.SerialNumber, cert.SAN, cert.UnicodeSAN, cert.NotBefore, cert.NotAfter, cert.Issuer,
+		cert.Organization, cert.AuthorityKeyID, cert.SPKIHash, cert.Lint, cert.IPAddresses, cert.EmailAddresses, cert.URIs,
+		cert.Fingerprint, cert.UnicodeCN).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	return id, err == nil, err
+}
+
+// Times are compared as text, in the C collation they sort like the times they hold.
+var postgresDialect = searchDialect{
+	columns: downloadedColumns,
+	id:      "D.ID",
+	names:   "unnest(D.SAN || lower(D.CN)) AS N",
+	collate: ` COLLATE "C"`,
+}
+
+func (p *Postgres) SearchCertificates(ctx context.Context, q CertificateQuery) ([]StoredCert, error) {
+	return p.searchCertificates(ctx, q, postgresDialect)
+}
+
+func (p *Postgres) PendingNotifications(ctx context.Context) ([]MonitoredCerts, error) {
+	return p.pendingNotifications(ctx, postgresDialect)
+}
+
+func (p *Postgres) DeleteFinishedRuns(ctx context.Context, before time.Time) (int64, error) {
+	res, err := p.db.ExecContext(ctx, "DELETE FROM Run WHERE Status <> $1 AND FinishedAt < $2", RunRunning, before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (p *Postgres) DeleteExpiredCertificates(ctx context.Context) error {
+	_, err := p.db.ExecContext(ctx, "DELETE FROM Certificate WHERE now() > to_date(NotAfter, 'YYYY-MM-DD HH24:MI:SS');")
+	return err
+}
@@ -0,0 +1,46 @@
+package sqldb
+
+import "context"
+
+// A log entry which could not be parsed
+type QuarantinedEntry struct {
+	LogUrl    string
+	Index     int64
+	LeafInput []byte
+	ExtraData []byte
+	Error     string
+}
+
+// Saves the raw entry and the reason it could not be parsed, so it can be reprocessed later.
+func (s *sqlStore) QuarantineEntry(ctx context.Context, entry QuarantinedEntry) error {
+	_, err := s.db.ExecContext(ctx, `
+	INSERT INTO Quarantine (LogUrl, EntryIndex, LeafInput, ExtraData, Error) VALUES ($1, $2, $3, $4, $5)
+	ON CONFLICT (LogUrl, EntryIndex) DO UPDATE SET Error = EXCLUDED.Error, QuarantinedAt = CURRENT_TIMESTAMP`,
+		entry.LogUrl, entry.Index, entry.LeafInput, entry.ExtraData, entry.Error)
+	return err
+}
+
+// Returns all quarantined entries.
+func (s *sqlStore) LoadQuarantine(ctx context.Context) ([]QuarantinedEntry, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT LogUrl, EntryIndex, LeafInput, ExtraData, Error FROM Quarantine ORDER BY LogUrl, EntryIndex")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []QuarantinedEntry
+	for rows.Next() {
+		var e QuarantinedEntry
+		if err := rows.Scan(&e.LogUrl, &e.Index, &e.LeafInput, &e.ExtraData, &e.Error); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// Removes an entry which was parsed successfully from the quarantine.
+func (s *sqlStore) ReleaseQuarantinedEntry(ctx context.Context, logurl string, index int64) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM Quarantine WHERE LogUrl = $1 AND EntryIndex = $2", logurl, index)
+	return err
+}
@@ -0,0 +1,43 @@
+package sqldb
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestQuarantine(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t)
+
+	entries := []QuarantinedEntry{
+		{LogUrl: "https://log.example/", Index: 1, LeafInput: []byte("leaf"), ExtraData: []byte("extra"), Error: "bad"},
+		// Logs may send no extra data
+		{LogUrl: "https://log.example/", Index: 2, LeafInput: []byte("leaf"), Error: "bad"},
+	}
+	for _, e := range entries {
+		if err := s.QuarantineEntry(ctx, e); err != nil {
+			t.Fatalf("QuarantineEntry(%d) = %v", e.Index, err)
+		}
+	}
+	// Quarantined again with another error
+	entries[0].Error = "worse"
+	if err := s.QuarantineEntry(ctx, entries[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := s.LoadQuarantine(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != 2 || loaded[0].Error != "worse" || !bytes.Equal(loaded[0].ExtraData, []byte("extra")) || loaded[1].ExtraData != nil {
+		t.Fatalf("LoadQuarantine() = %+v", loaded)
+	}
+
+	if err := s.ReleaseQuarantinedEntry(ctx, "https://log.example/", 1); err != nil {
+		t.Fatal(err)
+	}
+	if loaded, err := s.LoadQuarantine(ctx); err != nil || len(loaded) != 1 || loaded[0].Index != 2 {
+		t.Errorf("LoadQuarantine() after the release = %+v, %v", loaded, err)
+	}
+}
@@ -0,0 +1,290 @@
+package sqldb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Statuses of a log within a run
+const (
+	// Entries of the log are being downloaded
+	LogDownloading = "downloading"
+	// All entries up to the new head were downloaded and parsed
+	LogDownloaded = "downloaded"
+	// Only the entries up to the completed head were downloaded, the head advances to it
+	LogPartial = "partial"
+	// No entries were downloaded without gaps, the head stays where it was
+	LogFailed = "failed"
+	// The head of the log was advanced to the new head
+	LogCommitted = "committed"
+)
+
+// Returned when the head of a log was moved by someone else since the run started, the run leaves it as it is
+var ErrHeadMoved = errors.New("head of the log moved since the run started")
+
+// Statuses of a run
+const (
+	RunRunning  = "running"
+	RunFinished = "finished"
+	// Stopped by a signal, what was downloaded until then was processed
+	RunInterrupted = "interrupted"
+	// Stopped by an error, no heads were advanced
+	RunFailed = "failed"
+	// Left running by a process which did not finish
+	RunAborted = "aborted"
+)
+
+// Totals of a run which are not per log
+type RunStats struct {
+	Inserted   int64
+	Matches    int
+	EmailsSent int
+}
+
+// A past or running run
+type RunInfo struct {
+	ID         int64
+	StartedAt  time.Time
+	FinishedAt *time.Time
+	Status     string
+	RunStats
+
+	// Sums over the logs of the run
+	Downloaded    int64
+	ParseFailures int64
+}
+
+// A log within a run
+type RunLogInfo struct {
+	Url          string
+	OldHeadIndex int64
+	NewHeadIndex int64
+	// Last index downloaded without gaps
+	CompletedHeadIndex int64
+	Downloaded         int64
+	ParseFailures      int64
+	Status             string
+}
+
+// Returns how long the run took, or has been running.
+func (r RunInfo) Duration() time.Duration {
+	end := time.Now()
+	if r.FinishedAt != nil {
+		end = *r.FinishedAt
+	}
+	return end.Sub(r.StartedAt).Round(time.Second)
+}
+
+// Marks runs left running by a process which stopped beating as aborted, their heads were never committed.
+func (s *sqlStore) AbortStaleRuns(ctx context.Context, before time.Time) (int64, error) {
+	res, err := s.db.ExecContext(ctx, "UPDATE Run SET Status = $1, FinishedAt = CURRENT_TIMESTAMP WHERE Status = $2 AND HeartbeatAt < $3",
+		RunAborted, RunRunning, before.Unix())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// Records a new run with the ranges it is going to download from each log and returns its ID.
+func (s *sqlStore) StartRun(ctx context.Context, logInfos map[string]CTLogInfo) (int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var runID int64
+	if err = tx.QueryRowContext(ctx, "INSERT INTO Run (HeartbeatAt) VALUES ($1) RETURNING ID", time.Now().Unix()).Scan(&runID); err != nil {
+		return 0, err
+	}
+
+	for url, info := range logInfos {
+		_, err = tx.ExecContext(ctx, `
+		INSERT INTO RunLog (RunID, Url, OldHeadIndex, NewHeadIndex, CompletedHeadIndex) VALUES ($1, $2, $3, $4, $3)`,
+			runID, url, info.OldHeadIndex, info.NewHeadIndex)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return runID, tx.Commit()
+}
+
+func (s *sqlStore) Heartbeat(ctx context.Context, runID int64) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE Run SET HeartbeatAt = $1 WHERE ID = $2", time.Now().Unix(), runID)
+	return err
+}
+
+// Sets the status of a log within the run together with the last index downloaded without gaps
+// and the number of entries downloaded and failed to parse.
+func (s *sqlStore) SetRunLogStatus(ctx context.Context, runID int64, logurl string, status string, completedHead int64, downloaded int64, parseFailures int64) error {
+	_, err := s.db.ExecContext(ctx, `
+	UPDATE RunLog SET Status = $1, CompletedHeadIndex = $2, Downloaded = $3, ParseFailures = $4
+	WHERE RunID = $5 AND Url = $6`,
+		status, completedHead, downloaded, parseFailures, runID, logurl)
+	return err
+}
+
+// Advances the heads of the logs of the run to their completed heads, each log in its own transaction,
+// and marks the run with the status and its totals. A head only moves if nothing else moved it since the run started,
+// a failed run moves none. The run is finished even if some heads could not be advanced, their logs are marked failed
+// and the errors are returned, ErrHeadMoved for a moved head.
+func (s *sqlStore) FinishRun(ctx context.Context, runID int64, status string, stats RunStats) error {
+	if status == RunFailed {
+		_, err := s.db.ExecContext(ctx, "UPDATE RunLog SET Status = $1 WHERE RunID = $2 AND Status IN ($3, $4)", LogFailed, runID, LogDownloaded, LogPartial)
+		if err != nil {
+			return err
+		}
+	}
+
+	rows, err := s.db.QueryContext(ctx, "SELECT Url FROM RunLog WHERE RunID = $1 AND Status IN ($2, $3)", runID, LogDownloaded, LogPartial)
+	if err != nil {
+		return err
+	}
+	var urls []string
+	for rows.Next() {
+		var url string
+		if err := rows.Scan(&url); err != nil {
+			rows.Close()
+			return err
+		}
+		urls = append(urls, url)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var headErrs []error
+	for _, url := range urls {
+		err := commitLogHead(ctx, s.db, runID, url)
+		if err == nil {
+			continue
+		}
+		headErrs = append(headErrs, fmt.Errorf("advancing head of %s -> %w", url, err))
+		// A moved head already marked the log, a commit which failed otherwise left it as downloaded
+		if !errors.Is(err, ErrHeadMoved) {
+			if _, err := s.db.ExecContext(ctx, "UPDATE RunLog SET Status = $1 WHERE RunID = $2 AND Url = $3", LogFailed, runID, url); err != nil {
+				slog.Error("Failed to set status of log", "run_id", runID, "log_url", url, "err", err)
+			}
+		}
+	}
+
+	_, err = s.db.ExecContext(ctx, `
+	UPDATE Run SET Status = $1, FinishedAt = CURRENT_TIMESTAMP, Inserted = $2, Matches = $3, EmailsSent = $4
+	WHERE ID = $5`,
+		status, stats.Inserted, stats.Matches, stats.EmailsSent, runID)
+	if err != nil {
+		return err
+	}
+	return errors.Join(headErrs...)
+}
+
+func commitLogHead(ctx context.Context, db *sql.DB, runID int64, logurl string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `
+	UPDATE CTLog SET HeadIndex = R.CompletedHeadIndex
+	FROM RunLog R
+	WHERE R.RunID = $1 AND R.Url = $2 AND CTLog.Url = R.Url AND CTLog.HeadIndex = R.OldHeadIndex`,
+		runID, logurl)
+	if err != nil {
+		return err
+	}
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	// The run did not start from the head the log has now, the log is marked failed and its head is kept
+	status := LogCommitted
+	if updated == 0 {
+		status = LogFailed
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE RunLog SET Status = $1 WHERE RunID = $2 AND Url = $3", status, runID, logurl)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if updated == 0 {
+		return ErrHeadMoved
+	}
+	return nil
+}
+
+const runColumns = `R.ID, R.StartedAt, R.FinishedAt, R.Status, R.Inserted, R.Matches, R.EmailsSent,
+	COALESCE(SUM(L.Downloaded), 0), COALESCE(SUM(L.ParseFailures), 0)`
+
+func scanRun(row interface{ Scan(...interface{}) error }) (RunInfo, error) {
+	var r RunInfo
+	err := row.Scan(&r.ID, &r.StartedAt, &r.FinishedAt, &r.Status, &r.Inserted, &r.Matches, &r.EmailsSent,
+		&r.Downloaded, &r.ParseFailures)
+	return r, err
+}
+
+// Returns the most recent runs, newest first.
+func (s *sqlStore) ListRuns(ctx context.Context, limit int) ([]RunInfo, error) {
+	rows, err := s.db.QueryContext(ctx, `
+	SELECT `+runColumns+`
+	FROM Run R LEFT JOIN RunLog L ON L.RunID = R.ID
+	GROUP BY R.ID
+	ORDER BY R.ID DESC
+	LIMIT $1`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var runs []RunInfo
+	for rows.Next() {
+		r, err := scanRun(rows)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, r)
+	}
+	return runs, rows.Err()
+}
+
+// Returns the run and its logs.
+func (s *sqlStore) GetRun(ctx context.Context, id int64) (RunInfo, []RunLogInfo, error) {
+	run, err := scanRun(s.db.QueryRowContext(ctx, `
+	SELECT `+runColumns+`
+	FROM Run R LEFT JOIN RunLog L ON L.RunID = R.ID
+	WHERE R.ID = $1
+	GROUP BY R.ID`, id))
+	if err != nil {
+		return run, nil, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+	SELECT Url, OldHeadIndex, NewHeadIndex, CompletedHeadIndex, Downloaded, ParseFailures, Status
+	FROM RunLog
+	WHERE RunID = $1
+	ORDER BY Url`, id)
+	if err != nil {
+		return run, nil, err
+	}
+	defer rows.Close()
+
+	var logs []RunLogInfo
+	for rows.Next() {
+		var l RunLogInfo
+		if err := rows.Scan(&l.Url, &l.OldHeadIndex, &l.NewHeadIndex, &l.CompletedHeadIndex, &l.Downloaded, &l.ParseFailures, &l.Status); err != nil {
+			return run, nil, err
+		}
+		logs = append(logs, l)
+	}
+	return run, logs, rows.Err()
+}
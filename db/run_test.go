@@ -0,0 +1,101 @@
+package sqldb
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// Starts a run of the log from its head 9 to 19, which downloaded the entries up to completed
+func startTestRun(t *testing.T, s *SQLite, completed int64) int64 {
+	t.Helper()
+	ctx := context.Background()
+	if err := s.SaveLog(ctx, "https://log.example/", 86400); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetHead(ctx, "https://log.example/", 9); err != nil {
+		t.Fatal(err)
+	}
+	runID, err := s.StartRun(ctx, map[string]CTLogInfo{"https://log.example/": {OldHeadIndex: 9, NewHeadIndex: 19}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetRunLogStatus(ctx, runID, "https://log.example/", LogPartial, completed, completed-9, 0); err != nil {
+		t.Fatal(err)
+	}
+	return runID
+}
+
+// Checks the head of the log and the statuses of the run and its log
+func checkTestRun(t *testing.T, s *SQLite, runID int64, head int64, logStatus string) {
+	t.Helper()
+	ctx := context.Background()
+	logs, err := s.Logs(ctx)
+	if err != nil || len(logs) != 1 || logs[0].HeadIndex != head {
+		t.Errorf("Logs() = %+v, %v, want head %d", logs, err, head)
+	}
+	run, runLogs, err := s.GetRun(ctx, runID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run.Status != RunFinished || run.Matches != 2 {
+		t.Errorf("run %+v, want finished with 2 matches", run)
+	}
+	if len(runLogs) != 1 || runLogs[0].Status != logStatus {
+		t.Errorf("logs of the run %+v, want %s", runLogs, logStatus)
+	}
+}
+
+func TestFinishRunCommitsHead(t *testing.T) {
+	s := newTestStore(t)
+	runID := startTestRun(t, s, 15)
+
+	if err := s.FinishRun(context.Background(), runID, RunFinished, RunStats{Matches: 2}); err != nil {
+		t.Fatalf("FinishRun() = %v", err)
+	}
+	checkTestRun(t, s, runID, 15, LogCommitted)
+}
+
+func TestFinishRunRejectsMovedHead(t *testing.T) {
+	s := newTestStore(t)
+	runID := startTestRun(t, s, 15)
+	// Another process advanced the head while the run was downloading
+	if err := s.SetHead(context.Background(), "https://log.example/", 12); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.FinishRun(context.Background(), runID, RunFinished, RunStats{Matches: 2}); !errors.Is(err, ErrHeadMoved) {
+		t.Fatalf("FinishRun() = %v, want %v", err, ErrHeadMoved)
+	}
+	checkTestRun(t, s, runID, 12, LogFailed)
+}
+
+func TestDeleteFinishedRuns(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t)
+	finished := startTestRun(t, s, 15)
+	if err := s.FinishRun(ctx, finished, RunFinished, RunStats{}); err != nil {
+		t.Fatal(err)
+	}
+	running, err := s.StartRun(ctx, map[string]CTLogInfo{"https://log.example/": {OldHeadIndex: 15, NewHeadIndex: 19}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := s.DeleteFinishedRuns(ctx, time.Now().Add(-time.Hour)); err != nil || n != 0 {
+		t.Errorf("DeleteFinishedRuns() of runs finished an hour ago = %d, %v, want 0", n, err)
+	}
+	if n, err := s.DeleteFinishedRuns(ctx, time.Now().Add(time.Hour)); err != nil || n != 1 {
+		t.Errorf("DeleteFinishedRuns() = %d, %v, want 1", n, err)
+	}
+
+	runs, err := s.ListRuns(ctx, 10)
+	if err != nil || len(runs) != 1 || runs[0].ID != running {
+		t.Errorf("ListRuns() = %+v, %v, want the running run", runs, err)
+	}
+	var logs int
+	if err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM RunLog WHERE RunID = $1", finished).Scan(&logs); err != nil || logs != 0 {
+		t.Errorf("%d logs of the deleted run, %v, want none", logs, err)
+	}
+}
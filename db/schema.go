@@ -0,0 +1,774 @@
+package sqldb
+
+import (
+	"context"
+	"ctlog/match"
+	"database/sql"
+	"fmt"
+	"log/slog"
+)
+
+// Schema migrations, applied in order. The index of a migration plus one is its version.
+// Never edit an applied migration, append a new one instead. Data SQL can not convert is migrated
+// by the function of the version in dataMigrations, in the transaction of the migration.
+var migrations = []string{
+	// 1: initial schema
+	`
+	CREATE TABLE IF NOT EXISTS CTLog (
+		Url       text PRIMARY KEY,
+		HeadIndex bigint NOT NULL DEFAULT -1
+	);
+
+	CREATE TABLE IF NOT EXISTS Monitor (
+		Email  text NOT NULL,
+		Domain text NOT NULL,
+		PRIMARY KEY (Email, Domain)
+	);
+
+	CREATE TABLE IF NOT EXISTS Downloaded (
+		CN           text,
+		DN           text,
+		SerialNumber text,
+		SAN          text,
+		NotBefore    text,
+		NotAfter     text,
+		Issuer       text,
+		Raw          text
+	);
+
+	CREATE TABLE IF NOT EXISTS Certificate (
+		CN           text,
+		DN           text,
+		SerialNumber text NOT NULL,
+		SAN          text,
+		NotBefore    text,
+		NotAfter     text,
+		Issuer       text NOT NULL,
+		UNIQUE (SerialNumber, Issuer)
+	);
+	`,
+
+	// 2: SAN stored as an array, names of downloaded certificates stored with reversed labels
+	`
+	CREATE OR REPLACE FUNCTION ReverseLabels(name text) RETURNS text AS $$
+		SELECT string_agg(label, '.' ORDER BY i DESC)
+		FROM unnest(string_to_array(lower(rtrim(name, '.')), '.')) WITH ORDINALITY AS t(label, i)
+	$$ LANGUAGE SQL IMMUTABLE STRICT;
+
+	DROP TABLE IF EXISTS Downloaded;
+
+	CREATE TABLE Downloaded (
+		CN           text NOT NULL,
+		DN           text NOT NULL,
+		SerialNumber text NOT NULL,
+		SAN          text[] NOT NULL DEFAULT '{}',
+		NotBefore    text,
+		NotAfter     text,
+		Issuer       text NOT NULL,
+		Raw          text,
+		PRIMARY KEY (SerialNumber, Issuer)
+	);
+
+	-- Every CN and SAN of a downloaded certificate, labels in reverse order (www.example.com -> com.example.www),
+	-- so subdomains of a monitored domain form a contiguous range of the index
+	CREATE TABLE DownloadedName (
+		SerialNumber text NOT NULL,
+		Issuer       text NOT NULL,
+		ReversedName text COLLATE "C" NOT NULL,
+		PRIMARY KEY (ReversedName, SerialNumber, Issuer)
+	);
+
+	ALTER TABLE Certificate ALTER COLUMN SAN TYPE text[] USING string_to_array(rtrim(SAN, ','), ',');
+	ALTER TABLE Certificate ALTER COLUMN SAN SET DEFAULT '{}';
+	`,
+
+	// 3: match mode of monitors
+	`
+	ALTER TABLE Monitor ADD COLUMN Mode text NOT NULL DEFAULT 'subdomain'
+		CHECK (Mode IN ('exact', 'subdomain', 'wildcard'));
+	`,
+
+	// 4: lookalike detection sensitivity of monitors
+	`
+	ALTER TABLE Monitor ADD COLUMN Lookalike text NOT NULL DEFAULT 'off'
+		CHECK (Lookalike IN ('off', 'low', 'medium', 'high'));
+	`,
+
+	// 5: Unicode forms of names and monitored domains, SAN and Domain hold the ASCII forms
+	`
+	ALTER TABLE Downloaded ADD COLUMN UnicodeSAN text[] NOT NULL DEFAULT '{}';
+	ALTER TABLE Certificate ADD COLUMN UnicodeSAN text[] NOT NULL DEFAULT '{}';
+	UPDATE Certificate SET UnicodeSAN = SAN;
+	ALTER TABLE Monitor ADD COLUMN UnicodeDomain text NOT NULL DEFAULT '';
+	UPDATE Monitor SET UnicodeDomain = Domain;
+	`,
+
+	// 6: monitors of organizations, issuers and keys, Domain holds the monitored value of any kind
+	`
+	ALTER TABLE Monitor ADD COLUMN Kind text NOT NULL DEFAULT 'domain'
+		CHECK (Kind IN ('domain', 'organization', 'issuer', 'key'));
+	-- Databases created by the former create_database.sql name the key monitor_pk, so it is looked up
+	DO $$
+	DECLARE pk text;
+	BEGIN
+		SELECT conname INTO pk FROM pg_constraint WHERE conrelid = 'monitor'::regclass AND contype = 'p';
+		IF pk IS NOT NULL THEN
+			EXECUTE format('ALTER TABLE Monitor DROP CONSTRAINT %I', pk);
+		END IF;
+	END $$;
+	ALTER TABLE Monitor ADD PRIMARY KEY (Email, Kind, Domain);
+
+	ALTER TABLE Downloaded
+		ADD COLUMN Organization text[] NOT NULL DEFAULT '{}',
+		ADD COLUMN AuthorityKeyID text NOT NULL DEFAULT '',
+		ADD COLUMN SPKIHash text NOT NULL DEFAULT '';
+	ALTER TABLE Certificate
+		ADD COLUMN Organization text[] NOT NULL DEFAULT '{}',
+		ADD COLUMN AuthorityKeyID text NOT NULL DEFAULT '',
+		ADD COLUMN SPKIHash text NOT NULL DEFAULT '';
+	`,
+
+	// 7: CAs authorized to issue certificates for monitored domains, issuer DNs or hex AKIs
+	`
+	CREATE TABLE MonitorCA (
+		Email  text NOT NULL,
+		Kind   text NOT NULL DEFAULT 'domain' CHECK (Kind = 'domain'),
+		Domain text NOT NULL,
+		CA     text NOT NULL,
+		PRIMARY KEY (Email, Domain, CA),
+		FOREIGN KEY (Email, Kind, Domain) REFERENCES Monitor ON DELETE CASCADE
+	);
+	`,
+
+	// 8: lint findings, "code: description"
+	`
+	ALTER TABLE Downloaded ADD COLUMN Lint text[] NOT NULL DEFAULT '{}';
+	ALTER TABLE Certificate ADD COLUMN Lint text[] NOT NULL DEFAULT '{}';
+	`,
+
+	// 9: raw entries which could not be parsed
+	`
+	CREATE TABLE Quarantine (
+		LogUrl        text NOT NULL,
+		EntryIndex    bigint NOT NULL,
+		LeafInput     bytea NOT NULL,
+		ExtraData     bytea NOT NULL,
+		Error         text NOT NULL,
+		QuarantinedAt timestamptz NOT NULL DEFAULT now(),
+		PRIMARY KEY (LogUrl, EntryIndex)
+	);
+	`,
+
+	// 10: IP address, email and URI SANs
+	`
+	ALTER TABLE Downloaded
+		ADD COLUMN IPAddresses text[] NOT NULL DEFAULT '{}',
+		ADD COLUMN EmailAddresses text[] NOT NULL DEFAULT '{}',
+		ADD COLUMN URIs text[] NOT NULL DEFAULT '{}';
+	ALTER TABLE Certificate
+		ADD COLUMN IPAddresses text[] NOT NULL DEFAULT '{}',
+		ADD COLUMN EmailAddresses text[] NOT NULL DEFAULT '{}',
+		ADD COLUMN URIs text[] NOT NULL DEFAULT '{}';
+	`,
+
+	// 11: IP addresses stored as inet, monitors of IP ranges
+	`
+	ALTER TABLE Downloaded ALTER COLUMN IPAddresses DROP DEFAULT;
+	ALTER TABLE Downloaded ALTER COLUMN IPAddresses TYPE inet[] USING IPAddresses::inet[];
+	ALTER TABLE Downloaded ALTER COLUMN IPAddresses SET DEFAULT '{}';
+	ALTER TABLE Certificate ALTER COLUMN IPAddresses DROP DEFAULT;
+	ALTER TABLE Certificate ALTER COLUMN IPAddresses TYPE inet[] USING IPAddresses::inet[];
+	ALTER TABLE Certificate ALTER COLUMN IPAddresses SET DEFAULT '{}';
+
+	ALTER TABLE Monitor DROP CONSTRAINT monitor_kind_check;
+	ALTER TABLE Monitor ADD CONSTRAINT monitor_kind_check
+		CHECK (Kind IN ('domain', 'organization', 'issuer', 'key', 'cidr'));
+	`,
+
+	// 12: runs and the ranges they download from each log, heads are advanced per log in a transaction
+	// instead of swapping a copy of CTLog, which lost its constraints
+	`
+	DROP TABLE IF EXISTS TmpCTLog;
+	CREATE UNIQUE INDEX IF NOT EXISTS CTLogUrl ON CTLog (Url);
+
+	CREATE TABLE Run (
+		ID         bigserial PRIMARY KEY,
+		StartedAt  timestamptz NOT NULL DEFAULT now(),
+		FinishedAt timestamptz,
+		Status     text NOT NULL DEFAULT 'running' CHECK (Status IN ('running', 'finished', 'aborted'))
+	);
+
+	CREATE TABLE RunLog (
+		RunID        bigint NOT NULL REFERENCES Run ON DELETE CASCADE,
+		Url          text NOT NULL,
+		OldHeadIndex bigint NOT NULL,
+		NewHeadIndex bigint NOT NULL,
+		Status       text NOT NULL DEFAULT 'downloading'
+			CHECK (Status IN ('downloading', 'downloaded', 'failed', 'committed')),
+		PRIMARY KEY (RunID, Url)
+	);
+	`,
+
+	// 13: run history
+	`
+	ALTER TABLE Run
+		ADD COLUMN Inserted bigint NOT NULL DEFAULT 0,
+		ADD COLUMN Matches integer NOT NULL DEFAULT 0,
+		ADD COLUMN EmailsSent integer NOT NULL DEFAULT 0;
+	ALTER TABLE RunLog
+		ADD COLUMN Downloaded bigint NOT NULL DEFAULT 0,
+		ADD COLUMN ParseFailures bigint NOT NULL DEFAULT 0;
+	`,
+
+	// 14: maximum merge delay of the logs in seconds, the watch mode polls by it
+	`
+	ALTER TABLE CTLog ADD COLUMN MMD integer NOT NULL DEFAULT 86400 CHECK (MMD > 0);
+	`,
+
+	// 15: interrupted runs, logs advance to the last entry downloaded without gaps
+	`
+	ALTER TABLE Run DROP CONSTRAINT run_status_check;
+	ALTER TABLE Run ADD CONSTRAINT run_status_check
+		CHECK (Status IN ('running', 'finished', 'interrupted', 'aborted'));
+
+	ALTER TABLE RunLog DROP CONSTRAINT runlog_status_check;
+	ALTER TABLE RunLog ADD CONSTRAINT runlog_status_check
+		CHECK (Status IN ('downloading', 'downloaded', 'partial', 'failed', 'committed'));
+
+	ALTER TABLE RunLog ADD COLUMN CompletedHeadIndex bigint;
+	UPDATE RunLog SET CompletedHeadIndex = CASE WHEN Status IN ('downloaded', 'committed') THEN NewHeadIndex ELSE OldHeadIndex END;
+	ALTER TABLE RunLog ALTER COLUMN CompletedHeadIndex SET NOT NULL;
+	`,
+
+	// 16: certificates are matched while they are parsed, Downloaded is only kept for dumps
+	`
+	DROP TABLE DownloadedName;
+	DROP FUNCTION ReverseLabels(text);
+	`,
+
+	// 17: fingerprints and IDs of saved certificates, the query API pages by ID
+	`
+	ALTER TABLE Certificate
+		ADD COLUMN ID bigserial,
+		ADD COLUMN Fingerprint text NOT NULL DEFAULT '';
+	CREATE UNIQUE INDEX CertificateID ON Certificate (ID);
+	CREATE INDEX CertificateFingerprint ON Certificate (Fingerprint);
+	`,
+
+	// 18: API keys, monitors added through the API wait for confirmation
+	`
+	ALTER TABLE Monitor ADD COLUMN ConfirmationHash text;
+	CREATE UNIQUE INDEX MonitorConfirmation ON Monitor (ConfirmationHash);
+
+	CREATE TABLE ApiKey (
+		Hash      text PRIMARY KEY,
+		Email     text NOT NULL,
+		CreatedAt timestamptz NOT NULL DEFAULT now()
+	);
+	`,
+
+	// 19: domain ownership verification, monitors which existed before stay verified by the administrator
+	`
+	ALTER TABLE Monitor
+		ADD COLUMN VerificationToken text NOT NULL DEFAULT '',
+		ADD COLUMN VerifiedBy text CHECK (VerifiedBy IN ('dns', 'http', 'admin'));
+	UPDATE Monitor SET VerifiedBy = 'admin' WHERE ConfirmationHash IS NULL;
+	UPDATE Monitor SET VerificationToken = md5(random()::text || Email || Domain) WHERE ConfirmationHash IS NOT NULL;
+	`,
+
+	// 20: secrets generated by the service, like the key of unsubscribe tokens
+	`
+	CREATE TABLE Secret (
+		Name  text PRIMARY KEY,
+		Value text NOT NULL
+	);
+	`,
+
+	// 21: sign-in tokens of the web interface and the sessions they open, expiring at a Unix time
+	`
+	CREATE TABLE Session (
+		Hash      text PRIMARY KEY,
+		Email     text NOT NULL,
+		Kind      text NOT NULL CHECK (Kind IN ('login', 'session')),
+		ExpiresAt bigint NOT NULL
+	);
+	CREATE INDEX SessionExpiresAt ON Session (ExpiresAt);
+	`,
+
+	// 22: heartbeats of running runs at a Unix time, runs whose process stopped beating are aborted
+	`
+	ALTER TABLE Run ADD COLUMN HeartbeatAt bigint NOT NULL DEFAULT 0;
+	`,
+
+	// 23: runs stopped by an error are finished as failed
+	`
+	ALTER TABLE Run DROP CONSTRAINT run_status_check;
+	ALTER TABLE Run ADD CONSTRAINT run_status_check
+		CHECK (Status IN ('running', 'finished', 'interrupted', 'failed', 'aborted'));
+	`,
+
+	// 24: Unicode forms of CNs, NULL where it is the CN. Monitors added before version 5 may hold
+	// the Unicode form in Domain, they and the CNs are converted by normalizeNames.
+	`
+	ALTER TABLE Downloaded ADD COLUMN UnicodeCN text;
+	ALTER TABLE Certificate ADD COLUMN UnicodeCN text;
+	`,
+
+	// 25: entries of logs which send no extra data are quarantined too
+	`
+	ALTER TABLE Quarantine ALTER COLUMN ExtraData DROP NOT NULL;
+	`,
+
+	// 26: emails a saved certificate is reported to, with the monitors that matched as "kind value" lines.
+	// Notified is set once the email was accepted, the others are sent again by the next run.
+	`
+	CREATE TABLE Notification (
+		CertificateID bigint NOT NULL REFERENCES Certificate (ID) ON DELETE CASCADE,
+		Email         text NOT NULL,
+		Reason        text NOT NULL,
+		Monitors      text NOT NULL,
+		Notified      boolean NOT NULL DEFAULT false,
+		PRIMARY KEY (CertificateID, Email)
+	);
+	CREATE INDEX NotificationPending ON Notification (Email) WHERE NOT Notified;
+	`,
+}
+
+// Data migrations of PostgreSQL stores by version
+var dataMigrations = map[int]func(context.Context, *sql.Tx) error{
+	24: normalizeNames,
+}
+
+// Schema migrations of SQLite stores, which start from the schema of PostgreSQL version 15. Arrays are stored as JSON.
+var sqliteMigrations = []string{
+	// 1: initial schema
+	`
+	CREATE TABLE CTLog (
+		Url       text PRIMARY KEY,
+		HeadIndex integer NOT NULL DEFAULT -1,
+		MMD       integer NOT NULL DEFAULT 86400 CHECK (MMD > 0)
+	);
+
+	CREATE TABLE Monitor (
+		Email         text NOT NULL,
+		Kind          text NOT NULL DEFAULT 'domain' CHECK (Kind IN ('domain', 'organization', 'issuer', 'key', 'cidr')),
+		Domain        text NOT NULL,
+		UnicodeDomain text NOT NULL DEFAULT '',
+		Mode          text NOT NULL DEFAULT 'subdomain' CHECK (Mode IN ('exact', 'subdomain', 'wildcard')),
+		Lookalike     text NOT NULL DEFAULT 'off' CHECK (Lookalike IN ('off', 'low', 'medium', 'high')),
+		PRIMARY KEY (Email, Kind, Domain)
+	);
+
+	CREATE TABLE MonitorCA (
+		Email  text NOT NULL,
+		Kind   text NOT NULL DEFAULT 'domain' CHECK (Kind = 'domain'),
+		Domain text NOT NULL,
+		CA     text NOT NULL,
+		PRIMARY KEY (Email, Domain, CA),
+		FOREIGN KEY (Email, Kind, Domain) REFERENCES Monitor ON DELETE CASCADE
+	);
+
+	CREATE TABLE Downloaded (
+		CN             text NOT NULL,
+		DN             text NOT NULL,
+		SerialNumber   text NOT NULL,
+		SAN            text NOT NULL DEFAULT '[]',
+		UnicodeSAN     text NOT NULL DEFAULT '[]',
+		NotBefore      text,
+		NotAfter       text,
+		Issuer         text NOT NULL,
+		Raw            text,
+		Organization   text NOT NULL DEFAULT '[]',
+		AuthorityKeyID text NOT NULL DEFAULT '',
+		SPKIHash       text NOT NULL DEFAULT '',
+		Lint           text NOT NULL DEFAULT '[]',
+		IPAddresses    text NOT NULL DEFAULT '[]',
+		EmailAddresses text NOT NULL DEFAULT '[]',
+		URIs           text NOT NULL DEFAULT '[]',
+		PRIMARY KEY (SerialNumber, Issuer)
+	);
+
+	CREATE TABLE DownloadedName (
+		SerialNumber text NOT NULL,
+		Issuer       text NOT NULL,
+		ReversedName text NOT NULL,
+		PRIMARY KEY (ReversedName, SerialNumber, Issuer)
+	) WITHOUT ROWID;
+
+	CREATE TABLE Certificate (
+		CN             text,
+		DN             text,
+		SerialNumber   text NOT NULL,
+		SAN            text NOT NULL DEFAULT '[]',
+		UnicodeSAN     text NOT NULL DEFAULT '[]',
+		NotBefore      text,
+		NotAfter       text,
+		Issuer         text NOT NULL,
+		Organization   text NOT NULL DEFAULT '[]',
+		AuthorityKeyID text NOT NULL DEFAULT '',
+		SPKIHash       text NOT NULL DEFAULT '',
+		Lint           text NOT NULL DEFAULT '[]',
+		IPAddresses    text NOT NULL DEFAULT '[]',
+		EmailAddresses text NOT NULL DEFAULT '[]',
+		URIs           text NOT NULL DEFAULT '[]',
+		UNIQUE (SerialNumber, Issuer)
+	);
+
+	CREATE TABLE Quarantine (
+		LogUrl        text NOT NULL,
+		EntryIndex    integer NOT NULL,
+		LeafInput     blob NOT NULL,
+		ExtraData     blob NOT NULL,
+		Error         text NOT NULL,
+		QuarantinedAt datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (LogUrl, EntryIndex)
+	);
+
+	CREATE TABLE Run (
+		ID         integer PRIMARY KEY AUTOINCREMENT,
+		StartedAt  datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		FinishedAt datetime,
+		Status     text NOT NULL DEFAULT 'running' CHECK (Status IN ('running', 'finished', 'interrupted', 'aborted')),
+		Inserted   integer NOT NULL DEFAULT 0,
+		Matches    integer NOT NULL DEFAULT 0,
+		EmailsSent integer NOT NULL DEFAULT 0
+	);
+
+	CREATE TABLE RunLog (
+		RunID              integer NOT NULL REFERENCES Run ON DELETE CASCADE,
+		Url                text NOT NULL,
+		OldHeadIndex       integer NOT NULL,
+		NewHeadIndex       integer NOT NULL,
+		CompletedHeadIndex integer NOT NULL,
+		Status             text NOT NULL DEFAULT 'downloading'
+			CHECK (Status IN ('downloading', 'downloaded', 'partial', 'failed', 'committed')),
+		Downloaded         integer NOT NULL DEFAULT 0,
+		ParseFailures      integer NOT NULL DEFAULT 0,
+		PRIMARY KEY (RunID, Url)
+	);
+	`,
+
+	// 2: certificates are matched while they are parsed, names are not looked up in the database
+	`
+	DROP TABLE DownloadedName;
+	`,
+
+	// 3: fingerprints of saved certificates, the rowid serves as their ID
+	`
+	ALTER TABLE Certificate ADD COLUMN Fingerprint text NOT NULL DEFAULT '';
+	CREATE INDEX CertificateFingerprint ON Certificate (Fingerprint);
+	`,
+
+	// 4: API keys, monitors added through the API wait for confirmation
+	`
+	ALTER TABLE Monitor ADD COLUMN ConfirmationHash text;
+	CREATE UNIQUE INDEX MonitorConfirmation ON Monitor (ConfirmationHash);
+
+	CREATE TABLE ApiKey (
+		Hash      text PRIMARY KEY,
+		Email     text NOT NULL,
+		CreatedAt datetime NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+	`,
+
+	// 5: domain ownership verification, monitors which existed before stay verified by the administrator
+	`
+	ALTER TABLE Monitor ADD COLUMN VerificationToken text NOT NULL DEFAULT '';
+	ALTER TABLE Monitor ADD COLUMN VerifiedBy text CHECK (VerifiedBy IN ('dns', 'http', 'admin'));
+	UPDATE Monitor SET VerifiedBy = 'admin' WHERE ConfirmationHash IS NULL;
+	UPDATE Monitor SET VerificationToken = lower(hex(randomblob(16))) WHERE ConfirmationHash IS NOT NULL;
+	`,
+
+	// 6: secrets generated by the service, like the key of unsubscribe tokens
+	`
+	CREATE TABLE Secret (
+		Name  text PRIMARY KEY,
+		Value text NOT NULL
+	);
+	`,
+
+	// 7: sign-in tokens of the web interface and the sessions they open, expiring at a Unix time
+	`
+	CREATE TABLE Session (
+		Hash      text PRIMARY KEY,
+		Email     text NOT NULL,
+		Kind      text NOT NULL CHECK (Kind IN ('login', 'session')),
+		ExpiresAt integer NOT NULL
+	);
+	CREATE INDEX SessionExpiresAt ON Session (ExpiresAt);
+	`,
+
+	// 8: heartbeats of running runs at a Unix time, runs whose process stopped beating are aborted
+	`
+	ALTER TABLE Run ADD COLUMN HeartbeatAt integer NOT NULL DEFAULT 0;
+	`,
+
+	// 9: runs stopped by an error are finished as failed. SQLite cannot alter a CHECK constraint, so Run is rebuilt,
+	// and RunLog with it, as dropping Run would cascade to its logs.
+	`
+	CREATE TABLE RunNew (
+		ID          integer PRIMARY KEY AUTOINCREMENT,
+		StartedAt   datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		FinishedAt  datetime,
+		Status      text NOT NULL DEFAULT 'running' CHECK (Status IN ('running', 'finished', 'interrupted', 'failed', 'aborted')),
+		Inserted    integer NOT NULL DEFAULT 0,
+		Matches     integer NOT NULL DEFAULT 0,
+		EmailsSent  integer NOT NULL DEFAULT 0,
+		HeartbeatAt integer NOT NULL DEFAULT 0
+	);
+	INSERT INTO RunNew (ID, StartedAt, FinishedAt, Status, Inserted, Matches, EmailsSent, HeartbeatAt)
+		SELECT ID, StartedAt, FinishedAt, Status, Inserted, Matches, EmailsSent, HeartbeatAt FROM Run;
+
+	CREATE TABLE RunLogNew (
+		RunID              integer NOT NULL REFERENCES RunNew ON DELETE CASCADE,
+		Url                text NOT NULL,
+		OldHeadIndex       integer NOT NULL,
+		NewHeadIndex       integer NOT NULL,
+		CompletedHeadIndex integer NOT NULL,
+		Status             text NOT NULL DEFAULT 'downloading'
+			CHECK (Status IN ('downloading', 'downloaded', 'partial', 'failed', 'committed')),
+		Downloaded         integer NOT NULL DEFAULT 0,
+		ParseFailures      integer NOT NULL DEFAULT 0,
+		PRIMARY KEY (RunID, Url)
+	);
+	INSERT INTO RunLogNew (RunID, Url, OldHeadIndex, NewHeadIndex, CompletedHeadIndex, Status, Downloaded, ParseFailures)
+		SELECT RunID, Url, OldHeadIndex, NewHeadIndex, CompletedHeadIndex, Status, Downloaded, ParseFailures FROM RunLog;
+
+	DROP TABLE RunLog;
+	DROP TABLE Run;
+	ALTER TABLE RunNew RENAME TO Run;
+	ALTER TABLE RunLogNew RENAME TO RunLog;
+	`,
+
+	// 10: Unicode forms of CNs, NULL where it is the CN, converted by normalizeNames with the domains of monitors
+	`
+	ALTER TABLE Downloaded ADD COLUMN UnicodeCN text;
+	ALTER TABLE Certificate ADD COLUMN UnicodeCN text;
+	`,
+
+	// 11: entries of logs which send no extra data are quarantined too. SQLite cannot drop NOT NULL, so Quarantine is rebuilt.
+	`
+	CREATE TABLE QuarantineNew (
+		LogUrl        text NOT NULL,
+		EntryIndex    integer NOT NULL,
+		LeafInput     blob NOT NULL,
+		ExtraData     blob,
+		Error         text NOT NULL,
+		QuarantinedAt datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (LogUrl, EntryIndex)
+	);
+	INSERT INTO QuarantineNew SELECT LogUrl, EntryIndex, LeafInput, ExtraData, Error, QuarantinedAt FROM Quarantine;
+	DROP TABLE Quarantine;
+	ALTER TABLE QuarantineNew RENAME TO Quarantine;
+	`,
+
+	// 12: emails a saved certificate is reported to, with the monitors that matched as "kind value" lines.
+	// The ID of Certificate is its rowid, which can not be referenced, so a trigger deletes the notifications with it.
+	`
+	CREATE TABLE Notification (
+		CertificateID integer NOT NULL,
+		Email         text NOT NULL,
+		Reason        text NOT NULL,
+		Monitors      text NOT NULL,
+		Notified      integer NOT NULL DEFAULT 0,
+		PRIMARY KEY (CertificateID, Email)
+	);
+	CREATE INDEX NotificationPending ON Notification (Email) WHERE NOT Notified;
+
+	CREATE TRIGGER CertificateDeleted AFTER DELETE ON Certificate
+	BEGIN
+		DELETE FROM Notification WHERE CertificateID = OLD.rowid;
+	END;
+	`,
+}
+
+// Data migrations of SQLite stores by version
+var sqliteDataMigrations = map[int]func(context.Context, *sql.Tx) error{
+	10: normalizeNames,
+}
+
+// Brings the database schema up to date.
+func (p *Postgres) Migrate(ctx context.Context) error {
+	return applyMigrations(ctx, p.db, migrations, dataMigrations)
+}
+
+// Applies the migrations newer than the version recorded in SchemaVersion.
+func applyMigrations(ctx context.Context, db *sql.DB, migrations []string, data map[int]func(context.Context, *sql.Tx) error) error {
+	_, err := db.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS SchemaVersion (Version integer NOT NULL)")
+	if err != nil {
+		return err
+	}
+
+	var version int
+	err = db.QueryRowContext(ctx, "SELECT COALESCE(MAX(Version), 0) FROM SchemaVersion").Scan(&version)
+	if err != nil {
+		return err
+	}
+
+	for ; version < len(migrations); version++ {
+		if err := migrate(ctx, db, version+1, migrations[version], data[version+1]); err != nil {
+			return fmt.Errorf("migrating to version %d -> %s", version+1, err)
+		}
+		slog.Info("Migrated the database", "version", version+1)
+	}
+	return nil
+}
+
+// Applies the migration of the version and its data migration, if it has one, in a transaction.
+func migrate(ctx context.Context, db *sql.DB, version int, migration string, data func(context.Context, *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(ctx, migration); err != nil {
+		return err
+	}
+	if data != nil {
+		if err = data(ctx, tx); err != nil {
+			return err
+		}
+	}
+	if _, err = tx.ExecContext(ctx, "INSERT INTO SchemaVersion VALUES ($1)", version); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Converts the domains of monitors to their ASCII forms with their Unicode forms alongside, and stores
+// the Unicode forms of the CNs which are IDNA hostnames.
+func normalizeNames(ctx context.Context, tx *sql.Tx) error {
+	if err := normalizeMonitorDomains(ctx, tx); err != nil {
+		return err
+	}
+	for _, table := range []string{"Downloaded", "Certificate"} {
+		if err := unicodeCNs(ctx, tx, table); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Monitors whose ASCII form is monitored by the same email already are dropped as duplicates.
+// The CAs of a monitor are moved to its new domain, as MonitorCA references the domain without cascading updates.
+func normalizeMonitorDomains(ctx context.Context, tx *sql.Tx) error {
+	type monitor struct{ email, domain, unicode string }
+	var monitors []monitor
+	rows, err := tx.QueryContext(ctx, "SELECT Email, Domain, UnicodeDomain FROM Monitor WHERE Kind = 'domain'")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var m monitor
+		if err := rows.Scan(&m.email, &m.domain, &m.unicode); err != nil {
+			rows.Close()
+			return err
+		}
+		monitors = append(monitors, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, m := range monitors {
+		ascii, unicode, err := match.ParseDomain(m.domain)
+		if err != nil {
+			slog.Warn("Monitored domain is not valid, left as it is", "email", m.email, "domain", m.domain, "err", err)
+			continue
+		}
+		if ascii == m.domain {
+			if unicode != m.unicode {
+				_, err = tx.ExecContext(ctx, "UPDATE Monitor SET UnicodeDomain = $1 WHERE Email = $2 AND Kind = 'domain' AND Domain = $3",
+					unicode, m.email, m.domain)
+			}
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		cas, err := monitorCAs(ctx, tx, m.email, m.domain)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "DELETE FROM MonitorCA WHERE Email = $1 AND Domain = $2", m.email, m.domain)
+		if err != nil {
+			return err
+		}
+
+		var duplicate bool
+		err = tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM Monitor WHERE Email = $1 AND Kind = 'domain' AND Domain = $2)",
+			m.email, ascii).Scan(&duplicate)
+		if err != nil {
+			return err
+		}
+		if duplicate {
+			_, err = tx.ExecContext(ctx, "DELETE FROM Monitor WHERE Email = $1 AND Kind = 'domain' AND Domain = $2", m.email, m.domain)
+		} else {
+			_, err = tx.ExecContext(ctx, "UPDATE Monitor SET Domain = $1, UnicodeDomain = $2 WHERE Email = $3 AND Kind = 'domain' AND Domain = $4",
+				ascii, unicode, m.email, m.domain)
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, ca := range cas {
+			_, err = tx.ExecContext(ctx, "INSERT INTO MonitorCA (Email, Domain, CA) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING",
+				m.email, ascii, ca)
+			if err != nil {
+				return err
+			}
+		}
+		slog.Info("Normalized monitored domain", "email", m.email, "domain", m.domain, "ascii", ascii, "duplicate", duplicate)
+	}
+	return nil
+}
+
+func monitorCAs(ctx context.Context, tx *sql.Tx, email string, domain string) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT CA FROM MonitorCA WHERE Email = $1 AND Domain = $2", email, domain)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var cas []string
+	for rows.Next() {
+		var ca string
+		if err := rows.Scan(&ca); err != nil {
+			return nil, err
+		}
+		cas = append(cas, ca)
+	}
+	return cas, rows.Err()
+}
+
+// Only CNs with a punycode label have a Unicode form of their own, the rest are left NULL.
+// The table name is not user input.
+func unicodeCNs(ctx context.Context, tx *sql.Tx, table string) error {
+	rows, err := tx.QueryContext(ctx, "SELECT DISTINCT CN FROM "+table+" WHERE lower(CN) LIKE '%xn--%'")
+	if err != nil {
+		return err
+	}
+	var cns []string
+	for rows.Next() {
+		var cn string
+		if err := rows.Scan(&cn); err != nil {
+			rows.Close()
+			return err
+		}
+		cns = append(cns, cn)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, cn := range cns {
+		if _, err := tx.ExecContext(ctx, "UPDATE "+table+" SET UnicodeCN = $1 WHERE CN = $2", match.UnicodeCN(cn), cn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package sqldb
+
+import (
+	"context"
+	"testing"
+)
+
+func TestNormalizeNames(t *testing.T) {
+	ctx := context.Background()
+	s, err := OpenSQLite(ctx, t.TempDir()+"/ctlog.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// The version before the data migration, with monitors in Unicode left by older versions
+	if err := applyMigrations(ctx, s.db, sqliteMigrations[:9], nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range []string{
+		`INSERT INTO Monitor (Email, Kind, Domain, UnicodeDomain) VALUES
+			('a@example.com', 'domain', 'Čeština.cz', 'Čeština.cz'),
+			('b@example.com', 'domain', 'čeština.cz', 'čeština.cz'),
+			('b@example.com', 'domain', 'xn--etina-gya30d.cz', 'čeština.cz'),
+			('c@example.com', 'domain', 'example.com', ''),
+			('c@example.com', 'organization', 'Čeština s.r.o.', '')`,
+		`INSERT INTO MonitorCA (Email, Domain, CA) VALUES ('a@example.com', 'Čeština.cz', 'CN=Test CA')`,
+		`INSERT INTO Certificate (CN, SerialNumber, Issuer) VALUES
+			('xn--etina-gya30d.cz', '01', 'CN=Test CA'),
+			('Example Org', '02', 'CN=Test CA')`,
+	} {
+		if _, err := s.db.ExecContext(ctx, stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"a@example.com domain xn--etina-gya30d.cz":  "čeština.cz",
+		"b@example.com domain xn--etina-gya30d.cz":  "čeština.cz",
+		"c@example.com domain example.com":          "example.com",
+		"c@example.com organization Čeština s.r.o.": "",
+	}
+	got := make(map[string]string)
+	rows, err := s.db.QueryContext(ctx, "SELECT Email, Kind, Domain, UnicodeDomain FROM Monitor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var email, kind, domain, unicode string
+		if err := rows.Scan(&email, &kind, &domain, &unicode); err != nil {
+			t.Fatal(err)
+		}
+		got[email+" "+kind+" "+domain] = unicode
+	}
+	rows.Close()
+	if len(got) != len(want) {
+		t.Errorf("monitors %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if u, ok := got[k]; !ok || u != v {
+			t.Errorf("monitor %s has the Unicode domain %q, %v, want %q", k, u, ok, v)
+		}
+	}
+
+	var ca string
+	err = s.db.QueryRowContext(ctx, "SELECT CA FROM MonitorCA WHERE Email = 'a@example.com' AND Domain = 'xn--etina-gya30d.cz'").Scan(&ca)
+	if err != nil {
+		t.Errorf("the CA of the monitor was not moved to its ASCII domain: %v", err)
+	}
+
+	for cn, want := range map[string]string{"xn--etina-gya30d.cz": "čeština.cz", "Example Org": "Example Org"} {
+		var unicode string
+		err := s.db.QueryRowContext(ctx, "SELECT COALESCE(UnicodeCN, CN) FROM Certificate WHERE CN = $1", cn).Scan(&unicode)
+		if err != nil || unicode != want {
+			t.Errorf("Unicode CN of %s = %q, %v, want %q", cn, unicode, err, want)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package sqldb
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"ctlog/match"
+	"ctlog/verify"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// Random bytes of API keys and confirmation, sign-in and session tokens
+const tokenBytes = 32
+
+// How long sign-in links and the sessions of the web interface last
+const LoginTokenDuration = 24 * time.Hour
+const SessionDuration = 7 * 24 * time.Hour
+
+// Kinds of the tokens of the Session table
+const (
+	loginToken   = "login"
+	sessionToken = "session"
+)
+
+// Returns a new random token, given to its user, and its hash, which is stored instead.
+func newToken() (string, string, error) {
+	b := make([]byte, tokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	return token, HashToken(token), nil
+}
+
+// Returns the hash a token is stored under.
+func HashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// Returns the link with the token in the parameter of the name.
+func tokenLink(base string, name string, token string) (string, error) {
+	link, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	q := link.Query()
+	q.Set(name, token)
+	link.RawQuery = q.Encode()
+	return link.String(), nil
+}
+
+// Issues a new API key of the email and sends it there, so only the owner of the email gets to use it.
+// The email also links to loginURL with a sign-in token in its "token" parameter, which opens a session
+// of the web interface once within LoginTokenDuration. The key itself never appears in links.
+func IssueAPIKey(ctx context.Context, email string, loginURL string, s Store) error {
+	if !emailRegex.MatchString(email) {
+		return fmt.Errorf("%w %q", ErrInvalidEmail, email)
+	}
+
+	key, hash, err := newToken()
+	if err != nil {
+		return err
+	}
+	if err := s.SaveAPIKey(ctx, hash, email); err != nil {
+		return err
+	}
+	login, loginHash, err := newToken()
+	if err != nil {
+		return err
+	}
+	if err := s.SaveSession(ctx, loginHash, email, loginToken, time.Now().Add(LoginTokenDuration)); err != nil {
+		return err
+	}
+	link, err := tokenLink(loginURL, "token", login)
+	if err != nil {
+		return err
+	}
+	return SendAPIKey(email, key, link)
+}
+
+// Uses up the sign-in token and opens a session of its email, which lasts SessionDuration.
+// Returns the session token and the email, reports whether the sign-in token was valid.
+func SignIn(ctx context.Context, token string, s Store) (string, string, bool, error) {
+	if token == "" {
+		return "", "", false, nil
+	}
+	email, ok, err := s.TakeSession(ctx, HashToken(token), loginToken, time.Now())
+	if err != nil || !ok {
+		return "", "", false, err
+	}
+
+	session, hash, err := newToken()
+	if err != nil {
+		return "", "", false, err
+	}
+	if err := s.SaveSession(ctx, hash, email, sessionToken, time.Now().Add(SessionDuration)); err != nil {
+		return "", "", false, err
+	}
+	return session, email, true, nil
+}
+
+// Returns the email of the session token, reports whether the session is open.
+func SessionEmail(ctx context.Context, session string, s Store) (string, bool, error) {
+	if session == "" {
+		return "", false, nil
+	}
+	return s.SessionEmail(ctx, HashToken(session), sessionToken, time.Now())
+}
+
+// Closes the session of the token.
+func SignOut(ctx context.Context, session string, s Store) error {
+	if session == "" {
+		return nil
+	}
+	_, _, err := s.TakeSession(ctx, HashToken(session), sessionToken, time.Now())
+	return err
+}
+
+// Returns the email of the API key, reports whether the key is valid.
+func Authenticate(ctx context.Context, key string, s Store) (string, bool, error) {
+	if key == "" {
+		return "", false, nil
+	}
+	return s.APIKeyEmail(ctx, HashToken(key))
+}
+
+// Requests a monitor of the value for the email. A new monitor is not matched until the email confirms it
+// by the link sent there, confirmURL with the token in its "token" parameter, and until it is verified.
+// An existing monitor only gets its mode and lookalike sensitivity updated, a waiting one gets a new link.
+func RequestMonitor(ctx context.Context, email string, kind match.Kind, value string, mode match.Mode, lookalike match.Sensitivity,
+	confirmURL string, s Store) (Monitor, error) {
+	v, display, err := parseMonitorValue(kind, value)
+	if err != nil {
+		return Monitor{}, err
+	}
+	m := Monitor{Email: email, Kind: kind, Value: v, Display: display, Mode: mode, Lookalike: lookalike}
+
+	token, hash, err := newToken()
+	if err != nil {
+		return m, err
+	}
+	// Published by the owner of the domain, so it is stored as it is
+	m.VerificationToken, _, err = newToken()
+	if err != nil {
+		return m, err
+	}
+	m, err = s.SavePendingMonitor(ctx, m, hash)
+	if err != nil || m.Confirmed {
+		return m, err
+	}
+
+	link, err := tokenLink(confirmURL, "token", token)
+	if err != nil {
+		return m, err
+	}
+	return m, SendConfirmation(m, link)
+}
+
+// Confirms the monitor waiting for the token, reports whether there was one.
+func ConfirmMonitor(ctx context.Context, token string, s Store) (Monitor, bool, error) {
+	if token == "" {
+		return Monitor{}, false, nil
+	}
+	return s.ConfirmMonitor(ctx, HashToken(token))
+}
+
+// Updates the mode and lookalike sensitivity of the monitor of the value for the email, empty ones are kept.
+func UpdateMonitor(ctx context.Context, email string, kind match.Kind, value string, mode match.Mode, lookalike match.Sensitivity,
+	s Store) (Monitor, error) {
+	v, _, err := parseMonitorValue(kind, value)
+	if err != nil {
+		return Monitor{}, err
+	}
+
+	m, found, err := s.UpdateMonitor(ctx, Monitor{Email: email, Kind: kind, Value: v, Mode: mode, Lookalike: lookalike})
+	if err != nil {
+		return m, err
+	}
+	if !found {
+		return m, fmt.Errorf("%w: %s does not monitor %s %s", ErrNoMonitor, email, kind, value)
+	}
+	return m, nil
+}
+
+// Verifies the domain monitor of the value for the email by the token its owner published.
+// A token which is not found gives an error wrapping verify.ErrNotVerified.
+// Monitors of other kinds can only be verified by the administrator.
+func VerifyMonitor(ctx context.Context, email string, kind match.Kind, value string, v *verify.Verifier, s Store) (Monitor, error) {
+	if kind != match.KindDomain {
+		return Monitor{}, fmt.Errorf("%w: only domain monitors can be verified by their owner, %s monitors by the administrator", ErrInvalidMonitor, kind)
+	}
+	value, _, err := parseMonitorValue(kind, value)
+	if err != nil {
+		return Monitor{}, err
+	}
+
+	m, found, err := s.GetMonitor(ctx, email, kind, value)
+	if err != nil {
+		return m, err
+	}
+	if !found {
+		return m, fmt.Errorf("%w: %s does not monitor %s %s", ErrNoMonitor, email, kind, value)
+	}
+	if m.VerifiedBy != "" {
+		return m, nil
+	}
+
+	method, err := v.Check(ctx, m.Value, m.VerificationToken)
+	if err != nil {
+		return m, err
+	}
+	m, _, err = s.SetMonitorVerified(ctx, email, kind, value, method)
+	return m, err
+}
+
+// Verifies the monitor of the value for the email as the administrator, without any token.
+func OverrideVerification(ctx context.Context, email string, kind match.Kind, value string, s Store) error {
+	value, _, err := parseMonitorValue(kind, value)
+	if err != nil {
+		return err
+	}
+
+	_, found, err := s.SetMonitorVerified(ctx, email, kind, value, verify.Admin)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("%w: %s does not monitor %s %s", ErrNoMonitor, email, kind, value)
+	}
+	return nil
+}
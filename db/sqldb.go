@@ -1,233 +1,168 @@
 package sqldb
 
 import (
-	"database/sql"
+	"context"
+	"ctlog/match"
 	"encoding/json"
-	_ "github.com/jackc/pgx/v4/stdlib"
-	"log"
+	"log/slog"
 	"os"
 	"regexp"
-	"strings"
 	"time"
 )
 
 type MonitoredCerts struct {
-	Email        string     `json:"email"`
-	Certificates []CertInfo `json:"certs"`
+	Email        string        `json:"email"`
+	Certificates []MatchedCert `json:"certs"`
+	// Monitors of the email which matched the certificates
+	Monitors []Monitor `json:"-"`
+}
+
+// A certificate and the reason it was reported to a monitor
+type MatchedCert struct {
+	CertInfo
+	Reason match.Reason `json:"reason"`
+	// ID of the saved certificate
+	ID int64 `json:"-"`
 }
 
 type CertInfo struct {
 	CN           string
+	UnicodeCN    string // Unicode form of the CN if it is a hostname, the CN otherwise
 	DN           string
 	SerialNumber string
-	SAN          string
+	SAN          []string
+	UnicodeSAN   []string
 	NotBefore    string
 	NotAfter     string
 	Issuer       string
 	Raw          string
-}
 
-type APIData struct {
-	CN        string
-	SAN       []string
-	NotBefore string
-	NotAfter  string
-}
-
-type CTLogInfo struct {
-	OldHeadIndex int64
-	NewHeadIndex int64
+	// Subject O and OU
+	Organization []string
+	// Hex authority key identifier
+	AuthorityKeyID string
+	// Hex SHA-256 of the subject public key info
+	SPKIHash string
+	// Findings of the lint package
+	Lint []string
+	// Hex SHA-256 of the DER of the certificate, or of the TBS certificate of a precertificate
+	Fingerprint string
+
+	// SANs other than DNS names, an IP address in the CN is among the IPAddresses
+	IPAddresses    []string
+	EmailAddresses []string
+	URIs           []string
 }
 
-var emailRegex = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+\\/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
-var domainRegex = regexp.MustCompile("^(([a-zA-Z]{1})|([a-zA-Z]{1}[a-zA-Z]{1})|([a-zA-Z]{1}[0-9]{1})|([0-9]{1}[a-zA-Z]{1})|([a-zA-Z0-9][a-zA-Z0-9-_]{1,61}[a-zA-Z0-9])).([a-zA-Z]{2,6}|[a-zA-Z0-9-]{2,30}.[a-zA-Z]{2,3})$")
-
-// Creates a connection to the database and returns it.
-func ConnectToDatabase(database string) *sql.DB {
-	db, err := sql.Open("pgx", database)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	if err = db.Ping(); err != nil {
-		log.Fatal(err)
+// Returns the hostnames of the certificate in their ASCII forms: DNS SANs, the CN if it is a hostname
+// and the domains of email and URI SANs.
+func (c CertInfo) Names() []string {
+	names := make([]string, 0, len(c.SAN)+1+len(c.EmailAddresses)+len(c.URIs))
+	names = append(names, c.SAN...)
+	if match.IsHostname(c.CN) {
+		names = append(names, match.Normalize(c.CN))
 	}
-	return db
-}
-
-// Closes the database connection.
-func CloseConnection(db *sql.DB) {
-	db.Close()
-}
-
-// Deletes the downloaded certificates.
-func CleanupDownloadTable(db *sql.DB) {
-	db.Exec("DELETE FROM Downloaded")
-}
-
-// Create a temporary table to save new CT log head indexes, so we can reroll in case of an error
-func CreateTempLogTable(db *sql.DB) {
-	// Delete the table if it's still here from the last run
-	_, err := db.Exec("DROP TABLE IF EXISTS TMPCtlog")
-	if err != nil {
-		log.Fatal(err.Error())
+	for _, e := range c.EmailAddresses {
+		if d := match.EmailDomain(e); d != "" {
+			names = append(names, d)
+		}
 	}
-
-	_, err = db.Exec("SELECT * INTO TmpCTLog FROM CTLog")
-	if err != nil {
-		log.Fatal(err.Error())
+	for _, u := range c.URIs {
+		if h := match.URIHost(u); h != "" {
+			names = append(names, h)
+		}
 	}
+	return names
 }
 
-// No error occurred during the program running, update the logs
-func UpdateLogIndexes(db *sql.DB) {
-	_, err := db.Exec("DROP TABLE CTLog")
-	if err != nil {
-		log.Fatal(err.Error())
-	}
-	_, err = db.Exec("ALTER TABLE TmpCTLog RENAME TO CTLog")
-	if err != nil {
-		log.Fatal(err.Error())
+// Returns the monitorable attributes of the certificate other than names.
+func (c CertInfo) Attributes() match.Attributes {
+	return match.Attributes{
+		Organization:   c.Organization,
+		Issuer:         c.Issuer,
+		AuthorityKeyID: c.AuthorityKeyID,
+		SPKIHash:       c.SPKIHash,
+		IPAddresses:    c.IPAddresses,
 	}
 }
 
-// Updates head index.
-func SaveLogIndex(index int64, logurl string, db *sql.DB) {
-	_, err := db.Exec("UPDATE TmpCTLog SET HeadIndex = $1 WHERE Url = $2", index, logurl)
-	if err != nil {
-		log.Printf("[-] Failed to update head index of log %s -> %s\n", logurl, err)
-		return
-	}
+// Identifies the certificate, precertificates share it with their final certificates.
+func (c CertInfo) key() string {
+	return c.SerialNumber + "/" + c.Issuer
 }
 
-// Find monitored certificates, create a map of email -> certificate attributes and send out emails
-func ParseDownloadedCertificates(db *sql.DB) {
-	// Super ugly, but it is the only way to remove duplicates after the join I've found
-	rows, err := db.Query(`
-	WITH
-	INSERTED AS (
-		INSERT INTO Certificate
-		SELECT DISTINCT CN, DN, SerialNumber, SAN, NotBefore, NotAfter, Issuer
-		FROM Downloaded
-		INNER JOIN Monitor M ON CN = M.Domain OR
-			CN = concat('www.', M.Domain) OR
-			CN LIKE concat('%.', M.Domain) OR
-			SAN LIKE concat(',', M.Domain, '%') OR
-			position(concat('.', M.Domain) IN SAN) > 0
-		ON CONFLICT DO NOTHING
-		RETURNING CN, DN, SerialNumber, SAN, NotBefore, NotAfter, Issuer
-	),
-	CERTS AS (
-		SELECT DISTINCT CN, DN, SerialNumber, SAN, NotBefore, NotAfter, Issuer, Email
-		FROM INSERTED
-		INNER JOIN Monitor M ON CN = M.Domain OR
-			CN = concat('www.', M.Domain) OR
-			CN LIKE concat('%.', M.Domain) OR
-			SAN LIKE concat(',', M.Domain, '%') OR
-			position(concat('.', M.Domain) IN SAN) > 0
-	)
-	
-	SELECT json_build_object(
-		'email', Email,
-		'certs', json_agg(CERTS.*))
-	FROM CERTS
-	GROUP BY Email;
-	`)
-
-	if err != nil {
-		log.Fatal(err.Error())
-	}
-	defer rows.Close()
-
-	var results []MonitoredCerts
-	count := 0
-	for rows.Next() {
-		var res MonitoredCerts
-		var tmp []byte
-		err = rows.Scan(&tmp)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		err := json.Unmarshal(tmp, &res)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		count += len(res.Certificates)
-		results = append(results, res)
-	}
-
-	log.Println("FOUND ", count, " CERTIFICATES")
-	log.Println("SENDING EMAILS")
-	for _, r := range results {
-		SendEmail(r)
-	}
+type APIData struct {
+	CN             string
+	SAN            []string
+	IPAddresses    []string
+	EmailAddresses []string
+	URIs           []string
+	NotBefore      string
+	NotAfter       string
 }
 
-func CreateDownloadedFile(db *sql.DB) {
-	fname := "/var/www/html/" + time.Now().Format("02_01_06") + ".jsonl"
+type CTLogInfo struct {
+	OldHeadIndex int64
+	NewHeadIndex int64
+}
 
-	// Create file
-	tmp, err := os.OpenFile(fname, os.O_CREATE, 0777)
-	if err != nil {
-		log.Printf("[-] Failed opening dump file -> %s\n", err)
-		return
-	}
-	tmp.Close()
+var emailRegex = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+\\/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
 
-	query := "SELECT DISTINCT CN, SAN, NotBefore, NotAfter FROM Downloaded WHERE CN!='' OR SAN!=''"
-	rows, err := db.Query(query)
-	if err != nil {
-		log.Printf("[-] Failed creating query for data dump -> %s\n", err)
-		return
-	}
+// Writes the names and validity of the downloaded certificates to a JSON lines file named by the date,
+// certificates without any names are left out.
+func CreateDownloadedFile(ctx context.Context, s Store) {
+	fname := "/var/www/html/" + time.Now().Format("02_01_06") + ".jsonl"
 
-	file, err := os.OpenFile(fname, os.O_TRUNC|os.O_WRONLY, 060)
+	file, err := os.OpenFile(fname, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0777)
 	if err != nil {
-		log.Printf("[-] Failed opening file for writing -> %s\n", err)
+		slog.Error("Failed opening dump file for writing", "file", fname, "err", err)
 		return
 	}
 	defer file.Close()
 
-	for rows.Next() {
-		var (
-			CN        string
-			SAN       string
-			notBefore string
-			notAfter  string
-		)
-
-		err := rows.Scan(&CN, &SAN, &notBefore, &notAfter)
-
-		if err != nil {
-			log.Printf("[-] Failed retrieving data for data dump -> %s\n", err)
-			continue
+	// Precertificates and certificates of the same names are written once
+	written := make(map[string]bool)
+	err = s.EachDownloaded(ctx, func(cert CertInfo) error {
+		if cert.CN == "" && len(cert.SAN) == 0 && len(cert.IPAddresses) == 0 &&
+			len(cert.EmailAddresses) == 0 && len(cert.URIs) == 0 {
+			return nil
 		}
 
-		sanArr := strings.Split(strings.TrimSuffix(SAN, ","), ",")
-
 		tmp, err := json.Marshal(APIData{
-			CN:        CN,
-			SAN:       sanArr,
-			NotBefore: notBefore,
-			NotAfter:  notAfter,
+			CN:             cert.CN,
+			SAN:            cert.SAN,
+			IPAddresses:    cert.IPAddresses,
+			EmailAddresses: cert.EmailAddresses,
+			URIs:           cert.URIs,
+			NotBefore:      cert.NotBefore,
+			NotAfter:       cert.NotAfter,
 		})
-
 		if err != nil {
-			log.Printf("[-] Failed creating json -> %s\n", err)
+			slog.Error("Failed encoding dump file entry", "err", err)
+			return nil
 		}
+		if written[string(tmp)] {
+			return nil
+		}
+		written[string(tmp)] = true
 
 		tmp = append(tmp, '\n')
 		if _, err := file.Write(tmp); err != nil {
-			log.Printf("[-] Failed writing to file -> %s\n", err)
+			slog.Error("Failed writing dump file", "file", fname, "err", err)
 		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("Failed retrieving data for dump file", "err", err)
 	}
 }
 
-func DeleteExpiredCertificates(db *sql.DB) {
-	_, err := db.Exec("DELETE FROM Certificate WHERE now() > to_date(NotAfter, 'YYYY-MM-DD HH24:MI:SS');")
-	if err != nil {
-		log.Fatal(err.Error())
+// Decodes text arrays selected with array_to_json.
+func unmarshalArrays(arrays map[*[]string][]byte) error {
+	for dest, data := range arrays {
+		if err := json.Unmarshal(data, dest); err != nil {
+			return err
+		}
 	}
+	return nil
 }
@@ -0,0 +1,173 @@
+package sqldb
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// Store in an SQLite file, for small deployments and tests. Arrays are stored as JSON.
+//
+// SQLite has a single writer, so the store uses a single connection and its operations take turns.
+type SQLite struct {
+	sqlStore
+}
+
+// Opens or creates the SQLite database at the path, ":memory:" keeps it in memory.
+func OpenSQLite(ctx context.Context, path string) (*SQLite, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(10000)")
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+
+	if err = db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLite{sqlStore{db}}, nil
+}
+
+func (s *SQLite) Migrate(ctx context.Context) error {
+	return applyMigrations(ctx, s.db, sqliteMigrations, sqliteDataMigrations)
+}
+
+// Encodes an array for a JSON column, nil is stored as an empty array.
+func jsonArray(a []string) string {
+	if a == nil {
+		return "[]"
+	}
+	data, _ := json.Marshal(a)
+	return string(data)
+}
+
+// Writes certificates in a transaction, SQLite does not need batches copied in.
+type sqliteInserter struct {
+	db *sql.DB
+}
+
+func (s *SQLite) NewInserter(ctx context.Context) (Inserter, error) {
+	return &sqliteInserter{s.db}, nil
+}
+
+func (i *sqliteInserter) Close() error {
+	return nil
+}
+
+// Inserts the certificates in one transaction, returns the number written like the PostgreSQL merge counts it.
+// A failing statement does not abort an SQLite transaction, so failing certificates are logged and skipped.
+func (i *sqliteInserter) Insert(ctx context.Context, certs []CertInfo) (int, error) {
+	tx, err := i.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	written := 0
+	for _, c := range certs {
+		res, err := tx.ExecContext(ctx, `
+		INSERT INTO Downloaded (CN, DN, SerialNumber, SAN, UnicodeSAN, NotBefore, NotAfter, Issuer, Raw,
+			Organization, AuthorityKeyID, SPKIHash, Lint, IPAddresses, EmailAddresses, URIs, UnicodeCN)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)
+		ON CONFLICT DO NOTHING`,
+			c.CN, c.DN, c.SerialNumber, jsonArray(c.SAN), jsonArray(c.UnicodeSAN), c.NotBefore, c.NotAfter, c.Issuer, c.Raw,
+			jsonArray(c.Organization), c.AuthorityKeyID, c.SPKIHash, jsonArray(c.Lint),
+			jsonArray(c.IPAddresses), jsonArray(c.EmailAddresses), jsonArray(c.URIs), c.UnicodeCN)
+		if err != nil {
+			if ctx.Err() != nil {
+				return 0, ctx.Err()
+			}
+			slog.Error("Failed saving certificate", "cn", c.CN, "dn", c.DN, "san", c.SAN, "serial", c.SerialNumber, "err", err)
+			continue
+		}
+		// Duplicates are ignored and not counted
+		if n, err := res.RowsAffected(); err == nil {
+			written += int(n)
+		}
+	}
+	return written, tx.Commit()
+}
+
+// Columns of Downloaded or Certificate aliased D, read by scanCertInfo, the arrays are JSON already
+const sqliteDownloadedColumns = `D.CN, COALESCE(D.UnicodeCN, D.CN), D.DN, D.SerialNumber, D.SAN, D.UnicodeSAN,
+	D.NotBefore, D.NotAfter, D.Issuer, D.Organization, D.AuthorityKeyID, D.SPKIHash,
+	D.Lint, D.IPAddresses, D.EmailAddresses, D.URIs`
+
+func (s *SQLite) EachDownloaded(ctx context.Context, fn func(CertInfo) error) error {
+	rows, err := s.db.QueryContext(ctx, "SELECT "+sqliteDownloadedColumns+" FROM Downloaded D")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cert CertInfo
+		if err := scanCertInfo(rows, &cert); err != nil {
+			return err
+		}
+		if err := fn(cert); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *SQLite) SaveCertificate(ctx context.Context, cert CertInfo) (bool, error) {
+	_, saved, err := insertSQLiteCertificate(ctx, s.db, cert)
+	return saved, err
+}
+
+func (s *SQLite) SaveMatches(ctx context.Context, matches []Match) (int, error) {
+	return s.saveMatches(ctx, matches, insertSQLiteCertificate)
+}
+
+// Inserts the certificate, returns its rowid and reports whether it was not saved before
+func insertSQLiteCertificate(ctx context.Context, q querier, cert CertInfo) (int64, bool, error) {
+	var id int64
+	err := q.QueryRowContext(ctx, `
+	INSERT INTO Certificate (CN, DN, SerialNumber, SAN, UnicodeSAN, NotBefore, NotAfter, Issuer,
+		Organization, AuthorityKeyID, SPKIHash, Lint, IPAddresses, EmailAddresses, URIs, Fingerprint, UnicodeCN)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)
+	ON CONFLICT DO NOTHING
+	RETURNING rowid`,
+		cert.CN, cert.DN, cert.SerialNumber, jsonArray(cert.SAN), jsonArray(cert.UnicodeSAN), cert.NotBefore, cert.NotAfter, cert.Issuer,
+		jsonArray(cert.Organization), cert.AuthorityKeyID, cert.SPKIHash, jsonArray(cert.Lint),
+		jsonArray(cert.IPAddresses), jsonArray(cert.EmailAddresses), jsonArray(cert.URIs), cert.Fingerprint, cert.UnicodeCN).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	return id, err == nil, err
+}
+
+var sqliteDialect = searchDialect{
+	columns: sqliteDownloadedColumns,
+	id:      "D.rowid",
+	names:   "(SELECT value AS N FROM json_each(D.SAN) UNION ALL SELECT lower(D.CN))",
+}
+
+func (s *SQLite) SearchCertificates(ctx context.Context, q CertificateQuery) ([]StoredCert, error) {
+	return s.searchCertificates(ctx, q, sqliteDialect)
+}
+
+func (s *SQLite) PendingNotifications(ctx context.Context) ([]MonitoredCerts, error) {
+	return s.pendingNotifications(ctx, sqliteDialect)
+}
+
+// NotAfter is formatted like datetime() of SQLite, so they compare as strings.
+// FinishedAt is set by CURRENT_TIMESTAMP, the time is formatted like it so they compare as strings.
+func (s *SQLite) DeleteFinishedRuns(ctx context.Context, before time.Time) (int64, error) {
+	res, err := s.db.ExecContext(ctx, "DELETE FROM Run WHERE Status <> $1 AND FinishedAt < $2", RunRunning, before.UTC().Format(time.DateTime))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *SQLite) DeleteExpiredCertificates(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM Certificate WHERE NotAfter < datetime('now')")
+	return err
+}
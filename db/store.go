@@ -0,0 +1,502 @@
+package sqldb
+
+import (
+	"context"
+	"ctlog/match"
+	"ctlog/verify"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Storage of the logs, runs, downloaded certificates, monitors and matches.
+// PostgreSQL is the main implementation, SQLite serves small deployments and tests.
+//
+// Stores only keep data. Validation of monitors, matching and notifications are done
+// by the functions of this package on top of any store.
+type Store interface {
+	// Creates the schema or brings it up to date.
+	Migrate(ctx context.Context) error
+	Close() error
+
+	// Returns the monitored CT logs.
+	Logs(ctx context.Context) ([]CTLog, error)
+	// Sets the last downloaded index of a log.
+	SetHead(ctx context.Context, logurl string, head int64) error
+	// Adds a log to download from its start, or sets the maximum merge delay of a log added before.
+	SaveLog(ctx context.Context, logurl string, mmd int64) error
+
+	// Marks runs whose last heartbeat is before the time as aborted, their process did not finish.
+	// Returns how many there were.
+	AbortStaleRuns(ctx context.Context, before time.Time) (int64, error)
+	// Records a new run with the ranges it is going to download from each log and returns its ID.
+	StartRun(ctx context.Context, logInfos map[string]CTLogInfo) (int64, error)
+	// Records that the process of the run is still alive.
+	Heartbeat(ctx context.Context, runID int64) error
+	// Sets the status of a log within the run together with the last index downloaded without gaps
+	// and the number of entries downloaded and failed to parse.
+	SetRunLogStatus(ctx context.Context, runID int64, logurl string, status string, completedHead int64, downloaded int64, parseFailures int64) error
+	// Advances the heads of the logs of the run to their completed heads, each log on its own,
+	// and marks the run with the status and its totals. A head only moves if nothing else moved it since the run started,
+	// a failed run moves none. The run is finished even if some heads could not be advanced, their errors are returned.
+	FinishRun(ctx context.Context, runID int64, status string, stats RunStats) error
+	// Deletes the runs finished before the time together with their logs, returns how many there were.
+	DeleteFinishedRuns(ctx context.Context, before time.Time) (int64, error)
+	// Returns the most recent runs, newest first.
+	ListRuns(ctx context.Context, limit int) ([]RunInfo, error)
+	// Returns the run and its logs.
+	GetRun(ctx context.Context, id int64) (RunInfo, []RunLogInfo, error)
+
+	// Deletes the downloaded certificates, they are only kept for dumps. Nothing is deleted while a run is running.
+	CleanupDownloaded(ctx context.Context) error
+	// Returns an inserter of downloaded certificates, several can be used at once.
+	NewInserter(ctx context.Context) (Inserter, error)
+	// Calls fn for every downloaded certificate, stops at the first error.
+	// Callbacks must not use the store, it may be reading with its only connection.
+	EachDownloaded(ctx context.Context, fn func(CertInfo) error) error
+
+	// Saves the raw entry and the reason it could not be parsed, so it can be reprocessed later.
+	QuarantineEntry(ctx context.Context, entry QuarantinedEntry) error
+	// Returns all quarantined entries.
+	LoadQuarantine(ctx context.Context) ([]QuarantinedEntry, error)
+	// Removes an entry which was parsed successfully from the quarantine.
+	ReleaseQuarantinedEntry(ctx context.Context, logurl string, index int64) error
+
+	// Saves a validated monitor, an existing one gets its mode and lookalike sensitivity updated.
+	// The monitor is confirmed and verified by the administrator.
+	SaveMonitor(ctx context.Context, m Monitor) error
+	// Saves a validated monitor waiting for the confirmation token of the hash and for the verification
+	// of its domain by its VerificationToken. An existing one gets its mode and lookalike sensitivity updated,
+	// a confirmed one stays confirmed and its verification is kept. Returns the saved monitor.
+	SavePendingMonitor(ctx context.Context, m Monitor, tokenHash string) (Monitor, error)
+	// Confirms the monitor waiting for the token of the hash, reports whether there was one.
+	ConfirmMonitor(ctx context.Context, tokenHash string) (Monitor, bool, error)
+	// Updates the mode and lookalike sensitivity of a monitor, empty ones are kept. Returns the updated monitor
+	// and reports whether it exists.
+	UpdateMonitor(ctx context.Context, m Monitor) (Monitor, bool, error)
+	// Records how a monitor was verified, returns it and reports whether it exists.
+	SetMonitorVerified(ctx context.Context, email string, kind match.Kind, value string, by verify.Method) (Monitor, bool, error)
+	// Returns a monitor of the email, reports whether it exists.
+	GetMonitor(ctx context.Context, email string, kind match.Kind, value string) (Monitor, bool, error)
+	// Deletes a monitor, reports whether it existed.
+	DeleteMonitor(ctx context.Context, email string, kind match.Kind, value string) (bool, error)
+	// Authorizes a validated CA for the monitored domain of the email.
+	SaveAuthorizedCA(ctx context.Context, email string, domain string, ca string) error
+	// Deletes an authorized CA, reports whether it existed.
+	DeleteAuthorizedCA(ctx context.Context, email string, domain string, ca string) (bool, error)
+	// Returns the CA policies of the domain monitors, keyed by email and domain.
+	Policies(ctx context.Context) (map[string]match.Policy, error)
+
+	// Returns the confirmed and verified monitors, the ones which are matched.
+	Monitors(ctx context.Context) ([]Monitor, error)
+	// Returns the monitors of the email, confirmed and verified or not.
+	MonitorsOf(ctx context.Context, email string) ([]Monitor, error)
+
+	// Saves the hash of an API key of the email.
+	SaveAPIKey(ctx context.Context, hash string, email string) error
+	// Returns the email of the API key of the hash, reports whether there is one.
+	APIKeyEmail(ctx context.Context, hash string) (string, bool, error)
+	// Saves the hash of a sign-in or session token of the email, expired tokens are deleted.
+	SaveSession(ctx context.Context, hash string, email string, kind string, expiresAt time.Time) error
+	// Returns the email of the token of the hash and kind which has not expired by now, reports whether there is one.
+	SessionEmail(ctx context.Context, hash string, kind string, now time.Time) (string, bool, error)
+	// Deletes the token of the hash and kind, returns its email and reports whether it existed and had not expired by now.
+	TakeSession(ctx context.Context, hash string, kind string, now time.Time) (string, bool, error)
+	// Returns the secret of the name, the candidate is saved as the secret if there is none yet.
+	Secret(ctx context.Context, name string, candidate string) (string, error)
+
+	// Saves a matched certificate, reports whether it was not saved before.
+	SaveCertificate(ctx context.Context, cert CertInfo) (bool, error)
+	// Saves the matched certificates with a notification of each of their recipients in one transaction.
+	// Certificates saved before get no notifications. Returns the number of certificates not saved before.
+	SaveMatches(ctx context.Context, matches []Match) (int, error)
+	// Returns the certificates of the notifications not sent yet grouped by email, with the monitors which matched them.
+	PendingNotifications(ctx context.Context) ([]MonitoredCerts, error)
+	// Marks the notifications of the certificates of the IDs to the email as sent.
+	MarkNotified(ctx context.Context, email string, ids []int64) error
+	// Returns the saved certificates found by the query, newest first.
+	SearchCertificates(ctx context.Context, q CertificateQuery) ([]StoredCert, error)
+	// Deletes the saved certificates which expired.
+	DeleteExpiredCertificates(ctx context.Context) error
+}
+
+// Writes downloaded certificates, duplicates are ignored.
+type Inserter interface {
+	// Returns the number of certificates written, not counting duplicates. Certificates which fail on their own are logged and skipped.
+	Insert(ctx context.Context, certs []CertInfo) (int, error)
+	Close() error
+}
+
+// A monitored CT log
+type CTLog struct {
+	Url       string
+	HeadIndex int64
+	// Maximum merge delay in seconds
+	MMD int64
+}
+
+// A monitor of an email. Value holds the monitored value of any kind in its stored form,
+// Display the form shown to users. Mode and Lookalike only apply to domain monitors.
+// Monitors added through the API are not matched until the email confirms them and the owner
+// of the domain publishes the VerificationToken, or the administrator verifies them.
+type Monitor struct {
+	Email     string
+	Kind      match.Kind
+	Value     string
+	Display   string
+	Mode      match.Mode
+	Lookalike match.Sensitivity
+	Confirmed bool
+
+	VerificationToken string
+	// How the monitor was verified, empty until it is
+	VerifiedBy verify.Method
+}
+
+// A search of the saved certificates, empty fields do not filter.
+type CertificateQuery struct {
+	// ASCII form of a name of the certificates, with Subdomains also the names below it
+	Domain     string
+	Subdomains bool
+	// Issuer DN or hex AKI
+	Issuer string
+	// Lowercase hex without leading zeros
+	SerialNumber string
+	// Lowercase hex SHA-256
+	Fingerprint string
+	// The certificates are valid at some point between the times, formatted like NotBefore and NotAfter
+	ValidFrom string
+	ValidTo   string
+
+	// ID of the last certificate of the previous page, 0 for the first page
+	After int64
+	Limit int
+}
+
+// A saved certificate, IDs grow as certificates are saved
+type StoredCert struct {
+	ID int64
+	CertInfo
+}
+
+const sqlitePrefix = "sqlite:"
+
+// Opens the store of the database: "sqlite:<path>" for an SQLite file, PostgreSQL connection parameters otherwise.
+func Open(ctx context.Context, database string) (Store, error) {
+	if strings.HasPrefix(database, sqlitePrefix) {
+		s, err := OpenSQLite(ctx, strings.TrimPrefix(database, sqlitePrefix))
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+
+	p, err := ConnectToDatabase(ctx, database)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Queries both databases understand, shared by the stores. Arrays and name lookups differ and are left to each store.
+type sqlStore struct {
+	db *sql.DB
+}
+
+// Closes the database connection.
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *sqlStore) Logs(ctx context.Context) ([]CTLog, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT Url, HeadIndex, MMD FROM CTLog")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var logs []CTLog
+	for rows.Next() {
+		var l CTLog
+		if err := rows.Scan(&l.Url, &l.HeadIndex, &l.MMD); err != nil {
+			return nil, err
+		}
+		logs = append(logs, l)
+	}
+	return logs, rows.Err()
+}
+
+func (s *sqlStore) SetHead(ctx context.Context, logurl string, head int64) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE CTLog SET HeadIndex = $1 WHERE Url = $2", head, logurl)
+	return err
+}
+
+func (s *sqlStore) SaveLog(ctx context.Context, logurl string, mmd int64) error {
+	_, err := s.db.ExecContext(ctx, `
+	INSERT INTO CTLog (Url, MMD) VALUES ($1, $2)
+	ON CONFLICT (Url) DO UPDATE SET MMD = EXCLUDED.MMD`, logurl, mmd)
+	return err
+}
+
+// Deletes the downloaded certificates.
+func (s *sqlStore) CleanupDownloaded(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM Downloaded WHERE NOT EXISTS (SELECT 1 FROM Run WHERE Status = $1)", RunRunning)
+	return err
+}
+
+func (s *sqlStore) SaveMonitor(ctx context.Context, m Monitor) error {
+	_, err := s.db.ExecContext(ctx, `
+	INSERT INTO Monitor (Email, Kind, Domain, UnicodeDomain, Mode, Lookalike, VerifiedBy) VALUES ($1, $2, $3, $4, $5, $6, 'admin')
+	ON CONFLICT (Email, Kind, Domain) DO UPDATE SET Mode = EXCLUDED.Mode, Lookalike = EXCLUDED.Lookalike,
+		ConfirmationHash = NULL, VerifiedBy = 'admin'`,
+		m.Email, string(m.Kind), m.Value, m.Display, string(m.Mode), string(m.Lookalike))
+	return err
+}
+
+func (s *sqlStore) SavePendingMonitor(ctx context.Context, m Monitor, tokenHash string) (Monitor, error) {
+	saved, _, err := s.returnMonitor(s.db.QueryRowContext(ctx, `
+	INSERT INTO Monitor (Email, Kind, Domain, UnicodeDomain, Mode, Lookalike, ConfirmationHash, VerificationToken)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	ON CONFLICT (Email, Kind, Domain) DO UPDATE SET Mode = EXCLUDED.Mode, Lookalike = EXCLUDED.Lookalike,
+		ConfirmationHash = CASE WHEN Monitor.ConfirmationHash IS NULL THEN NULL ELSE EXCLUDED.ConfirmationHash END
+	RETURNING `+monitorColumns,
+		m.Email, string(m.Kind), m.Value, m.Display, string(m.Mode), string(m.Lookalike), tokenHash, m.VerificationToken))
+	return saved, err
+}
+
+func (s *sqlStore) ConfirmMonitor(ctx context.Context, tokenHash string) (Monitor, bool, error) {
+	return s.returnMonitor(s.db.QueryRowContext(ctx, `
+	UPDATE Monitor SET ConfirmationHash = NULL WHERE ConfirmationHash = $1 RETURNING `+monitorColumns, tokenHash))
+}
+
+func (s *sqlStore) UpdateMonitor(ctx context.Context, m Monitor) (Monitor, bool, error) {
+	return s.returnMonitor(s.db.QueryRowContext(ctx, `
+	UPDATE Monitor SET Mode = COALESCE(NULLIF($1, ''), Mode), Lookalike = COALESCE(NULLIF($2, ''), Lookalike)
+	WHERE Email = $3 AND Kind = $4 AND Domain = $5 RETURNING `+monitorColumns,
+		string(m.Mode), string(m.Lookalike), m.Email, string(m.Kind), m.Value))
+}
+
+func (s *sqlStore) SetMonitorVerified(ctx context.Context, email string, kind match.Kind, value string, by verify.Method) (Monitor, bool, error) {
+	return s.returnMonitor(s.db.QueryRowContext(ctx, `
+	UPDATE Monitor SET VerifiedBy = $1 WHERE Email = $2 AND Kind = $3 AND Domain = $4 RETURNING `+monitorColumns,
+		string(by), email, string(kind), value))
+}
+
+func (s *sqlStore) GetMonitor(ctx context.Context, email string, kind match.Kind, value string) (Monitor, bool, error) {
+	return s.returnMonitor(s.db.QueryRowContext(ctx, `
+	SELECT `+monitorColumns+` FROM Monitor WHERE Email = $1 AND Kind = $2 AND Domain = $3`, email, string(kind), value))
+}
+
+// Scans the monitor returned by a statement, reports whether there was one.
+func (s *sqlStore) returnMonitor(row *sql.Row) (Monitor, bool, error) {
+	m, err := scanMonitor(row)
+	if err == sql.ErrNoRows {
+		return m, false, nil
+	}
+	return m, err == nil, err
+}
+
+func (s *sqlStore) DeleteMonitor(ctx context.Context, email string, kind match.Kind, value string) (bool, error) {
+	res, err := s.db.ExecContext(ctx, "DELETE FROM Monitor WHERE Email = $1 AND Kind = $2 AND Domain = $3", email, string(kind), value)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *sqlStore) SaveAuthorizedCA(ctx context.Context, email string, domain string, ca string) error {
+	_, err := s.db.ExecContext(ctx, "INSERT INTO MonitorCA (Email, Domain, CA) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING", email, domain, ca)
+	return err
+}
+
+func (s *sqlStore) DeleteAuthorizedCA(ctx context.Context, email string, domain string, ca string) (bool, error) {
+	res, err := s.db.ExecContext(ctx, "DELETE FROM MonitorCA WHERE Email = $1 AND Domain = $2 AND CA = $3", email, domain, ca)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *sqlStore) Policies(ctx context.Context) (map[string]match.Policy, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT Email, Domain, CA FROM MonitorCA")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	policies := make(map[string]match.Policy)
+	for rows.Next() {
+		var email, domain, ca string
+		if err := rows.Scan(&email, &domain, &ca); err != nil {
+			return nil, err
+		}
+		policies[policyKey(email, domain)] = append(policies[policyKey(email, domain)], ca)
+	}
+	return policies, rows.Err()
+}
+
+func (s *sqlStore) Monitors(ctx context.Context) ([]Monitor, error) {
+	return s.queryMonitors(ctx, "WHERE ConfirmationHash IS NULL AND VerifiedBy IS NOT NULL")
+}
+
+func (s *sqlStore) MonitorsOf(ctx context.Context, email string) ([]Monitor, error) {
+	return s.queryMonitors(ctx, "WHERE Email = $1 ORDER BY Kind, Domain", email)
+}
+
+// Columns of Monitor read by scanMonitor
+const monitorColumns = "Email, Kind, Domain, UnicodeDomain, Mode, Lookalike, ConfirmationHash IS NULL, VerificationToken, COALESCE(VerifiedBy, '')"
+
+func scanMonitor(row interface{ Scan(...interface{}) error }) (Monitor, error) {
+	var m Monitor
+	err := row.Scan(&m.Email, &m.Kind, &m.Value, &m.Display, &m.Mode, &m.Lookalike, &m.Confirmed,
+		&m.VerificationToken, &m.VerifiedBy)
+	return m, err
+}
+
+// Returns the monitors selected by the rest of the query.
+func (s *sqlStore) queryMonitors(ctx context.Context, rest string, args ...interface{}) ([]Monitor, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT "+monitorColumns+" FROM Monitor "+rest, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var monitors []Monitor
+	for rows.Next() {
+		m, err := scanMonitor(rows)
+		if err != nil {
+			return nil, err
+		}
+		monitors = append(monitors, m)
+	}
+	return monitors, rows.Err()
+}
+
+func (s *sqlStore) SaveAPIKey(ctx context.Context, hash string, email string) error {
+	_, err := s.db.ExecContext(ctx, "INSERT INTO ApiKey (Hash, Email) VALUES ($1, $2)", hash, email)
+	return err
+}
+
+func (s *sqlStore) APIKeyEmail(ctx context.Context, hash string) (string, bool, error) {
+	var email string
+	err := s.db.QueryRowContext(ctx, "SELECT Email FROM ApiKey WHERE Hash = $1", hash).Scan(&email)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	return email, err == nil, err
+}
+
+func (s *sqlStore) SaveSession(ctx context.Context, hash string, email string, kind string, expiresAt time.Time) error {
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM Session WHERE ExpiresAt <= $1", time.Now().Unix()); err != nil {
+		return err
+	}
+	_, err := s.db.ExecContext(ctx, "INSERT INTO Session (Hash, Email, Kind, ExpiresAt) VALUES ($1, $2, $3, $4)", hash, email, kind, expiresAt.Unix())
+	return err
+}
+
+func (s *sqlStore) SessionEmail(ctx context.Context, hash string, kind string, now time.Time) (string, bool, error) {
+	var email string
+	err := s.db.QueryRowContext(ctx, "SELECT Email FROM Session WHERE Hash = $1 AND Kind = $2 AND ExpiresAt > $3", hash, kind, now.Unix()).Scan(&email)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	return email, err == nil, err
+}
+
+func (s *sqlStore) TakeSession(ctx context.Context, hash string, kind string, now time.Time) (string, bool, error) {
+	var email string
+	var expiresAt int64
+	err := s.db.QueryRowContext(ctx, "DELETE FROM Session WHERE Hash = $1 AND Kind = $2 RETURNING Email, ExpiresAt", hash, kind).Scan(&email, &expiresAt)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return email, expiresAt > now.Unix(), nil
+}
+
+func (s *sqlStore) Secret(ctx context.Context, name string, candidate string) (string, error) {
+	_, err := s.db.ExecContext(ctx, "INSERT INTO Secret (Name, Value) VALUES ($1, $2) ON CONFLICT (Name) DO NOTHING", name, candidate)
+	if err != nil {
+		return "", err
+	}
+	var secret string
+	err = s.db.QueryRowContext(ctx, "SELECT Value FROM Secret WHERE Name = $1", name).Scan(&secret)
+	return secret, err
+}
+
+// How the stores differ in the certificate search
+type searchDialect struct {
+	// Columns of Certificate D read by scanCertInfo
+	columns string
+	// Column of the ID of Certificate D
+	id string
+	// Table of the names of Certificate D, the SANs and the CN, in column N
+	names string
+	// Collation of times compared as text
+	collate string
+}
+
+// Searches Certificate D. A name is below the domain if it ends with "." and the domain.
+func (s *sqlStore) searchCertificates(ctx context.Context, q CertificateQuery, d searchDialect) ([]StoredCert, error) {
+	var where []string
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if q.Domain != "" {
+		domain := arg(q.Domain)
+		cond := "N = " + domain
+		if q.Subdomains {
+			cond += " OR substr(N, length(N) - length(" + domain + ")) = '.' || " + domain
+		}
+		where = append(where, "EXISTS (SELECT 1 FROM "+d.names+" WHERE "+cond+")")
+	}
+	if q.Issuer != "" {
+		issuer := arg(q.Issuer)
+		where = append(where, "(D.Issuer = "+issuer+" OR D.AuthorityKeyID = "+issuer+")")
+	}
+	if q.SerialNumber != "" {
+		where = append(where, "D.SerialNumber = "+arg(q.SerialNumber))
+	}
+	if q.Fingerprint != "" {
+		where = append(where, "D.Fingerprint = "+arg(q.Fingerprint))
+	}
+	if q.ValidFrom != "" {
+		where = append(where, "D.NotAfter"+d.collate+" >= "+arg(q.ValidFrom))
+	}
+	if q.ValidTo != "" {
+		where = append(where, "D.NotBefore"+d.collate+" <= "+arg(q.ValidTo))
+	}
+	if q.After > 0 {
+		where = append(where, d.id+" < "+arg(q.After))
+	}
+
+	query := "SELECT " + d.columns + ", D.Fingerprint, " + d.id + " FROM Certificate D"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY " + d.id + " DESC LIMIT " + arg(q.Limit)
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var certs []StoredCert
+	for rows.Next() {
+		var c StoredCert
+		if err := scanCertInfo(rows, &c.CertInfo, &c.Fingerprint, &c.ID); err != nil {
+			return nil, err
+		}
+		certs = append(certs, c)
+	}
+	return certs, rows.Err()
+}
@@ -0,0 +1,267 @@
+package sqldb
+
+import (
+	"context"
+	"ctlog/match"
+	"ctlog/verify"
+	"slices"
+	"testing"
+	"time"
+)
+
+// Returns a migrated SQLite store which is removed with the test
+func newTestStore(t *testing.T) *SQLite {
+	t.Helper()
+	ctx := context.Background()
+	s, err := OpenSQLite(ctx, t.TempDir()+"/ctlog.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	if err := s.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestSaveLog(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t)
+
+	if err := s.SaveLog(ctx, "https://log.example/", 86400); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetHead(ctx, "https://log.example/", 41); err != nil {
+		t.Fatal(err)
+	}
+	// Saved again, only the MMD changes
+	if err := s.SaveLog(ctx, "https://log.example/", 3600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveLog(ctx, "https://other.example/", 60); err != nil {
+		t.Fatal(err)
+	}
+
+	logs, err := s.Logs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]CTLog{
+		"https://log.example/":   {Url: "https://log.example/", HeadIndex: 41, MMD: 3600},
+		"https://other.example/": {Url: "https://other.example/", HeadIndex: -1, MMD: 60},
+	}
+	if len(logs) != len(want) {
+		t.Fatalf("Logs() = %+v, want %+v", logs, want)
+	}
+	for _, l := range logs {
+		if l != want[l.Url] {
+			t.Errorf("log %+v, want %+v", l, want[l.Url])
+		}
+	}
+}
+
+func TestSearchCertificates(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t)
+
+	first := testCert(10, "www.example.com")
+	first.AuthorityKeyID = "aa"
+	first.Fingerprint = "f1"
+	second := testCert(11, "a.b.example.com")
+	second.Issuer = "CN=Other CA"
+	second.NotBefore, second.NotAfter = "2025-01-01 00:00:00", "2025-04-01 00:00:00"
+	for _, c := range []CertInfo{first, second, testCert(12, "badexample.com")} {
+		saveTestCert(t, s, c)
+	}
+	if saved, err := s.SaveCertificate(ctx, first); err != nil || saved {
+		t.Errorf("SaveCertificate() of a saved certificate = %v, %v, want false", saved, err)
+	}
+
+	tests := []struct {
+		name string
+		q    CertificateQuery
+		want []string
+	}{
+		{"all", CertificateQuery{}, []string{"badexample.com", "a.b.example.com", "www.example.com"}},
+		{"exact", CertificateQuery{Domain: "www.example.com"}, []string{"www.example.com"}},
+		{"exact parent", CertificateQuery{Domain: "example.com"}, nil},
+		{"subdomains", CertificateQuery{Domain: "example.com", Subdomains: true}, []string{"a.b.example.com", "www.example.com"}},
+		{"issuer DN", CertificateQuery{Issuer: "CN=Other CA"}, []string{"a.b.example.com"}},
+		{"issuer AKI", CertificateQuery{Issuer: "aa"}, []string{"www.example.com"}},
+		{"serial", CertificateQuery{SerialNumber: "12"}, []string{"badexample.com"}},
+		{"fingerprint", CertificateQuery{Fingerprint: "f1"}, []string{"www.example.com"}},
+		{"valid from", CertificateQuery{ValidFrom: "2025-06-01 00:00:00"}, []string{"badexample.com", "www.example.com"}},
+		{"valid to", CertificateQuery{ValidTo: "2025-06-01 00:00:00"}, []string{"a.b.example.com"}},
+		{"limit", CertificateQuery{Limit: 1}, []string{"badexample.com"}},
+	}
+	for _, tt := range tests {
+		if tt.q.Limit == 0 {
+			tt.q.Limit = 10
+		}
+		certs, err := s.SearchCertificates(ctx, tt.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var cns []string
+		for _, c := range certs {
+			cns = append(cns, c.CN)
+		}
+		if !slices.Equal(cns, tt.want) {
+			t.Errorf("%s: SearchCertificates() = %v, want %v", tt.name, cns, tt.want)
+		}
+	}
+
+	// The next page continues after the last certificate of the previous one
+	page, err := s.SearchCertificates(ctx, CertificateQuery{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := s.SearchCertificates(ctx, CertificateQuery{Limit: 2, After: page[1].ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(next) != 1 || next[0].CN != "www.example.com" || next[0].ID >= page[1].ID {
+		t.Errorf("next page %+v after %d", next, page[1].ID)
+	}
+}
+
+func TestMonitorLifecycle(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t)
+
+	pending := Monitor{Email: "user@example.com", Kind: match.KindDomain, Value: "example.com", Display: "example.com",
+		Mode: match.Subdomain, Lookalike: match.Off, VerificationToken: "verification"}
+	m, err := s.SavePendingMonitor(ctx, pending, "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Confirmed || m.VerifiedBy != "" || m.VerificationToken != "verification" {
+		t.Errorf("SavePendingMonitor() = %+v", m)
+	}
+	if monitors, err := s.Monitors(ctx); err != nil || len(monitors) != 0 {
+		t.Errorf("Monitors() of a pending monitor = %+v, %v", monitors, err)
+	}
+
+	if _, found, err := s.ConfirmMonitor(ctx, "wrong"); err != nil || found {
+		t.Errorf("ConfirmMonitor() of a wrong hash = %v, %v", found, err)
+	}
+	if m, found, err := s.ConfirmMonitor(ctx, "hash"); err != nil || !found || !m.Confirmed {
+		t.Errorf("ConfirmMonitor() = %+v, %v, %v", m, found, err)
+	}
+	if _, found, err := s.ConfirmMonitor(ctx, "hash"); err != nil || found {
+		t.Errorf("ConfirmMonitor() of a used hash = %v, %v", found, err)
+	}
+
+	// Requested again, a confirmed monitor stays confirmed
+	pending.Lookalike = match.High
+	if m, err := s.SavePendingMonitor(ctx, pending, "other"); err != nil || !m.Confirmed || m.Lookalike != match.High {
+		t.Errorf("SavePendingMonitor() of a confirmed monitor = %+v, %v", m, err)
+	}
+	if m, found, err := s.UpdateMonitor(ctx, Monitor{Email: "user@example.com", Kind: match.KindDomain, Value: "example.com", Mode: match.Exact}); err != nil || !found ||
+		m.Mode != match.Exact || m.Lookalike != match.High {
+		t.Errorf("UpdateMonitor() = %+v, %v, %v", m, found, err)
+	}
+	if _, found, err := s.UpdateMonitor(ctx, Monitor{Email: "other@example.com", Kind: match.KindDomain, Value: "example.com", Mode: match.Exact}); err != nil || found {
+		t.Errorf("UpdateMonitor() of another email = %v, %v", found, err)
+	}
+
+	if m, found, err := s.SetMonitorVerified(ctx, "user@example.com", match.KindDomain, "example.com", verify.DNS); err != nil || !found || m.VerifiedBy != verify.DNS {
+		t.Errorf("SetMonitorVerified() = %+v, %v, %v", m, found, err)
+	}
+	if monitors, err := s.Monitors(ctx); err != nil || len(monitors) != 1 {
+		t.Errorf("Monitors() of a confirmed and verified monitor = %+v, %v", monitors, err)
+	}
+	if m, found, err := s.GetMonitor(ctx, "user@example.com", match.KindDomain, "example.com"); err != nil || !found || m.Mode != match.Exact {
+		t.Errorf("GetMonitor() = %+v, %v, %v", m, found, err)
+	}
+
+	if found, err := s.DeleteMonitor(ctx, "user@example.com", match.KindDomain, "example.com"); err != nil || !found {
+		t.Errorf("DeleteMonitor() = %v, %v", found, err)
+	}
+	if found, err := s.DeleteMonitor(ctx, "user@example.com", match.KindDomain, "example.com"); err != nil || found {
+		t.Errorf("DeleteMonitor() of a deleted monitor = %v, %v", found, err)
+	}
+	if monitors, err := s.MonitorsOf(ctx, "user@example.com"); err != nil || len(monitors) != 0 {
+		t.Errorf("MonitorsOf() = %+v, %v", monitors, err)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t)
+	now := time.Now()
+
+	if err := s.SaveAPIKey(ctx, "key", "user@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if email, ok, err := s.APIKeyEmail(ctx, "key"); err != nil || !ok || email != "user@example.com" {
+		t.Errorf("APIKeyEmail() = %q, %v, %v", email, ok, err)
+	}
+	if _, ok, err := s.APIKeyEmail(ctx, "wrong"); err != nil || ok {
+		t.Errorf("APIKeyEmail() of a wrong hash = %v, %v", ok, err)
+	}
+
+	if err := s.SaveSession(ctx, "login", "user@example.com", loginToken, now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveSession(ctx, "expired", "user@example.com", sessionToken, now.Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := s.SessionEmail(ctx, "login", sessionToken, now); err != nil || ok {
+		t.Errorf("SessionEmail() of another kind = %v, %v", ok, err)
+	}
+	if _, ok, err := s.SessionEmail(ctx, "expired", sessionToken, now); err != nil || ok {
+		t.Errorf("SessionEmail() of an expired token = %v, %v", ok, err)
+	}
+	if email, ok, err := s.SessionEmail(ctx, "login", loginToken, now); err != nil || !ok || email != "user@example.com" {
+		t.Errorf("SessionEmail() = %q, %v, %v", email, ok, err)
+	}
+
+	// A token is taken once
+	if email, ok, err := s.TakeSession(ctx, "login", loginToken, now); err != nil || !ok || email != "user@example.com" {
+		t.Errorf("TakeSession() = %q, %v, %v", email, ok, err)
+	}
+	if _, ok, err := s.TakeSession(ctx, "login", loginToken, now); err != nil || ok {
+		t.Errorf("TakeSession() of a taken token = %v, %v", ok, err)
+	}
+	if _, ok, err := s.TakeSession(ctx, "expired", sessionToken, now); err != nil || ok {
+		t.Errorf("TakeSession() of an expired token = %v, %v", ok, err)
+	}
+}
+
+func TestSecret(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t)
+
+	if secret, err := s.Secret(ctx, "name", "first"); err != nil || secret != "first" {
+		t.Errorf("Secret() = %q, %v, want the candidate", secret, err)
+	}
+	if secret, err := s.Secret(ctx, "name", "second"); err != nil || secret != "first" {
+		t.Errorf("Secret() = %q, %v, want the saved secret", secret, err)
+	}
+	if secret, err := s.Secret(ctx, "other", "second"); err != nil || secret != "second" {
+		t.Errorf("Secret() of another name = %q, %v", secret, err)
+	}
+}
+
+func TestDeleteExpiredCertificates(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t)
+
+	expired := testCert(1, "expired.example.com")
+	valid := testCert(2, "valid.example.com")
+	valid.NotAfter = time.Now().Add(24 * time.Hour).UTC().Format("2006-01-02 15:04:05")
+	saveTestCert(t, s, expired)
+	saveTestCert(t, s, valid)
+
+	if err := s.DeleteExpiredCertificates(ctx); err != nil {
+		t.Fatal(err)
+	}
+	certs, err := s.SearchCertificates(ctx, CertificateQuery{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 1 || certs[0].CN != "valid.example.com" {
+		t.Errorf("certificates left %+v, want valid.example.com", certs)
+	}
+}
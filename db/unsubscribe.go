@@ -0,0 +1,196 @@
+package sqldb
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"ctlog/match"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// Path of the one-click unsubscribe links, relative to the public URL of the service
+const UnsubscribePath = "/unsubscribe/one-click"
+
+// Name of the secret unsubscribe tokens are signed by
+const unsubscribeSecret = "unsubscribe"
+
+// Monitor line of the tokens which unsubscribe an email from all of its monitors
+const allMonitors = "*"
+
+// Returned for unsubscribe tokens which are malformed or not signed by the service
+var ErrInvalidToken = errors.New("invalid unsubscribe token")
+
+// Signs and checks the unsubscribe tokens of monitors. A token names an email and some of its monitors,
+// or all of them, and is signed by a secret kept in the store, so tokens never expire and need not be stored,
+// and processes sharing the store accept each other's tokens.
+type Unsubscriber struct {
+	key []byte
+	// Public URL of the service the links point to, no links are made without one
+	url string
+}
+
+// Loads the signing key from the store, a new one is generated the first time.
+// baseURL is the public URL of the service, empty if the links are not to be sent out.
+func NewUnsubscriber(ctx context.Context, s Store, baseURL string) (*Unsubscriber, error) {
+	candidate := make([]byte, tokenBytes)
+	if _, err := rand.Read(candidate); err != nil {
+		return nil, err
+	}
+	secret, err := s.Secret(ctx, unsubscribeSecret, hex.EncodeToString(candidate))
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(secret)
+	if err != nil {
+		return nil, err
+	}
+	return &Unsubscriber{key: key, url: strings.TrimRight(baseURL, "/")}, nil
+}
+
+func (u *Unsubscriber) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, u.key)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// Returns the token which unsubscribes the email from the monitors.
+// The payload is the email and a line with the kind and value of each monitor.
+func (u *Unsubscriber) Token(email string, monitors []Monitor) string {
+	lines := []string{email}
+	for _, m := range monitors {
+		lines = append(lines, monitorLine(m))
+	}
+	return u.token(lines)
+}
+
+// Returns the kind and value of the monitor as a line, the form monitors are named by in tokens and notifications
+func monitorLine(m Monitor) string {
+	return string(m.Kind) + " " + m.Value
+}
+
+// Returns the monitor of the email named by a line of monitorLine, reports whether the line is valid
+func parseMonitorLine(email string, line string) (Monitor, bool) {
+	k, value, ok := strings.Cut(line, " ")
+	kind, err := match.ParseKind(k)
+	if !ok || err != nil {
+		return Monitor{}, false
+	}
+	display := value
+	if _, d, err := parseMonitorValue(kind, value); err == nil {
+		display = d
+	}
+	return Monitor{Email: email, Kind: kind, Value: value, Display: display}, true
+}
+
+// Returns the token which unsubscribes the email from all of its monitors, also the ones added after it was made.
+// The payload is the email and a line with *.
+func (u *Unsubscriber) AllToken(email string) string {
+	return u.token([]string{email, allMonitors})
+}
+
+func (u *Unsubscriber) token(lines []string) string {
+	payload := []byte(strings.Join(lines, "\n"))
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(u.sign(payload))
+}
+
+// Returns the one-click link which unsubscribes the email from the monitors, empty without a public URL.
+func (u *Unsubscriber) Link(email string, monitors []Monitor) string {
+	if !u.sendsLinks() || len(monitors) == 0 {
+		return ""
+	}
+	return u.link(u.Token(email, monitors))
+}
+
+// Returns the one-click link which unsubscribes the email from all of its monitors, empty without a public URL.
+func (u *Unsubscriber) AllLink(email string) string {
+	if !u.sendsLinks() {
+		return ""
+	}
+	return u.link(u.AllToken(email))
+}
+
+// Links are only made with a public URL
+func (u *Unsubscriber) sendsLinks() bool {
+	return u != nil && u.url != ""
+}
+
+func (u *Unsubscriber) link(token string) string {
+	link, err := tokenLink(u.url+UnsubscribePath, "token", token)
+	if err != nil {
+		return ""
+	}
+	return link
+}
+
+// Returns the email and the monitors of a token signed by the service,
+// for a token of all monitors the ones the email has in the store.
+func (u *Unsubscriber) Monitors(ctx context.Context, token string, s Store) (string, []Monitor, error) {
+	email, monitors, all, err := u.parse(token)
+	if err != nil || !all {
+		return email, monitors, err
+	}
+	monitors, err = s.MonitorsOf(ctx, email)
+	return email, monitors, err
+}
+
+// Returns the email and the monitors of a token signed by the service, or whether it names all monitors.
+func (u *Unsubscriber) parse(token string) (string, []Monitor, bool, error) {
+	if u == nil {
+		return "", nil, false, ErrInvalidToken
+	}
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", nil, false, ErrInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", nil, false, ErrInvalidToken
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, u.sign(payload)) {
+		return "", nil, false, ErrInvalidToken
+	}
+
+	lines := strings.Split(string(payload), "\n")
+	email := lines[0]
+	if len(lines) == 2 && lines[1] == allMonitors {
+		return email, nil, true, nil
+	}
+	var monitors []Monitor
+	for _, line := range lines[1:] {
+		m, ok := parseMonitorLine(email, line)
+		if !ok {
+			return "", nil, false, ErrInvalidToken
+		}
+		monitors = append(monitors, m)
+	}
+	if len(monitors) == 0 {
+		return "", nil, false, ErrInvalidToken
+	}
+	return email, monitors, false, nil
+}
+
+// Removes the monitors of the unsubscribe token and returns the email they belonged to and the ones removed,
+// monitors removed before are skipped. Tokens which the service did not sign give ErrInvalidToken.
+func Unsubscribe(ctx context.Context, token string, u *Unsubscriber, s Store) (string, []Monitor, error) {
+	email, monitors, err := u.Monitors(ctx, token, s)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var removed []Monitor
+	for _, m := range monitors {
+		found, err := s.DeleteMonitor(ctx, email, m.Kind, m.Value)
+		if err != nil {
+			return email, removed, err
+		}
+		if found {
+			removed = append(removed, m)
+		}
+	}
+	return email, removed, nil
+}
@@ -0,0 +1,123 @@
+package sqldb
+
+import (
+	"context"
+	"ctlog/match"
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// Returns the token of an unsubscribe link
+func linkToken(t *testing.T, link string) string {
+	t.Helper()
+	u, err := url.Parse(link)
+	if err != nil || !strings.HasPrefix(link, "https://ctlog.example"+UnsubscribePath+"?") {
+		t.Fatalf("link %q, %v", link, err)
+	}
+	return u.Query().Get("token")
+}
+
+func TestUnsubscribe(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t)
+	u, err := NewUnsubscriber(ctx, s, "https://ctlog.example/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := AddMonitor(ctx, "a@example.com", match.KindDomain, []string{"one.example", "two.example"}, match.DefaultMode, match.Off, s); err != nil {
+		t.Fatal(err)
+	}
+
+	monitors, err := s.MonitorsOf(ctx, "a@example.com")
+	if err != nil || len(monitors) != 2 {
+		t.Fatalf("MonitorsOf() = %v, %v", monitors, err)
+	}
+	email, removed, err := Unsubscribe(ctx, linkToken(t, u.Link("a@example.com", monitors[:1])), u, s)
+	if err != nil || email != "a@example.com" || len(removed) != 1 || removed[0].Value != monitors[0].Value {
+		t.Fatalf("Unsubscribe() = %q, %v, %v, want %s", email, removed, err, monitors[0].Value)
+	}
+	// Used again, nothing is left to remove
+	if _, removed, err := Unsubscribe(ctx, linkToken(t, u.Link("a@example.com", monitors[:1])), u, s); err != nil || len(removed) != 0 {
+		t.Errorf("Unsubscribe() again = %v, %v", removed, err)
+	}
+}
+
+func TestUnsubscribeAll(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t)
+	u, err := NewUnsubscriber(ctx, s, "https://ctlog.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := linkToken(t, u.AllLink("a@example.com"))
+
+	// Monitors added after the token was made are covered too, other emails are not
+	if err := AddMonitor(ctx, "a@example.com", match.KindDomain, []string{"one.example", "two.example"}, match.DefaultMode, match.Off, s); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddMonitor(ctx, "a@example.com", match.KindOrganization, []string{"Example Org"}, match.DefaultMode, match.Off, s); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddMonitor(ctx, "b@example.com", match.KindDomain, []string{"one.example"}, match.DefaultMode, match.Off, s); err != nil {
+		t.Fatal(err)
+	}
+
+	email, monitors, err := u.Monitors(ctx, token, s)
+	if err != nil || email != "a@example.com" || len(monitors) != 3 {
+		t.Fatalf("Monitors() = %q, %v, %v, want the 3 monitors of a@example.com", email, monitors, err)
+	}
+	if _, removed, err := Unsubscribe(ctx, token, u, s); err != nil || len(removed) != 3 {
+		t.Fatalf("Unsubscribe() = %v, %v, want 3 monitors removed", removed, err)
+	}
+	if left, err := s.MonitorsOf(ctx, "a@example.com"); err != nil || len(left) != 0 {
+		t.Errorf("monitors left %v, %v", left, err)
+	}
+	if left, err := s.MonitorsOf(ctx, "b@example.com"); err != nil || len(left) != 1 {
+		t.Errorf("monitors of another email %v, %v, want 1", left, err)
+	}
+}
+
+func TestUnsubscribeInvalidToken(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t)
+	u, err := NewUnsubscriber(ctx, s, "https://ctlog.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	monitors := []Monitor{{Email: "a@example.com", Kind: match.KindDomain, Value: "one.example"}}
+	token := u.Token("a@example.com", monitors)
+	other := u.Token("b@example.com", monitors)
+	payload, _, _ := strings.Cut(other, ".")
+	_, signature, _ := strings.Cut(token, ".")
+
+	for _, bad := range []string{"", "nodot", token + "x", payload + "." + signature, "*." + signature} {
+		if _, _, err := Unsubscribe(ctx, bad, u, s); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("Unsubscribe(%q) = %v, want %v", bad, err, ErrInvalidToken)
+		}
+	}
+
+	// Another store signs with another key
+	foreign, err := NewUnsubscriber(ctx, newTestStore(t), "https://ctlog.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Unsubscribe(ctx, foreign.AllToken("a@example.com"), u, s); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Unsubscribe() of a foreign token = %v, want %v", err, ErrInvalidToken)
+	}
+}
+
+func TestUnsubscribeLinksNeedPublicURL(t *testing.T) {
+	u, err := NewUnsubscriber(context.Background(), newTestStore(t), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link := u.AllLink("a@example.com"); link != "" {
+		t.Errorf("AllLink() without a public URL = %q", link)
+	}
+	var none *Unsubscriber
+	if link := none.Link("a@example.com", []Monitor{{Kind: match.KindDomain, Value: "one.example"}}); link != "" {
+		t.Errorf("Link() of no unsubscriber = %q", link)
+	}
+}
@@ -0,0 +1,141 @@
+// Package lint checks certificates for common mistakes and Baseline Requirements violations.
+//
+// Findings are strings of the form "code: description", where code is one of
+//
+//	weak-key             - RSA key shorter than 2048 bits or an elliptic curve weaker than P-256
+//	weak-signature       - MD2, MD5 or SHA-1 signature algorithm
+//	validity-too-long    - validity period over the CA/Browser Forum limit in force at NotBefore, counted like
+//	                       the Baseline Requirements do, from NotBefore to NotAfter inclusive
+//	missing-san          - no DNS or IP SAN
+//	cn-not-in-san        - the CN is none of the SANs
+//	invalid-wildcard     - a wildcard which is not the whole leftmost label, or one directly under a public suffix
+package lint
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/google/certificate-transparency-go/x509"
+	"golang.org/x/net/publicsuffix"
+)
+
+// Maximum validity periods of the CA/Browser Forum Baseline Requirements, by the date they apply from,
+// the steps from 2026 on are those of ballot SC-081
+var validityLimits = []struct {
+	from time.Time
+	days int
+}{
+	{time.Date(2029, time.March, 15, 0, 0, 0, 0, time.UTC), 47},
+	{time.Date(2027, time.March, 15, 0, 0, 0, 0, time.UTC), 100},
+	{time.Date(2026, time.March, 15, 0, 0, 0, 0, time.UTC), 200},
+	{time.Date(2020, time.September, 1, 0, 0, 0, 0, time.UTC), 398},
+	{time.Date(2018, time.March, 1, 0, 0, 0, 0, time.UTC), 825},
+	{time.Date(2015, time.April, 1, 0, 0, 0, 0, time.UTC), 39 * 31},
+}
+
+const minRSABits = 2048
+const minCurveBits = 256
+
+func finding(code string, format string, args ...interface{}) string {
+	return code + ": " + fmt.Sprintf(format, args...)
+}
+
+// Returns the findings for a leaf certificate or precertificate, CA certificates are not checked.
+func Check(cert *x509.Certificate) []string {
+	if cert.IsCA {
+		return nil
+	}
+
+	var findings []string
+	findings = append(findings, checkKey(cert)...)
+	findings = append(findings, checkSignature(cert)...)
+	findings = append(findings, checkValidity(cert)...)
+	findings = append(findings, checkNames(cert)...)
+	return findings
+}
+
+func checkKey(cert *x509.Certificate) []string {
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if bits := key.N.BitLen(); bits < minRSABits {
+			return []string{finding("weak-key", "RSA key has %d bits", bits)}
+		}
+	case *ecdsa.PublicKey:
+		if bits := key.Curve.Params().BitSize; bits < minCurveBits {
+			return []string{finding("weak-key", "ECDSA key on %s", key.Curve.Params().Name)}
+		}
+	}
+	return nil
+}
+
+func checkSignature(cert *x509.Certificate) []string {
+	switch cert.SignatureAlgorithm {
+	case x509.MD2WithRSA, x509.MD5WithRSA, x509.SHA1WithRSA, x509.DSAWithSHA1, x509.ECDSAWithSHA1:
+		return []string{finding("weak-signature", "signed with %s", cert.SignatureAlgorithm)}
+	}
+	return nil
+}
+
+// The validity period includes the second of NotAfter, so a certificate of 398 days has NotAfter
+// one second less than 398 days after NotBefore
+func checkValidity(cert *x509.Certificate) []string {
+	const day = 24 * time.Hour
+	validity := cert.NotAfter.Sub(cert.NotBefore) + time.Second
+	for _, l := range validityLimits {
+		if !cert.NotBefore.Before(l.from) {
+			if validity > time.Duration(l.days)*day {
+				// Started days count whole
+				days := (validity + day - 1) / day
+				return []string{finding("validity-too-long", "valid for %d days, at most %d allowed", days, l.days)}
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+func checkNames(cert *x509.Certificate) []string {
+	var findings []string
+
+	if len(cert.DNSNames) == 0 && len(cert.IPAddresses) == 0 {
+		findings = append(findings, finding("missing-san", "no DNS or IP subject alternative names"))
+	} else if cn := cert.Subject.CommonName; cn != "" && !inSAN(cert, cn) {
+		findings = append(findings, finding("cn-not-in-san", "CN %s is not a subject alternative name", cn))
+	}
+
+	for _, name := range cert.DNSNames {
+		if !strings.Contains(name, "*") {
+			continue
+		}
+
+		base := strings.TrimPrefix(name, "*.")
+		if strings.Contains(base, "*") || base == name {
+			findings = append(findings, finding("invalid-wildcard", "%s has a wildcard outside of the leftmost label", name))
+		} else if suffix, _ := publicsuffix.PublicSuffix(base); suffix == base {
+			findings = append(findings, finding("invalid-wildcard", "%s covers a whole public suffix", name))
+		}
+	}
+
+	return findings
+}
+
+// Reports whether the CN is one of the DNS or IP SANs.
+func inSAN(cert *x509.Certificate, cn string) bool {
+	for _, name := range cert.DNSNames {
+		if strings.EqualFold(strings.TrimSuffix(name, "."), strings.TrimSuffix(cn, ".")) {
+			return true
+		}
+	}
+	if ip := net.ParseIP(cn); ip != nil {
+		for _, a := range cert.IPAddresses {
+			if a.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
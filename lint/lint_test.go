@@ -0,0 +1,128 @@
+package lint
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"math/big"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/certificate-transparency-go/x509"
+	"github.com/google/certificate-transparency-go/x509/pkix"
+)
+
+func TestCheckValidity(t *testing.T) {
+	const day = 24 * time.Hour
+	date := func(year int, month time.Month, d int) time.Time {
+		return time.Date(year, month, d, 12, 0, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		notBefore time.Time
+		validity  time.Duration
+		want      bool
+	}{
+		// NotAfter is included, 398 days end one second before NotBefore + 398 days
+		{date(2024, time.June, 1), 398*day - time.Second, false},
+		{date(2024, time.June, 1), 398 * day, true},
+		{date(2024, time.June, 1), 398*day + time.Second, true},
+		{date(2019, time.June, 1), 825*day - time.Second, false},
+		{date(2019, time.June, 1), 825 * day, true},
+		{date(2016, time.June, 1), 39*31*day - time.Second, false},
+		{date(2016, time.June, 1), 39 * 31 * day, true},
+		{date(2014, time.June, 1), 2000 * day, false},
+
+		// SC-081
+		{date(2026, time.March, 14), 398*day - time.Second, false},
+		{date(2026, time.March, 15), 200*day - time.Second, false},
+		{date(2026, time.March, 15), 200 * day, true},
+		{date(2027, time.March, 15), 100*day - time.Second, false},
+		{date(2027, time.March, 15), 100 * day, true},
+		{date(2029, time.March, 15), 47*day - time.Second, false},
+		{date(2029, time.March, 15), 47 * day, true},
+	}
+
+	for _, tt := range tests {
+		cert := &x509.Certificate{NotBefore: tt.notBefore, NotAfter: tt.notBefore.Add(tt.validity)}
+		findings := checkValidity(cert)
+		if got := len(findings) > 0; got != tt.want {
+			t.Errorf("checkValidity(%s + %s) = %v, want a finding %v", tt.notBefore.Format(time.DateOnly), tt.validity, findings, tt.want)
+		}
+	}
+}
+
+func TestCheckValidityDays(t *testing.T) {
+	notBefore := time.Date(2024, time.June, 1, 0, 0, 0, 0, time.UTC)
+	cert := &x509.Certificate{NotBefore: notBefore, NotAfter: notBefore.Add(398 * 24 * time.Hour)}
+	findings := checkValidity(cert)
+	if len(findings) != 1 || !strings.Contains(findings[0], "valid for 399 days, at most 398") {
+		t.Errorf("checkValidity() = %v, want 399 started days", findings)
+	}
+}
+
+// Returns the codes of the findings
+func codes(findings []string) []string {
+	var codes []string
+	for _, f := range findings {
+		code, _, _ := strings.Cut(f, ":")
+		codes = append(codes, code)
+	}
+	return codes
+}
+
+func TestCheck(t *testing.T) {
+	bits := func(n int) *rsa.PublicKey {
+		return &rsa.PublicKey{N: new(big.Int).Lsh(big.NewInt(1), uint(n-1)), E: 65537}
+	}
+
+	tests := []struct {
+		name   string
+		modify func(cert *x509.Certificate)
+		code   string
+		want   bool
+	}{
+		{"1024-bit RSA key", func(c *x509.Certificate) { c.PublicKey = bits(1024) }, "weak-key", true},
+		{"2048-bit RSA key", func(c *x509.Certificate) { c.PublicKey = bits(2048) }, "weak-key", false},
+		{"P-224 key", func(c *x509.Certificate) { c.PublicKey = &ecdsa.PublicKey{Curve: elliptic.P224()} }, "weak-key", true},
+		{"P-256 key", func(c *x509.Certificate) { c.PublicKey = &ecdsa.PublicKey{Curve: elliptic.P256()} }, "weak-key", false},
+
+		{"SHA-1 signature", func(c *x509.Certificate) { c.SignatureAlgorithm = x509.SHA1WithRSA }, "weak-signature", true},
+		{"SHA-256 signature", func(c *x509.Certificate) { c.SignatureAlgorithm = x509.SHA256WithRSA }, "weak-signature", false},
+
+		{"no SANs", func(c *x509.Certificate) { c.DNSNames = nil }, "missing-san", true},
+		{"only an IP SAN", func(c *x509.Certificate) {
+			c.DNSNames = nil
+			c.Subject.CommonName = "192.0.2.1"
+			c.IPAddresses = []net.IP{net.ParseIP("192.0.2.1")}
+		}, "missing-san", false},
+
+		{"CN not in SANs", func(c *x509.Certificate) { c.Subject.CommonName = "mail.example.com" }, "cn-not-in-san", true},
+		{"CN in SANs of another case", func(c *x509.Certificate) { c.Subject.CommonName = "WWW.example.com." }, "cn-not-in-san", false},
+
+		{"wildcard inside a label", func(c *x509.Certificate) { c.DNSNames = append(c.DNSNames, "w*.example.com") }, "invalid-wildcard", true},
+		{"wildcard of a public suffix", func(c *x509.Certificate) { c.DNSNames = append(c.DNSNames, "*.co.uk") }, "invalid-wildcard", true},
+		{"wildcard of a domain", func(c *x509.Certificate) { c.DNSNames = append(c.DNSNames, "*.example.com") }, "invalid-wildcard", false},
+	}
+
+	for _, tt := range tests {
+		notBefore := time.Date(2025, time.June, 1, 0, 0, 0, 0, time.UTC)
+		cert := &x509.Certificate{
+			Subject:            pkix.Name{CommonName: "www.example.com"},
+			DNSNames:           []string{"www.example.com"},
+			NotBefore:          notBefore,
+			NotAfter:           notBefore.Add(90 * 24 * time.Hour),
+			PublicKey:          bits(2048),
+			SignatureAlgorithm: x509.SHA256WithRSA,
+		}
+		tt.modify(cert)
+
+		findings := Check(cert)
+		if got := slices.Contains(codes(findings), tt.code); got != tt.want {
+			t.Errorf("Check() of %s = %v, want %s %v", tt.name, findings, tt.code, tt.want)
+		}
+	}
+}
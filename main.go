@@ -1,39 +1,49 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
 	ct "ctlog/ct"
 	sqldb "ctlog/db"
-	"database/sql"
+	"ctlog/lint"
+	"ctlog/match"
 	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
 	ct_tls "github.com/google/certificate-transparency-go/tls"
 	"github.com/google/certificate-transparency-go/x509"
-	"log"
+	"log/slog"
+	"net"
 	"os"
-	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync/atomic"
+	"text/tabwriter"
 	"time"
-
-	"golang.org/x/net/publicsuffix"
 )
 
-// MatchIPv6 is a regular expression for validating IPv6 addresses
-var MatchIPv6 = regexp.MustCompile(`^((([0-9A-Fa-f]{1,4}:){7}([0-9A-Fa-f]{1,4}|:))|(([0-9A-Fa-f]{1,4}:){6}(:[0-9A-Fa-f]{1,4}|((25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)(\.(25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)){3})|:))|(([0-9A-Fa-f]{1,4}:){5}(((:[0-9A-Fa-f]{1,4}){1,2})|:((25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)(\.(25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)){3})|:))|(([0-9A-Fa-f]{1,4}:){4}(((:[0-9A-Fa-f]{1,4}){1,3})|((:[0-9A-Fa-f]{1,4})?:((25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)(\.(25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)){3}))|:))|(([0-9A-Fa-f]{1,4}:){3}(((:[0-9A-Fa-f]{1,4}){1,4})|((:[0-9A-Fa-f]{1,4}){0,2}:((25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)(\.(25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)){3}))|:))|(([0-9A-Fa-f]{1,4}:){2}(((:[0-9A-Fa-f]{1,4}){1,5})|((:[0-9A-Fa-f]{1,4}){0,3}:((25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)(\.(25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)){3}))|:))|(([0-9A-Fa-f]{1,4}:){1}(((:[0-9A-Fa-f]{1,4}){1,6})|((:[0-9A-Fa-f]{1,4}){0,4}:((25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)(\.(25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)){3}))|:))|(:(((:[0-9A-Fa-f]{1,4}){1,7})|((:[0-9A-Fa-f]{1,4}){0,5}:((25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)(\.(25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)){3}))|:)))(%.+)?$`)
-
-// MatchIPv4 is a regular expression for validating IPv4 addresses
-var MatchIPv4 = regexp.MustCompile(`^(?:(?:25[0-5]|2[0-4][0-9]|[0-1]?[0-9]{1,2})[.](?:25[0-5]|2[0-4][0-9]|[0-1]?[0-9]{1,2})[.](?:25[0-5]|2[0-4][0-9]|[0-1]?[0-9]{1,2})[.](?:25[0-5]|2[0-4][0-9]|[0-1]?[0-9]{1,2}))$`)
-
-var outputCount int64 = 0
-var inputCount int64 = 0
-var startTime time.Time
-
 const INSERT_BUFFER_SIZE = 10000
 const DOWNLOADER_COUNT = 120
 const PARSE_BUFFER_SIZE = 1000
 const PARSER_COUNT = 4
+const INSERTER_COUNT = 4
+
+// Matched certificates are saved once this many are kept by the matcher
+const MATCH_BATCH_SIZE = 1000
+
+const HISTORY_LENGTH = 30
+
+// Maximum merge delay of logs added without one, in seconds, the most common MMD of 24 hours
+const DEFAULT_MMD = 86400
+
+// A running run records a heartbeat this often, runs without one for RUN_STALE_AFTER were left by a dead process
+const RUN_HEARTBEAT_INTERVAL = time.Minute
+const RUN_STALE_AFTER = 5 * time.Minute
+
+// Finished runs are kept in the history this long, the watch mode records a run every few minutes
+const RUN_RETENTION = 30 * 24 * time.Hour
 
 func usage() {
 	fmt.Println("Usage: " + os.Args[0] + " [options]")
@@ -45,129 +55,225 @@ func usage() {
 }
 
 // For testing purposes, updates the log head index, reducing the amount of data to the minimum
-func updateHeads(logInfoMap *map[string]sqldb.CTLogInfo, db *sql.DB) {
+func updateHeads(ctx context.Context, logInfoMap *map[string]sqldb.CTLogInfo, store sqldb.Store) {
 	for url, logInfo := range *logInfoMap {
-		if _, err := db.Exec("UPDATE CTLog SET HeadIndex = $1 WHERE Url = $2", logInfo.NewHeadIndex, url); err != nil {
-			log.Printf("[-] Failed updating head -> %s\n", err)
+		if err := store.SetHead(ctx, url, logInfo.NewHeadIndex); err != nil {
+			slog.Error("Failed updating head", "log_url", url, "err", err)
 		}
 	}
 }
 
 // Downloads the new STHs from the logs, returns a map of log url -> old and new index
-func downloadHeads(db *sql.DB) (*map[string]sqldb.CTLogInfo, error) {
+func downloadHeads(ctx context.Context, store sqldb.Store) (*map[string]sqldb.CTLogInfo, error) {
 	resultMap := make(map[string]sqldb.CTLogInfo)
-	rows, err := db.Query("SELECT Url, HeadIndex FROM CTLog")
+	logs, err := store.Logs(ctx)
 	if err != nil {
-		log.Fatal("[-] Failed to query logurls from database -> ", err, "\n")
+		return nil, err
 	}
-	for rows.Next() {
-		var url string
-		var headIndex int64
-		err = rows.Scan(&url, &headIndex)
+	for _, l := range logs {
+		sth, err := DownloadSTH(ctx, l.Url)
 		if err != nil {
 			return nil, err
 		}
+		resultMap[l.Url] = sqldb.CTLogInfo{OldHeadIndex: l.HeadIndex, NewHeadIndex: sth.TreeSize - 1}
+	}
 
-		sth, err := DownloadSTH(url)
-		if err != nil {
-			return nil, err
+	return &resultMap, nil
+}
+
+// Removes items from the inserter channel and inserts them into the database together with their names
+// in batches of INSERT_BUFFER_SIZE, several inserters run at once
+// Duplicates from multiple logs get ignored
+func (p *Pipeline) inserter() error {
+	ctx := p.workerCtx
+	ins, err := p.store.NewInserter(ctx)
+	if err != nil {
+		return fmt.Errorf("preparing inserter -> %w", err)
+	}
+	defer ins.Close()
+
+	batch := make([]sqldb.CertInfo, 0, INSERT_BUFFER_SIZE)
+	flush := func() error {
+		insertStart := time.Now()
+		n, err := ins.Insert(ctx, batch)
+		metricInsertDuration.Observe(time.Since(insertStart).Seconds())
+		batch = batch[:0]
+
+		inserted := atomic.AddInt64(&p.inserted, int64(n))
+		if inserted/1000000 != (inserted-int64(n))/1000000 {
+			p.logger.Debug("Inserted certificates", "millions", inserted/1000000, "elapsed", time.Since(p.started))
 		}
-		resultMap[url] = sqldb.CTLogInfo{headIndex, sth.TreeSize - 1}
+		return err
 	}
 
-	return &resultMap, err
+	for name := range p.insert {
+		batch = append(batch, name)
+		if len(batch) == INSERT_BUFFER_SIZE {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if len(batch) > 0 {
+		return flush()
+	}
+	return nil
 }
 
-// Removes items from the inserter channel and inserts them into the database
-// Duplicates from multiple logs get ignored
-func inserter(o <-chan sqldb.CertInfo, db *sql.DB) {
-	q, _ := db.Prepare("INSERT INTO Downloaded VALUES ($1, $2, $3, $4, $5, $6, $7, $8) ON CONFLICT DO NOTHING ")
-	defer q.Close()
-	count := 0
-	for name := range o {
-		_, err := q.Exec(name.CN, name.DN, name.SerialNumber, name.SAN, name.NotBefore, name.NotAfter, name.Issuer, name.Raw)
-		if err != nil {
-			log.Printf("Failed saving cert with CN: %s\nDN: %s\nDNS: %s\nSerialNumber: %s\n-> %s", name.CN, name.DN, name.SAN, name.SerialNumber, err)
+// An entry which could not be parsed, Type is the kind of the failure
+type parseError struct {
+	Type string
+	Err  error
+}
+
+func (e parseError) Error() string {
+	return e.Err.Error()
+}
+
+func (e parseError) Unwrap() error {
+	return e.Err
+}
+
+// Returns the Type of the parseError in the chain of err, unknown for other errors
+func parseErrorType(err error) string {
+	var pe parseError
+	if errors.As(err, &pe) {
+		return pe.Type
+	}
+	return "unknown"
+}
+
+// Parses the Merkle tree leaf of the entry into a certificate. Certificates with non-fatal x509 errors,
+// malformed fields the parser could skip, are returned with the errors as findings of the code malformed.
+// Errors are parseErrors
+func parseEntry(e CTEntry) (*x509.Certificate, []string, error) {
+	var leaf ct.MerkleTreeLeaf
+
+	if rest, err := ct_tls.Unmarshal(e.LeafInput, &leaf); err != nil {
+		return nil, nil, parseError{"unmarshal", fmt.Errorf("failed to unmarshal MerkleTreeLeaf: %v", err)}
+	} else if len(rest) > 0 {
+		return nil, nil, parseError{"trailing-data", fmt.Errorf("trailing data (%d bytes) after MerkleTreeLeaf", len(rest))}
+	}
+
+	var cert *x509.Certificate
+	var err error
+	var kind string
+
+	switch leaf.TimestampedEntry.EntryType {
+	case ct.X509LogEntryType:
+		kind = "certificate"
+		cert, err = x509.ParseCertificate(leaf.TimestampedEntry.X509Entry.Data)
+		if x509.IsFatal(err) {
+			return nil, nil, parseError{kind, fmt.Errorf("failed to parse cert: %v", err)}
 		}
-		atomic.AddInt64(&outputCount, 1)
 
-		count++
-		if count%1000000 == 0 {
-			end := time.Now()
-			println("O", end.Sub(startTime).String(), count/1000000)
+	case ct.PrecertLogEntryType:
+		kind = "precertificate"
+		cert, err = x509.ParseTBSCertificate(leaf.TimestampedEntry.PrecertEntry.TBSCertificate)
+		if x509.IsFatal(err) {
+			return nil, nil, parseError{kind, fmt.Errorf("failed to parse precert: %v", err)}
 		}
+
+	default:
+		return nil, nil, parseError{"unknown-entry-type", fmt.Errorf("unknown entry type: %v", leaf.TimestampedEntry.EntryType)}
 	}
 
-	log.Printf("TOTAL INSERTED %d\n", count)
-	Wo.Done()
+	var nonFatal x509.NonFatalErrors
+	if !errors.As(err, &nonFatal) {
+		return cert, nil, nil
+	}
+	metricNonFatalParseErrors.WithLabelValues(kind).Inc()
+	findings := make([]string, 0, len(nonFatal.Errors))
+	for _, e := range nonFatal.Errors {
+		findings = append(findings, "malformed: "+e.Error())
+	}
+	return cert, findings, nil
 }
 
-// Takes out and parses Merkle tree leaf into a certificate info struct
-// Sends the result into the database inserter
-func parser(c <-chan CTEntry, o chan<- sqldb.CertInfo, db *sql.DB) {
-	defer Wp.Done()
+// Takes out and parses Merkle tree leaf into a certificate info struct and matches it against the monitors
+// Entries which can not be parsed are quarantined and counted in the stats of their log, if there are any
+// If the downloaded certificates are kept, sends the result into the database inserter, stops if the inserter fails
+func (p *Pipeline) parser() error {
+	ctx := p.workerCtx
 	sum := 0.0
 	sumExtra := 0.0
 	cnt := 0
 
-	for e := range c {
-		var leaf ct.MerkleTreeLeaf
-
-		if rest, err := ct_tls.Unmarshal(e.LeafInput, &leaf); err != nil {
-			log.Printf("[-] Failed to unmarshal MerkleTreeLeaf: %v (%v)", err, e)
-			continue
-		} else if len(rest) > 0 {
-			log.Printf("[-] Trailing data (%d bytes) after MerkleTreeLeaf: %q", len(rest), rest)
+	for e := range p.parse {
+		cert, malformed, err := parseEntry(e)
+		if err != nil {
+			errType := parseErrorType(err)
+			metricParseErrors.WithLabelValues(errType).Inc()
+			p.logger.Warn("Quarantining entry", "log_url", e.LogUrl, "index", e.Index, "type", errType, "err", err)
+			err = p.store.QuarantineEntry(ctx, sqldb.QuarantinedEntry{
+				LogUrl:    e.LogUrl,
+				Index:     e.Index,
+				LeafInput: e.LeafInput,
+				ExtraData: e.ExtraData,
+				Error:     err.Error(),
+			})
+			if err != nil {
+				p.logger.Error("Failed quarantining entry", "log_url", e.LogUrl, "index", e.Index, "err", err)
+			}
+			if st := p.logs[e.LogUrl]; st != nil {
+				atomic.AddInt64(&st.parseFailures, 1)
+			}
 			continue
 		}
 
-		var cert *x509.Certificate
-		var err error
-
-		switch leaf.TimestampedEntry.EntryType {
-		case ct.X509LogEntryType:
-			cert, err = x509.ParseCertificate(leaf.TimestampedEntry.X509Entry.Data)
-			if err != nil && !strings.Contains(err.Error(), "NonFatalErrors:") {
-				log.Printf("[-] Failed to parse cert: %s\n", err.Error())
-				continue
-			}
+		// The entry stays quarantined until its matches are saved
+		if e.Quarantined {
+			p.mu.Lock()
+			p.released = append(p.released, sqldb.QuarantinedEntry{LogUrl: e.LogUrl, Index: e.Index})
+			p.mu.Unlock()
+		}
 
-		case ct.PrecertLogEntryType:
-			cert, err = x509.ParseTBSCertificate(leaf.TimestampedEntry.PrecertEntry.TBSCertificate)
-			if err != nil && !strings.Contains(err.Error(), "NonFatalErrors:") {
-				log.Printf("[-] Failed to parse precert: %s\n", err.Error())
-				continue
-			}
+		// Certificates whose CN is not a hostname are kept, the CN is just not matched as a name.
+		// An IP address in the CN goes with the IP SANs.
+		ips := make([]string, 0, len(cert.IPAddresses))
+		for _, ip := range cert.IPAddresses {
+			ips = append(ips, ip.String())
+		}
+		if ip := net.ParseIP(strings.TrimSpace(cert.Subject.CommonName)); ip != nil {
+			ips = append(ips, ip.String())
+		}
 
-		default:
-			log.Printf("[-] Unknown entry type: %v (%v)", leaf.TimestampedEntry.EntryType, e)
-			continue
+		uris := make([]string, 0, len(cert.URIs))
+		for _, u := range cert.URIs {
+			uris = append(uris, u.String())
 		}
 
-		if _, err := publicsuffix.EffectiveTLDPlusOne(cert.Subject.CommonName); err == nil {
-			// Make sure this looks like an actual hostname or IP address
-			if !(MatchIPv4.Match([]byte(cert.Subject.CommonName)) ||
-				MatchIPv6.Match([]byte(cert.Subject.CommonName))) &&
-				(strings.Contains(cert.Subject.CommonName, " ") ||
-					strings.Contains(cert.Subject.CommonName, ":") ||
-					strings.TrimSpace(cert.Subject.CommonName) == "") {
-				continue
-			}
+		emails := cert.EmailAddresses
+		if emails == nil {
+			emails = []string{}
 		}
 
 		// Valid input
-		atomic.AddInt64(&inputCount, 1)
+		atomic.AddInt64(&p.parsed, 1)
+
+		// Names are stored in both IDNA forms, a nil slice would be stored as NULL
+		san := make([]string, len(cert.DNSNames))
+		unicodeSAN := make([]string, len(cert.DNSNames))
+		for i, name := range cert.DNSNames {
+			san[i] = match.Normalize(name)
+			unicodeSAN[i] = match.ToUnicode(san[i])
+		}
 
-		san := ""
-		if len(cert.DNSNames) > 0 {
-			san = strings.Join(cert.DNSNames, ",")
-			san += ","
+		organization := make([]string, 0, len(cert.Subject.Organization)+len(cert.Subject.OrganizationalUnit))
+		organization = append(organization, cert.Subject.Organization...)
+		organization = append(organization, cert.Subject.OrganizationalUnit...)
+		spkiHash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		// Malformed fields are reported with the lint findings of any certificate
+		findings := malformed
+		if findings == nil {
+			findings = []string{}
 		}
+		fingerprint := sha256.Sum256(cert.Raw)
 
 		// Statistics
 		size := len(cert.Raw)
 		sizeExtra := size + len(cert.Subject.CommonName) +
-			len(san) +
+			len(strings.Join(san, ",")) +
 			//Not sure about the time
 			len(cert.NotAfter.Format("2006-01-02"))
 
@@ -175,158 +281,535 @@ func parser(c <-chan CTEntry, o chan<- sqldb.CertInfo, db *sql.DB) {
 		sumExtra += float64(sizeExtra) / 1000
 		cnt++
 
-		o <- sqldb.CertInfo{
+		info := sqldb.CertInfo{
 			CN:           cert.Subject.CommonName,
+			UnicodeCN:    match.UnicodeCN(cert.Subject.CommonName),
 			DN:           cert.Subject.String(),
 			SerialNumber: cert.SerialNumber.Text(16),
 			SAN:          san,
+			UnicodeSAN:   unicodeSAN,
 			NotBefore:    cert.NotBefore.Format("2006-01-02 15:04:05"),
 			NotAfter:     cert.NotAfter.Format("2006-01-02 15:04:05"),
 			Issuer:       cert.Issuer.String(),
 			Raw:          hex.EncodeToString(cert.Raw),
+
+			Organization:   organization,
+			AuthorityKeyID: hex.EncodeToString(cert.AuthorityKeyId),
+			SPKIHash:       hex.EncodeToString(spkiHash[:]),
+			Lint:           findings,
+			Fingerprint:    hex.EncodeToString(fingerprint[:]),
+
+			IPAddresses:    ips,
+			EmailAddresses: emails,
+			URIs:           uris,
+		}
+
+		// Only matched certificates are linted, which is too slow for every entry
+		lintFindings := func(c *sqldb.CertInfo) {
+			c.Lint = append(c.Lint, lint.Check(cert)...)
+		}
+		if p.matcher.Match(&info, lintFindings) {
+			atomic.AddInt64(&p.matched, 1)
+			if err := p.matcher.SaveMatches(ctx, p.store, MATCH_BATCH_SIZE); err != nil {
+				return fmt.Errorf("saving matched certificates -> %w", err)
+			}
+		}
+		if !p.keepDownloaded {
+			continue
+		}
+
+		select {
+		case p.insert <- info:
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 	}
 
 	// Sizes are total aka all of the certificates are counted
-	log.Println("Total size (all parsers): ", sum*PARSER_COUNT)
-	log.Println("Total size plus what we want to save: ", sumExtra*PARSER_COUNT)
-	log.Println("Average size: ", sum/float64(cnt))
+	p.logger.Debug("Parsed certificate sizes", "total_kb", sum*PARSER_COUNT, "total_saved_kb", sumExtra*PARSER_COUNT,
+		"average_kb", sum/float64(cnt))
+	return nil
 }
 
-func run(dumpFile bool, db *sql.DB) {
-	var logInfos *map[string]sqldb.CTLogInfo
-	var err error
-
-	logInfos, err = downloadHeads(db)
+// Adds, removes or verifies monitors given on the command line
+func manageMonitors(ctx context.Context, add string, remove string, verify string, kind string, mode string, lookalike string, store sqldb.Store) {
+	k, err := match.ParseKind(kind)
 	if err != nil {
-		// Try to recover
-		sec := 1
-		for err != nil {
-			time.Sleep(time.Duration(sec) * time.Second)
-			logInfos, err = downloadHeads(db)
-			sec += 1
-			if sec == 50 {
-				log.Fatal("[-] Timed out while downloading heads")
-			}
+		fatal("Invalid monitor kind", "err", err)
+	}
+
+	// Organizations and issuer DNs contain spaces, so they are given one per monitor
+	parseArgs := func(arg string) []string {
+		if k == match.KindDomain {
+			return strings.Fields(arg)
 		}
+		return strings.SplitN(strings.TrimSpace(arg), " ", 2)
 	}
 
-	// FOR TESTING PURPOSES
-	//updateHeads(logInfos, db)
+	if add != "" {
+		args := parseArgs(add)
+		if len(args) < 2 {
+			fatal("-add needs an email and at least one value")
+		}
 
-	// Print the amounts to download from each log and then the sum
-	var all int64 = 0
-	for u, i := range *logInfos {
-		all += i.NewHeadIndex - i.OldHeadIndex
-		fmt.Printf("%sct/v1/get-entries?start=%d&end=%d      %d\n", u, i.OldHeadIndex, i.NewHeadIndex, i.NewHeadIndex-i.OldHeadIndex)
+		m, err := match.ParseMode(mode)
+		if err != nil {
+			fatal("Invalid match mode", "err", err)
+		}
+		l, err := match.ParseSensitivity(lookalike)
+		if err != nil {
+			fatal("Invalid lookalike sensitivity", "err", err)
+		}
+
+		if err := sqldb.AddMonitor(ctx, args[0], k, args[1:], m, l, store); err != nil {
+			fatal("Failed adding monitor", "err", err)
+		}
+		slog.Info("Added monitors", "email", args[0], "kind", k, "count", len(args)-1)
+	}
+
+	if remove != "" {
+		args := parseArgs(remove)
+		if len(args) != 2 {
+			fatal("-remove needs an email and a value")
+		}
+
+		if err := sqldb.RemoveMonitor(ctx, args[0], k, args[1], store); err != nil {
+			fatal("Failed removing monitor", "err", err)
+		}
+		slog.Info("Removed monitor", "email", args[0], "kind", k, "value", args[1])
+	}
+
+	if verify != "" {
+		args := parseArgs(verify)
+		if len(args) != 2 {
+			fatal("-verify needs an email and a value")
+		}
+
+		if err := sqldb.OverrideVerification(ctx, args[0], k, args[1], store); err != nil {
+			fatal("Failed verifying monitor", "err", err)
+		}
+		slog.Info("Verified monitor", "email", args[0], "kind", k, "value", args[1])
+	}
+}
+
+// Adds or removes authorized CAs of monitored domains given on the command line
+func manageAuthorizedCAs(ctx context.Context, allow string, remove string, store sqldb.Store) {
+	if allow != "" {
+		args := strings.SplitN(strings.TrimSpace(allow), " ", 3)
+		if len(args) != 3 {
+			fatal("-allow-ca needs an email, a domain and a CA")
+		}
+
+		if err := sqldb.AddAuthorizedCA(ctx, args[0], args[1], args[2], store); err != nil {
+			fatal("Failed authorizing CA", "err", err)
+		}
+		slog.Info("Authorized CA", "email", args[0], "domain", args[1], "ca", args[2])
+	}
+
+	if remove != "" {
+		args := strings.SplitN(strings.TrimSpace(remove), " ", 3)
+		if len(args) != 3 {
+			fatal("-remove-ca needs an email, a domain and a CA")
+		}
+
+		if err := sqldb.RemoveAuthorizedCA(ctx, args[0], args[1], args[2], store); err != nil {
+			fatal("Failed removing authorized CA", "err", err)
+		}
+		slog.Info("Removed authorized CA", "email", args[0], "domain", args[1], "ca", args[2])
+	}
+}
+
+// Adds a log, or sets its MMD, given as "url [mmd]"
+func manageLogs(ctx context.Context, add string, store sqldb.Store) {
+	args := strings.Fields(add)
+	if len(args) < 1 || len(args) > 2 {
+		fatal("-add-log needs a url and optionally an MMD in seconds")
 	}
-	println("TO DOWNLOAD: ", all)
 
-	sqldb.CreateTempLogTable(db)
+	logurl := args[0]
+	if !strings.HasPrefix(logurl, "https://") && !strings.HasPrefix(logurl, "http://") {
+		fatal("-add-log needs the url of a log", "url", logurl)
+	}
+	// Requests are made to the url followed by ct/v1/...
+	if !strings.HasSuffix(logurl, "/") {
+		logurl += "/"
+	}
+
+	mmd := int64(DEFAULT_MMD)
+	if len(args) == 2 {
+		var err error
+		mmd, err = strconv.ParseInt(args[1], 10, 64)
+		if err != nil || mmd <= 0 {
+			fatal("MMD has to be a positive number of seconds", "mmd", args[1])
+		}
+	}
 
-	// Create channels
+	if err := store.SaveLog(ctx, logurl, mmd); err != nil {
+		fatal("Failed saving log", "url", logurl, "err", err)
+	}
+	slog.Info("Saved log", "url", logurl, "mmd", mmd)
+}
 
-	// Parsing
-	c_parse := make(chan CTEntry, PARSE_BUFFER_SIZE)
+// Prints the recent runs, or the logs of a single run
+func showHistory(ctx context.Context, arg string, store sqldb.Store) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	defer w.Flush()
 
-	// Inserting into database
-	c_insert := make(chan sqldb.CertInfo, INSERT_BUFFER_SIZE)
+	if arg == "" {
+		runs, err := store.ListRuns(ctx, HISTORY_LENGTH)
+		if err != nil {
+			fatal("Failed to list runs", "err", err)
+		}
 
-	// Launch parsers
-	for i := 0; i < PARSER_COUNT; i++ {
-		go parser(c_parse, c_insert, db)
+		fmt.Fprintln(w, "ID\tSTARTED\tDURATION\tSTATUS\tDOWNLOADED\tPARSE FAILURES\tINSERTED\tMATCHES\tEMAILS")
+		for _, r := range runs {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%d\t%d\t%d\t%d\t%d\n", r.ID, r.StartedAt.Format("2006-01-02 15:04:05"), r.Duration(),
+				r.Status, r.Downloaded, r.ParseFailures, r.Inserted, r.Matches, r.EmailsSent)
+		}
+		return
 	}
-	Wp.Add(PARSER_COUNT)
 
-	// Launch a database inserter
-	go inserter(c_insert, db)
-	Wo.Add(1)
+	id, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		fatal("Invalid run ID", "run_id", arg)
+	}
+	run, logs, err := store.GetRun(ctx, id)
+	if err != nil {
+		fatal("Failed to load run", "run_id", id, "err", err)
+	}
 
-	// Start timer for download
-	startTime = time.Now()
+	fmt.Fprintf(w, "RUN %d\t%s\tstarted %s\ttook %s\n", run.ID, run.Status, run.StartedAt.Format("2006-01-02 15:04:05"), run.Duration())
+	fmt.Fprintf(w, "inserted %d\tmatches %d\temails sent %d\n\n", run.Inserted, run.Matches, run.EmailsSent)
+	fmt.Fprintln(w, "LOG\tOLD HEAD\tNEW HEAD\tCOMPLETED HEAD\tDOWNLOADED\tPARSE FAILURES\tSTATUS")
+	for _, l := range logs {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\t%s\n", l.Url, l.OldHeadIndex, l.NewHeadIndex, l.CompletedHeadIndex,
+			l.Downloaded, l.ParseFailures, l.Status)
+	}
+}
 
-	// Start queueing downloads for each log
-	for url, headInfo := range *logInfos {
-		Wg.Add(1)
-		go distributeWork(headInfo.OldHeadIndex, headInfo.NewHeadIndex, DOWNLOADER_COUNT, url, c_parse, db)
+// Runs the quarantined entries through the parsers again, entries which parse are matched against
+// the monitors like freshly downloaded ones and released from the quarantine once their matches are saved
+func reprocess(ctx context.Context, store sqldb.Store, unsubscriber *sqldb.Unsubscriber) error {
+	entries, err := store.LoadQuarantine(ctx)
+	if err != nil {
+		return fmt.Errorf("loading quarantined entries -> %w", err)
+	}
+	slog.Info("Reprocessing quarantined entries", "count", len(entries))
+
+	// Once stopped, the entries already queued are still processed
+	dbCtx := context.WithoutCancel(ctx)
+
+	matcher, err := sqldb.LoadMatcher(ctx, store)
+	if err != nil {
+		return fmt.Errorf("loading monitors -> %w", err)
+	}
+
+	p := NewPipeline(ctx, nil, slog.Default(), store, matcher, false)
+	for _, e := range entries {
+		queued := p.Queue(CTEntry{
+			LeafInput:   e.LeafInput,
+			ExtraData:   e.ExtraData,
+			LogUrl:      e.LogUrl,
+			Index:       e.Index,
+			Quarantined: true,
+		})
+		if !queued {
+			break
+		}
+	}
+	if err := p.Wait(); err != nil {
+		return err
 	}
 
-	// Wait for work distributors
-	Wg.Wait()
+	if _, _, err := sqldb.NotifyMatches(dbCtx, store, matcher, unsubscriber); err != nil {
+		return fmt.Errorf("saving matches -> %w", err)
+	}
+	released := p.ParsedQuarantined()
+	for _, e := range released {
+		if err := store.ReleaseQuarantinedEntry(dbCtx, e.LogUrl, e.Index); err != nil {
+			return fmt.Errorf("releasing entry %d of %s from quarantine -> %w", e.Index, e.LogUrl, err)
+		}
+	}
+	slog.Info("Finished reprocessing", "released", len(released))
+	return nil
+}
 
-	// Wait for downloaders
-	Wd.Wait()
+func run(ctx context.Context, dumpFile bool, store sqldb.Store, unsubscriber *sqldb.Unsubscriber) error {
+	var logInfos *map[string]sqldb.CTLogInfo
+	var err error
 
-	// Update log indexes
-	for url, headInfo := range *logInfos {
-		sqldb.SaveLogIndex(headInfo.NewHeadIndex, url, db)
+	logInfos, err = downloadHeads(ctx, store)
+	if err != nil {
+		// Try to recover
+		sec := 1
+		for err != nil {
+			if !sleepContext(ctx, time.Duration(sec)*time.Second) {
+				return nil
+			}
+			logInfos, err = downloadHeads(ctx, store)
+			sec += 1
+			if sec == 50 {
+				return fmt.Errorf("timed out while downloading heads -> %w", err)
+			}
+		}
 	}
 
-	downloadEndTime := time.Now()
-	log.Println("FINISHED DOWNLOADING")
-	log.Println("Download duration = ", downloadEndTime.Sub(startTime))
+	// FOR TESTING PURPOSES
+	//updateHeads(ctx, logInfos, store)
 
-	// Everything downloaded, close to-parse channel
-	close(c_parse)
+	return process(ctx, *logInfos, dumpFile, store, unsubscriber)
+}
 
-	// Wait for parsers
-	Wp.Wait()
-	log.Println("FINISHED PARSING")
+// Downloads the entries between the old and new heads of the logs as one run, inserts and matches them
+// and advances the head of each log to the last entry downloaded without gaps.
+// Once the context is cancelled downloads stop, the run is finished with what was downloaded and marked interrupted.
+func process(ctx context.Context, logInfos map[string]sqldb.CTLogInfo, dumpFile bool, store sqldb.Store, unsubscriber *sqldb.Unsubscriber) error {
+	// Only the downloads are stopped, the database work goes on to keep the run consistent
+	dbCtx := context.WithoutCancel(ctx)
 
-	// Everything parsed, close to-insert channel
-	close(c_insert)
+	// Print the amounts to download from each log and then the sum
+	var all int64 = 0
+	for u, i := range logInfos {
+		all += i.NewHeadIndex - i.OldHeadIndex
+		slog.Debug("Log to download", "log_url", u, "start", i.OldHeadIndex, "end", i.NewHeadIndex, "count", i.NewHeadIndex-i.OldHeadIndex)
+	}
+
+	// Monitors are loaded once per run, changes apply to the next one
+	matcher, err := sqldb.LoadMatcher(dbCtx, store)
+	if err != nil {
+		return fmt.Errorf("loading monitors -> %w", err)
+	}
 
-	// Wait for the inserter
-	Wo.Wait()
+	runID, err := store.StartRun(dbCtx, logInfos)
+	if err != nil {
+		return fmt.Errorf("starting run -> %w", err)
+	}
+	logger := slog.With("run_id", runID)
+	logger.Info("Started run", "to_download", all)
+	defer heartbeat(dbCtx, store, runID, logger)()
+
+	p := NewPipeline(ctx, logInfos, logger, store, matcher, dumpFile)
+	if err := p.Wait(); err != nil {
+		// Downloaded entries may not have been parsed, so no log advances
+		for url, info := range logInfos {
+			st := p.Log(url)
+			if err := store.SetRunLogStatus(dbCtx, runID, url, sqldb.LogFailed, info.OldHeadIndex, st.downloaded, st.parseFailures); err != nil {
+				logger.Error("Failed to set status of log", "log_url", url, "status", sqldb.LogFailed, "err", err)
+			}
+		}
+		_, _, inserted := p.Counts()
+		failRun(dbCtx, store, runID, sqldb.RunStats{Inserted: inserted}, logger)
+		return fmt.Errorf("run %d failed -> %w", runID, err)
+	}
 
-	// Finished inserting, start working with the data
-	log.Println("FINISHED INSERTING")
+	// Logs get their heads advanced at the end of the run as far as they were downloaded without gaps
+	for url, info := range logInfos {
+		st := p.Log(url)
+		head := st.completedHead(info.OldHeadIndex)
+		status := sqldb.LogDownloaded
+		if head < info.NewHeadIndex {
+			status = sqldb.LogFailed
+			if head > info.OldHeadIndex {
+				status = sqldb.LogPartial
+			}
+			logger.Warn("Log not downloaded completely", "log_url", url, "completed", head, "end", info.NewHeadIndex, "err", st.err)
+		}
+		if err := store.SetRunLogStatus(dbCtx, runID, url, status, head, st.downloaded, st.parseFailures); err != nil {
+			logger.Error("Failed to set status of log", "log_url", url, "status", status, "err", err)
+		}
+	}
 
-	insertTimeLength := time.Now().Sub(startTime).Hours()
-	log.Println("THROUGHPUT: ", float64(inputCount)/insertTimeLength)
+	parsed, matched, inserted := p.Counts()
+	logger.Info("Finished pipeline", "parsed", parsed, "matched", matched, "inserted", inserted, "per_hour", float64(parsed)/time.Since(p.started).Hours())
 
 	if dumpFile {
-		log.Println("CREATING FILE FOR API")
-		sqldb.CreateDownloadedFile(db)
-		log.Println("FILE CREATED")
+		sqldb.CreateDownloadedFile(dbCtx, store)
+		logger.Info("Created dump file")
 	}
 
-	log.Println("PARSING")
-	sqldb.ParseDownloadedCertificates(db)
-	log.Println("FINISHED SENDING EMAILS")
+	// Heads are not advanced past matches which were not saved
+	matches, emails, err := sqldb.NotifyMatches(dbCtx, store, matcher, unsubscriber)
+	if err != nil {
+		failRun(dbCtx, store, runID, sqldb.RunStats{Inserted: inserted}, logger)
+		return fmt.Errorf("run %d failed saving matches -> %w", runID, err)
+	}
+	metricNotifications.Add(float64(emails))
+	logger.Info("Finished matching", "matches", matches, "emails_sent", emails)
 
-	sqldb.UpdateLogIndexes(db)
-	sqldb.DeleteExpiredCertificates(db)
-	log.Println("THE END")
+	status := sqldb.RunFinished
+	if ctx.Err() != nil {
+		status = sqldb.RunInterrupted
+	}
+	// Heads which could not be advanced fail the run after the cleanup, the run is finished without them
+	err = store.FinishRun(dbCtx, runID, status, sqldb.RunStats{Inserted: inserted, Matches: matches, EmailsSent: emails})
+	if err := store.DeleteExpiredCertificates(dbCtx); err != nil {
+		logger.Error("Failed deleting expired certificates", "err", err)
+	}
+	if n, err := store.DeleteFinishedRuns(dbCtx, time.Now().Add(-RUN_RETENTION)); err != nil {
+		logger.Error("Failed deleting old runs", "err", err)
+	} else if n > 0 {
+		logger.Info("Deleted old runs", "count", n)
+	}
+	if err != nil {
+		return fmt.Errorf("finishing run %d -> %w", runID, err)
+	}
+	logger.Info("Finished run", "status", status)
+	return nil
+}
+
+// Finishes the run as failed without advancing any head
+func failRun(ctx context.Context, store sqldb.Store, runID int64, stats sqldb.RunStats, logger *slog.Logger) {
+	if err := store.FinishRun(ctx, runID, sqldb.RunFailed, stats); err != nil {
+		logger.Error("Failed finishing run", "status", sqldb.RunFailed, "err", err)
+	}
+}
+
+// Records heartbeats of the run in the background until the returned function is called
+func heartbeat(ctx context.Context, store sqldb.Store, runID int64, logger *slog.Logger) func() {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(RUN_HEARTBEAT_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := store.Heartbeat(ctx, runID); err != nil && ctx.Err() == nil {
+					logger.Warn("Failed recording heartbeat of run", "err", err)
+				}
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
 }
 
 func main() {
-	log.Println("STARTING")
 	runtime.GOMAXPROCS(runtime.NumCPU())
-	log.Println("Number of logical CPUs: ", runtime.NumCPU())
 	os.Setenv("LC_ALL", "C")
 
 	flag.Usage = func() { usage() }
-	database := flag.String("db", "", "REQUIRED, path to database")
+	database := flag.String("db", "", "REQUIRED, PostgreSQL connection parameters, or sqlite:path of an SQLite file")
 	norun := flag.Bool("norun", false, "Do not run the scan")
-	dumpFile := flag.Bool("dump", false, "Dump the downloaded certificate to a dump file")
+	watchLogs := flag.Bool("watch", false, "Tail the logs continuously, polling each log at an interval based on its MMD, instead of running the scan once")
+	reprocessQuarantine := flag.Bool("reprocess", false, "Parse the quarantined entries again instead of running the scan")
+	dumpFile := flag.Bool("dump", false, "Keep the downloaded certificates and dump them to a dump file")
+	metricsAddr := flag.String("metrics", "", "Serve Prometheus metrics on /metrics of this address, e.g. :9100")
+	apiAddr := flag.String("api", "", "Serve the HTTP query API over the saved certificates on /api/certificates of this address, e.g. :8080")
+	publicURL := flag.String("public-url", "", "Address the API is reachable at in confirmation, sign-in and unsubscribe links, e.g. https://ctlog.example.com; without it no API keys, sign-in or confirmation links are sent")
+	history := flag.Bool("history", false, "List past runs, or show the run whose ID is given as an argument")
+	add := flag.String("add", "", "Add monitors, \"email domain1 domain2...\", domains can be in Unicode")
+	remove := flag.String("remove", "", "Remove a monitor, \"email domain\"")
+	verifyArg := flag.String("verify", "", "Verify a monitor added through the API without its owner publishing the token, \"email domain\"")
+	allowCA := flag.String("allow-ca", "", "Authorize a CA for a monitored domain, \"email domain CA\", CA is an issuer DN or a hex AKI")
+	removeCA := flag.String("remove-ca", "", "Remove an authorized CA of a monitored domain, \"email domain CA\"")
+	addLog := flag.String("add-log", "", "Add a CT log, or set the MMD of one added before, \"url [mmd]\", the maximum merge delay in seconds, 86400 by default")
+	kind := flag.String("kind", string(match.KindDomain), "Kind of added, removed or verified monitors: domain, organization, issuer or key")
+	mode := flag.String("mode", string(match.DefaultMode), "Match mode of added monitors: exact, subdomain or wildcard")
+	lookalike := flag.String("lookalike", string(match.Off), "Lookalike detection of added monitors: off, low, medium or high")
+	logFormat := flag.String("log-format", "text", "Format of the log: text or json")
+	logLevel := flag.String("log-level", "info", "Least severe level logged: debug, info, warn or error")
 
 	flag.Parse()
 
+	if err := setupLogging(os.Stderr, *logFormat, *logLevel); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	slog.Info("Starting", "cpus", runtime.NumCPU())
+
 	if *database == "" {
-		log.Fatal("[-] No database")
+		fatal("No database")
+	}
+
+	ctx := shutdownContext()
+
+	store, err := sqldb.Open(ctx, *database)
+	if err != nil {
+		fatal("Failed connecting to the database", "err", err)
+	}
+	defer store.Close()
+	if err := store.Migrate(ctx); err != nil {
+		fatal("Failed migrating the database", "err", err)
+	}
+	if *history {
+		showHistory(ctx, flag.Arg(0), store)
+		return
+	}
+
+	if *add != "" || *remove != "" || *verifyArg != "" {
+		manageMonitors(ctx, *add, *remove, *verifyArg, *kind, *mode, *lookalike, store)
+		return
+	}
+
+	if *allowCA != "" || *removeCA != "" {
+		manageAuthorizedCAs(ctx, *allowCA, *removeCA, store)
+		return
 	}
 
-	db := sqldb.ConnectToDatabase(*database)
-	defer sqldb.CloseConnection(db)
-	sqldb.CleanupDownloadTable(db)
+	if *addLog != "" {
+		manageLogs(ctx, *addLog, store)
+		return
+	}
+
+	// Only a scan can find the runs of other processes dead, and Downloaded is only cleaned up once no run is running
+	if !*norun {
+		aborted, err := store.AbortStaleRuns(ctx, time.Now().Add(-RUN_STALE_AFTER))
+		if err != nil {
+			fatal("Failed aborting unfinished runs", "err", err)
+		}
+		if aborted > 0 {
+			slog.Info("Marked unfinished runs as aborted", "count", aborted)
+		}
+		if err := store.CleanupDownloaded(ctx); err != nil {
+			fatal("Failed cleaning up downloaded certificates", "err", err)
+		}
+	}
 
 	// Create http client
 	CreateClient()
 
+	if *metricsAddr != "" {
+		serveMetrics(*metricsAddr)
+	}
+
+	unsubscriber, err := sqldb.NewUnsubscriber(ctx, store, *publicURL)
+	if err != nil {
+		fatal("Failed loading the unsubscribe key", "err", err)
+	}
+	if *publicURL == "" && !*norun {
+		slog.Warn("No public URL, emails are sent without unsubscribe links")
+	}
+
+	if *apiAddr != "" {
+		serveAPI(ctx, *apiAddr, *publicURL, store, unsubscriber)
+	}
+
 	if *norun {
-		log.Printf("NORUN")
+		slog.Info("Not running the scan")
+		if *apiAddr != "" {
+			// Only serving the API, until stopped
+			<-ctx.Done()
+		}
+	} else if *watchLogs {
+		err = watch(ctx, store, unsubscriber)
+	} else if *reprocessQuarantine {
+		err = reprocess(ctx, store, unsubscriber)
 	} else {
-		run(*dumpFile, db)
+		err = run(ctx, *dumpFile, store, unsubscriber)
+	}
+	if err != nil {
+		fatal("Run failed", "err", err)
+	}
+
+	if sig := stopped(); sig != nil {
+		slog.Info("Stopped", "signal", sig)
+		store.Close()
+		os.Exit(exitStatus())
 	}
 }
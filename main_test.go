@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseErrorType(t *testing.T) {
+	_, _, err := parseEntry(CTEntry{LeafInput: []byte("not a leaf")})
+	if got := parseErrorType(err); got != "unmarshal" {
+		t.Errorf("parseErrorType(%v) = %q, want unmarshal", err, got)
+	}
+	wrapped := fmt.Errorf("entry 7 -> %w", parseError{"certificate", errors.New("bad")})
+	if got := parseErrorType(wrapped); got != "certificate" {
+		t.Errorf("parseErrorType(%v) = %q, want certificate", wrapped, got)
+	}
+	if got := parseErrorType(errors.New("other")); got != "unknown" {
+		t.Errorf("parseErrorType of another error = %q, want unknown", got)
+	}
+}
+
+func TestParseEntryMalformed(t *testing.T) {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		// An SCT list which is not an octet string, the x509 parser skips it with a non-fatal error
+		ExtraExtensions: []pkix.Extension{{Id: asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}, Value: []byte{0xff}}},
+	}
+
+	cert, malformed, err := parseEntry(testEntryOf(t, template))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert == nil || len(cert.DNSNames) != 1 {
+		t.Fatalf("parseEntry() = %v, want the certificate", cert)
+	}
+	if len(malformed) != 1 || !strings.HasPrefix(malformed[0], "malformed: ") {
+		t.Errorf("parseEntry() reported %q, want a malformed finding", malformed)
+	}
+
+	_, malformed, err = parseEntry(testEntry(t, 2, "example.com"))
+	if err != nil || malformed != nil {
+		t.Errorf("parseEntry() of a valid certificate = %q, %v", malformed, err)
+	}
+}
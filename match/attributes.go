@@ -0,0 +1,174 @@
+package match
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// What a monitor watches for.
+//
+//	domain       - names of the certificate, see Mode
+//	organization - Subject O or OU, compared case-insensitively
+//	issuer       - issuer DN, or the hex authority key identifier (the SKI of the issuing CA)
+//	key          - hex SHA-256 of the subject public key info
+//	cidr         - IP address range containing an IP address SAN (or an IP address in the CN)
+type Kind string
+
+const (
+	KindDomain       Kind = "domain"
+	KindOrganization Kind = "organization"
+	KindIssuer       Kind = "issuer"
+	KindKey          Kind = "key"
+	KindCIDR         Kind = "cidr"
+)
+
+// Reasons of certificates reported to monitors which are not domain monitors.
+const (
+	ReasonOrganization Reason = "organization"
+	ReasonIssuer       Reason = "issuer"
+	ReasonKey          Reason = "key"
+	ReasonCIDR         Reason = "ip-range"
+)
+
+// Reason of certificates matching a domain monitor, which were issued by a CA the domain does not authorize.
+const ReasonPolicyViolation Reason = "policy-violation"
+
+// Returns how urgent a certificate reported for the reason is, higher is more urgent.
+func (r Reason) Priority() int {
+	switch r {
+	case ReasonPolicyViolation:
+		return 3
+	case ReasonMatch, ReasonOrganization, ReasonIssuer, ReasonKey, ReasonCIDR:
+		return 2
+	default:
+		return 1
+	}
+}
+
+// The CAs a domain expects its certificates to be issued by, as issuer DNs or hex authority key identifiers
+// in the form returned by ParseValue for KindIssuer. An empty policy authorizes any CA.
+type Policy []string
+
+// Reports whether the policy authorizes the issuer of a certificate.
+func (p Policy) Allows(a Attributes) bool {
+	if len(p) == 0 {
+		return true
+	}
+	for _, ca := range p {
+		if _, ok := a.Match(KindIssuer, ca); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Certificate attributes other than names which can be monitored.
+type Attributes struct {
+	Organization   []string
+	Issuer         string
+	AuthorityKeyID string
+	SPKIHash       string
+	IPAddresses    []string
+}
+
+// Parses a monitor kind, an empty string is a domain monitor.
+func ParseKind(s string) (Kind, error) {
+	switch k := Kind(strings.ToLower(strings.TrimSpace(s))); k {
+	case "":
+		return KindDomain, nil
+	case KindDomain, KindOrganization, KindIssuer, KindKey, KindCIDR:
+		return k, nil
+	default:
+		return "", fmt.Errorf("unknown monitor kind %q", s)
+	}
+}
+
+// Lowercase hex without separators, as written by openssl (AB:CD:...) or as is.
+func normalizeHex(s string) (string, bool) {
+	s = strings.ToLower(strings.NewReplacer(":", "", " ", "").Replace(s))
+	_, err := hex.DecodeString(s)
+	return s, err == nil && s != ""
+}
+
+// Validates a monitored value of a kind other than domain and returns the form it is stored and compared in.
+func ParseValue(kind Kind, value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", fmt.Errorf("empty %s", kind)
+	}
+
+	switch kind {
+	case KindOrganization:
+		return value, nil
+
+	case KindIssuer:
+		// A DN always contains "=", a key identifier never does
+		if strings.Contains(value, "=") {
+			return value, nil
+		}
+		if aki, ok := normalizeHex(value); ok {
+			return aki, nil
+		}
+		return "", fmt.Errorf("issuer %q is neither a DN nor a hex key identifier", value)
+
+	case KindKey:
+		if h, ok := normalizeHex(value); ok && len(h) == 64 {
+			return h, nil
+		}
+		return "", fmt.Errorf("key %q is not a hex SHA-256 hash", value)
+
+	case KindCIDR:
+		// A single address is a range of its own
+		if ip := net.ParseIP(value); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			return (&net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}).String(), nil
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return "", fmt.Errorf("invalid IP range %q -> %s", value, err)
+		}
+		return network.String(), nil
+	}
+
+	return "", fmt.Errorf("%s monitors have no value", kind)
+}
+
+// Reports whether the attributes contain the monitored value of the kind, and the reason to report it with.
+func (a Attributes) Match(kind Kind, value string) (Reason, bool) {
+	switch kind {
+	case KindOrganization:
+		for _, o := range a.Organization {
+			if strings.EqualFold(strings.TrimSpace(o), value) {
+				return ReasonOrganization, true
+			}
+		}
+
+	case KindIssuer:
+		if a.Issuer == value || (a.AuthorityKeyID != "" && a.AuthorityKeyID == value) {
+			return ReasonIssuer, true
+		}
+
+	case KindKey:
+		if a.SPKIHash == value {
+			return ReasonKey, true
+		}
+
+	case KindCIDR:
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return "", false
+		}
+		for _, s := range a.IPAddresses {
+			if ip := net.ParseIP(s); ip != nil && network.Contains(ip) {
+				return ReasonCIDR, true
+			}
+		}
+	}
+
+	return "", false
+}
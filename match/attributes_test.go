@@ -0,0 +1,142 @@
+package match
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseValue(t *testing.T) {
+	tests := []struct {
+		kind  Kind
+		value string
+		want  string
+		ok    bool
+	}{
+		{KindOrganization, " Example Inc. ", "Example Inc.", true},
+		{KindOrganization, " ", "", false},
+
+		{KindIssuer, "CN=R3,O=Let's Encrypt,C=US", "CN=R3,O=Let's Encrypt,C=US", true},
+		{KindIssuer, "14:2E:B3:17:B7:58:56:CB", "142eb317b75856cb", true},
+		{KindIssuer, "142EB317B75856CB", "142eb317b75856cb", true},
+		{KindIssuer, "Let's Encrypt", "", false},
+
+		{KindKey, "AB:" + strings.Repeat("00", 31), "ab" + strings.Repeat("00", 31), true},
+		{KindKey, "abcd", "", false},
+		{KindKey, strings.Repeat("zz", 32), "", false},
+
+		{KindCIDR, "192.0.2.0/24", "192.0.2.0/24", true},
+		{KindCIDR, "192.0.2.77/24", "192.0.2.0/24", true},
+		{KindCIDR, "192.0.2.1", "192.0.2.1/32", true},
+		{KindCIDR, "2001:DB8::/32", "2001:db8::/32", true},
+		{KindCIDR, "2001:db8::1", "2001:db8::1/128", true},
+		{KindCIDR, "192.0.2.0/33", "", false},
+		{KindCIDR, "example.com", "", false},
+
+		{KindDomain, "example.com", "", false},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseValue(tt.kind, tt.value)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("ParseValue(%s, %q) = %q, %v, want %q, ok %v", tt.kind, tt.value, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestAttributesMatch(t *testing.T) {
+	a := Attributes{
+		Organization:   []string{"Example Inc.", " Security "},
+		Issuer:         "CN=Test CA,O=Test",
+		AuthorityKeyID: "142eb317b75856cb",
+		SPKIHash:       "ab" + strings.Repeat("00", 31),
+		IPAddresses:    []string{"192.0.2.10", "2001:db8::1"},
+	}
+
+	tests := []struct {
+		kind  Kind
+		value string
+		want  Reason
+	}{
+		{KindOrganization, "example inc.", ReasonOrganization},
+		{KindOrganization, "security", ReasonOrganization},
+		{KindOrganization, "Example", ""},
+
+		{KindIssuer, "CN=Test CA,O=Test", ReasonIssuer},
+		{KindIssuer, "142eb317b75856cb", ReasonIssuer},
+		{KindIssuer, "CN=Other CA", ""},
+		{KindIssuer, "ffff", ""},
+
+		{KindKey, "ab" + strings.Repeat("00", 31), ReasonKey},
+		{KindKey, strings.Repeat("00", 32), ""},
+
+		{KindCIDR, "192.0.2.0/24", ReasonCIDR},
+		{KindCIDR, "2001:db8::/32", ReasonCIDR},
+		{KindCIDR, "198.51.100.0/24", ""},
+	}
+
+	for _, tt := range tests {
+		reason, ok := a.Match(tt.kind, tt.value)
+		if reason != tt.want || ok != (tt.want != "") {
+			t.Errorf("Match(%s, %q) = %q, %v, want %q", tt.kind, tt.value, reason, ok, tt.want)
+		}
+	}
+
+	// Without an AKI an empty issuer value matches nothing
+	if _, ok := (Attributes{Issuer: "CN=Test CA"}).Match(KindIssuer, ""); ok {
+		t.Error("Match() of an empty AKI = true")
+	}
+}
+
+func TestPolicyAllows(t *testing.T) {
+	a := Attributes{Issuer: "CN=Test CA,O=Test", AuthorityKeyID: "142eb317b75856cb"}
+
+	tests := []struct {
+		policy Policy
+		want   bool
+	}{
+		{nil, true},
+		{Policy{}, true},
+		{Policy{"CN=Test CA,O=Test"}, true},
+		{Policy{"CN=Other CA", "142eb317b75856cb"}, true},
+		{Policy{"CN=Other CA"}, false},
+		{Policy{"ffff"}, false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.policy.Allows(a); got != tt.want {
+			t.Errorf("%q.Allows() = %v, want %v", tt.policy, got, tt.want)
+		}
+	}
+}
+
+func TestAttributesMatchCIDR(t *testing.T) {
+	tests := []struct {
+		ips   []string
+		value string
+		want  bool
+	}{
+		{[]string{"192.0.2.10"}, "192.0.2.10/32", true},
+		{[]string{"198.51.100.1", "192.0.2.10"}, "192.0.2.0/24", true},
+		{[]string{"192.0.2.10"}, "192.0.2.11/32", false},
+		{[]string{"192.0.2.10"}, "0.0.0.0/0", true},
+		// IPv4 ranges do not contain IPv6 addresses, IPv4-mapped addresses are IPv4
+		{[]string{"2001:db8::1"}, "0.0.0.0/0", false},
+		{[]string{"::ffff:192.0.2.10"}, "192.0.2.0/24", true},
+		{[]string{"2001:db8::1"}, "2001:db8::/32", true},
+		{[]string{"2001:db9::1"}, "2001:db8::/32", false},
+		{nil, "192.0.2.0/24", false},
+
+		// Malformed values and addresses match nothing
+		{[]string{"192.0.2.10"}, "192.0.2.0/33", false},
+		{[]string{"192.0.2.10"}, "192.0.2.10", false},
+		{[]string{"192.0.2.10"}, "not a range", false},
+		{[]string{"192.0.2"}, "192.0.2.0/24", false},
+	}
+
+	for _, tt := range tests {
+		reason, ok := Attributes{IPAddresses: tt.ips}.Match(KindCIDR, tt.value)
+		if ok != tt.want || (ok && reason != ReasonCIDR) {
+			t.Errorf("Match(%v, cidr %q) = %q, %v, want %v", tt.ips, tt.value, reason, ok, tt.want)
+		}
+	}
+}
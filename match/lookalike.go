@@ -0,0 +1,239 @@
+package match
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/net/publicsuffix"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Why a certificate was reported to a monitor.
+type Reason string
+
+const (
+	// The name belongs to the monitored domain
+	ReasonMatch Reason = "match"
+	// The registrable label uses confusable characters (examp1e.com, xn--exmple-4nf.com)
+	ReasonHomoglyph Reason = "homoglyph"
+	// The registrable label is a small edit away (exmaple.com, exampel.com)
+	ReasonTypo Reason = "typo"
+	// The registrable label is the same under a different public suffix (example.net)
+	ReasonTLDSwap Reason = "tld-swap"
+	// The monitored label is embedded in another name (example-login.com, example.com.evil.net)
+	ReasonKeyword Reason = "keyword"
+)
+
+// How aggressively lookalike names are reported.
+//
+//	off    - no lookalike detection
+//	low    - homoglyphs and TLD swaps
+//	medium - low and typos one edit away
+//	high   - medium, typos two edits away and keyword embedding
+type Sensitivity string
+
+const (
+	Off    Sensitivity = "off"
+	Low    Sensitivity = "low"
+	Medium Sensitivity = "medium"
+	High   Sensitivity = "high"
+)
+
+// Labels shorter than this are too common to report typos and embeddings of.
+const minKeywordLength = 4
+
+// Parses a lookalike sensitivity, an empty string is off.
+func ParseSensitivity(s string) (Sensitivity, error) {
+	switch v := Sensitivity(strings.ToLower(strings.TrimSpace(s))); v {
+	case "":
+		return Off, nil
+	case Off, Low, Medium, High:
+		return v, nil
+	default:
+		return "", fmt.Errorf("unknown lookalike sensitivity %q", s)
+	}
+}
+
+// Characters that render (nearly) the same as a latin letter.
+var confusables = map[rune]rune{
+	'0': 'o', '1': 'l', 'i': 'l', 'ı': 'l', '|': 'l',
+	// Cyrillic
+	'а': 'a', 'в': 'b', 'е': 'e', 'һ': 'h', 'і': 'l', 'ј': 'j', 'к': 'k', 'м': 'm', 'н': 'h', 'о': 'o',
+	'р': 'p', 'с': 'c', 'т': 't', 'у': 'y', 'х': 'x', 'ѕ': 's', 'ԁ': 'd', 'ԛ': 'q', 'ԝ': 'w', 'ӏ': 'l',
+	// Greek
+	'α': 'a', 'β': 'b', 'ε': 'e', 'η': 'n', 'ι': 'l', 'κ': 'k', 'ν': 'v', 'ο': 'o', 'ρ': 'p', 'τ': 't',
+	'υ': 'u', 'χ': 'x', 'ω': 'w',
+	// Other latin
+	'ɡ': 'g', 'ɑ': 'a', 'ł': 'l', 'ø': 'o', 'đ': 'd', 'ħ': 'h',
+}
+
+// Sequences of latin letters which look like a single letter.
+var confusableSequences = strings.NewReplacer("rn", "m", "vv", "w", "cl", "d")
+
+// Maps a label to a form in which confusable labels are equal.
+func skeleton(label string) string {
+	var sb strings.Builder
+	for _, r := range norm.NFD.String(label) {
+		// Drop diacritics
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+		if c, ok := confusables[r]; ok {
+			r = c
+		}
+		sb.WriteRune(r)
+	}
+	return confusableSequences.Replace(sb.String())
+}
+
+// Optimal string alignment distance, edits are insertions, deletions, substitutions and adjacent swaps.
+func editDistance(a string, b string) int {
+	s, t := []rune(a), []rune(b)
+	d := make([][]int, len(s)+1)
+	for i := range d {
+		d[i] = make([]int, len(t)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+
+	for i := 1; i <= len(s); i++ {
+		for j := 1; j <= len(t); j++ {
+			cost := 1
+			if s[i-1] == t[j-1] {
+				cost = 0
+			}
+			d[i][j] = min3(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && s[i-1] == t[j-2] && s[i-2] == t[j-1] && d[i-2][j-2]+1 < d[i][j] {
+				d[i][j] = d[i-2][j-2] + 1
+			}
+		}
+	}
+	return d[len(s)][len(t)]
+}
+
+func min3(a int, b int, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// Splits a name into the label left of its public suffix and the public suffix.
+func registrable(name string) (label string, suffix string, ok bool) {
+	etld1, err := publicsuffix.EffectiveTLDPlusOne(name)
+	if err != nil {
+		return "", "", false
+	}
+	i := strings.IndexByte(etld1, '.')
+	return etld1[:i], etld1[i+1:], true
+}
+
+// A name prepared for lookalike detection, so a name compared against many domains is split,
+// converted to Unicode and reduced to its skeleton once.
+type LookalikeName struct {
+	// Normalized name without a leading wildcard label
+	name string
+	// Label left of the public suffix and the public suffix, ok is false if the name has none
+	label  string
+	suffix string
+	ok     bool
+	// Unicode form of the label, punycode hides the confusable characters, and its skeleton
+	unicode  string
+	skeleton string
+	// Unicode forms of all labels of the name
+	labels []string
+}
+
+// Prepares a certificate name or a monitored domain for lookalike detection.
+func NewLookalikeName(name string) LookalikeName {
+	n := LookalikeName{name: strings.TrimPrefix(Normalize(name), "*.")}
+	if n.name == "" {
+		return n
+	}
+	n.label, n.suffix, n.ok = registrable(n.name)
+	if !n.ok {
+		return n
+	}
+
+	n.unicode = toUnicodeLabel(n.label)
+	n.skeleton = skeleton(n.unicode)
+	for _, l := range strings.Split(n.name, ".") {
+		n.labels = append(n.labels, toUnicodeLabel(l))
+	}
+	return n
+}
+
+// Returns the Unicode form of an ASCII label, or the label if it can not be converted.
+func toUnicodeLabel(label string) string {
+	if u, err := idna.ToUnicode(label); err == nil {
+		return u
+	}
+	return label
+}
+
+// Reports whether the certificate name imitates domain without belonging to it, and why.
+// Names matching the domain in the subdomain mode and other names of its registrable domain are never lookalikes.
+func Lookalike(name string, domain string, s Sensitivity) (Reason, bool) {
+	if s == Off || s == "" {
+		return "", false
+	}
+	return NewLookalikeName(name).Imitates(NewLookalikeName(domain), s)
+}
+
+// Reports whether the name imitates domain without belonging to it, and why, see Lookalike.
+func (n LookalikeName) Imitates(domain LookalikeName, s Sensitivity) (Reason, bool) {
+	if s == Off || s == "" || !n.ok || !domain.ok || isSubdomain(n.name, domain.name) {
+		return "", false
+	}
+	// Siblings of the domain under the same registrable domain (mail.example.com of www.example.com) belong to its owner
+	if n.label == domain.label && n.suffix == domain.suffix {
+		return "", false
+	}
+
+	if n.unicode == domain.unicode && n.suffix != domain.suffix {
+		return ReasonTLDSwap, true
+	}
+
+	if n.unicode != domain.unicode && n.skeleton == domain.skeleton {
+		return ReasonHomoglyph, true
+	}
+
+	if s == Low || len([]rune(domain.unicode)) < minKeywordLength {
+		return "", false
+	}
+
+	maxDistance := 1
+	if s == High {
+		maxDistance = 2
+	}
+	if n.unicode != domain.unicode && editDistance(n.unicode, domain.unicode) <= maxDistance {
+		return ReasonTypo, true
+	}
+
+	if s == High {
+		for _, l := range n.labels {
+			if strings.Contains(l, domain.unicode) {
+				return ReasonKeyword, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// Returns the reason of the first lookalike among the names.
+func LookalikeNames(names []LookalikeName, domain LookalikeName, s Sensitivity) (Reason, bool) {
+	for _, n := range names {
+		if r, ok := n.Imitates(domain, s); ok {
+			return r, true
+		}
+	}
+	return "", false
+}
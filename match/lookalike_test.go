@@ -0,0 +1,127 @@
+package match
+
+import "testing"
+
+func TestLookalike(t *testing.T) {
+	tests := []struct {
+		name        string
+		domain      string
+		sensitivity Sensitivity
+		want        Reason
+	}{
+		// Names of the domain and its registrable domain
+		{"www.example.com", "example.com", High, ""},
+		{"*.example.com", "example.com", High, ""},
+		{"mail.example.com", "www.example.com", High, ""},
+		{"example.com", "www.example.com", High, ""},
+		{"*.example.com", "www.example.com", High, ""},
+		{"example-login.example.com", "www.example.com", High, ""},
+
+		// homoglyph
+		{"examp1e.com", "example.com", Low, ReasonHomoglyph},
+		{"exarnple.com", "example.com", Low, ReasonHomoglyph},
+		{"xn--exmple-4nf.com", "example.com", Low, ReasonHomoglyph},
+		{"ехаmple.com", "example.com", Low, ReasonHomoglyph},
+		{"www.examp1e.com", "www.example.com", Low, ReasonHomoglyph},
+
+		// tld-swap
+		{"example.net", "example.com", Low, ReasonTLDSwap},
+		{"www.example.co.uk", "example.com", Low, ReasonTLDSwap},
+
+		// typo
+		{"exmaple.com", "example.com", Low, ""},
+		{"exmaple.com", "example.com", Medium, ReasonTypo},
+		{"exampel.com", "example.com", Medium, ReasonTypo},
+		{"exampl.com", "example.com", Medium, ReasonTypo},
+		{"exmapel.com", "example.com", Medium, ""},
+		{"exmapel.com", "example.com", High, ReasonTypo},
+		{"xmpl.com", "example.com", High, ""},
+		// Labels shorter than minKeywordLength are too common
+		{"acb.com", "abc.com", High, ""},
+
+		// keyword
+		{"example-login.com", "example.com", Medium, ""},
+		{"example-login.com", "example.com", High, ReasonKeyword},
+		{"example.com.evil.net", "example.com", High, ReasonKeyword},
+		{"login.example.evil.net", "www.example.com", High, ReasonKeyword},
+		{"secure-example.org", "example.com", High, ReasonKeyword},
+		{"abc-login.com", "abc.com", High, ""},
+
+		{"other.org", "example.com", High, ""},
+		{"examp1e.com", "example.com", Off, ""},
+		{"", "example.com", High, ""},
+		{"localhost", "example.com", High, ""},
+	}
+
+	for _, tt := range tests {
+		got, ok := Lookalike(tt.name, tt.domain, tt.sensitivity)
+		if got != tt.want || ok != (tt.want != "") {
+			t.Errorf("Lookalike(%q, %q, %s) = %q, %v, want %q", tt.name, tt.domain, tt.sensitivity, got, ok, tt.want)
+		}
+	}
+}
+
+// Prepares the names for lookalike detection
+func lookalikeNames(names ...string) []LookalikeName {
+	prepared := make([]LookalikeName, len(names))
+	for i, n := range names {
+		prepared[i] = NewLookalikeName(n)
+	}
+	return prepared
+}
+
+func TestLookalikeNames(t *testing.T) {
+	domain := NewLookalikeName("www.example.com")
+	if r, ok := LookalikeNames(lookalikeNames("www.example.com", "mail.example.com", "examp1e.com"), domain, High); !ok || r != ReasonHomoglyph {
+		t.Errorf("LookalikeNames() = %q, %v, want %q", r, ok, ReasonHomoglyph)
+	}
+	if r, ok := LookalikeNames(lookalikeNames("www.example.com", "mail.example.com"), domain, High); ok {
+		t.Errorf("LookalikeNames() of the registrable domain = %q", r)
+	}
+	if r, ok := LookalikeNames(lookalikeNames("examp1e.com"), domain, Off); ok {
+		t.Errorf("LookalikeNames() with detection off = %q", r)
+	}
+}
+
+func TestSkeleton(t *testing.T) {
+	tests := map[string]string{
+		"example":  "example",
+		"examp1e":  "example",
+		"exarnple": "example",
+		"ехаmple":  "example",
+		"éxample":  "example",
+		"vvord":    "word",
+		"cloud":    "doud",
+		"ρaypal":   "paypal",
+	}
+	for label, want := range tests {
+		if got := skeleton(label); got != want {
+			t.Errorf("skeleton(%q) = %q, want %q", label, got, want)
+		}
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"example", "example", 0},
+		{"example", "exmaple", 1},
+		{"example", "exampl", 1},
+		{"example", "examples", 1},
+		{"example", "exannple", 2},
+		{"example", "exmapel", 2},
+		{"ca", "abc", 3},
+		{"", "abc", 3},
+		{"čeština", "cestina", 2},
+	}
+	for _, tt := range tests {
+		if got := editDistance(tt.a, tt.b); got != tt.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := editDistance(tt.b, tt.a); got != tt.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", tt.b, tt.a, got, tt.want)
+		}
+	}
+}
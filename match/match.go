@@ -0,0 +1,178 @@
+// Package match decides whether the names of a certificate belong to a monitored domain.
+//
+// Names and domains are compared in their IDNA ASCII form (A-labels), case-insensitively,
+// without a trailing dot and only on label boundaries, so "čeština.cz" matches
+// "xn--etina-gya30d.cz", and so "example.com" never matches "badexample.com" or "example.com.evil.net".
+// A wildcard name is a name whose leftmost label is "*", it covers exactly one label in its place.
+//
+// A monitor selects one of the match modes:
+//
+//	exact     - the domain itself, or a wildcard name covering it
+//	            (www.example.com matches www.example.com and *.example.com)
+//	subdomain - the domain, any name below it and wildcard names covering any of them
+//	            (example.com matches example.com, a.b.example.com and *.example.com)
+//	wildcard  - like subdomain, but only wildcard names
+//	            (example.com matches *.example.com and *.a.example.com, not www.example.com)
+package match
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+type Mode string
+
+const (
+	Exact     Mode = "exact"
+	Subdomain Mode = "subdomain"
+	Wildcard  Mode = "wildcard"
+)
+
+// Mode used for monitors which do not select one.
+const DefaultMode = Subdomain
+
+// A monitored domain and the way its names are matched.
+type Rule struct {
+	Domain string
+	Mode   Mode
+}
+
+// Parses a match mode, an empty string is the default mode.
+func ParseMode(s string) (Mode, error) {
+	switch m := Mode(strings.ToLower(strings.TrimSpace(s))); m {
+	case "":
+		return DefaultMode, nil
+	case Exact, Subdomain, Wildcard:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown match mode %q", s)
+	}
+}
+
+// IDNA mapping for names found in certificates, which may contain wildcards, underscores and worse.
+var profile = idna.New(idna.MapForLookup(), idna.StrictDomainName(false))
+
+// Returns the ASCII form of the name, lowercased and without surrounding whitespace and the trailing dot.
+// Names which are not valid IDNA are only lowercased.
+func Normalize(name string) string {
+	name = strings.TrimSuffix(strings.TrimSpace(name), ".")
+	if ascii, err := profile.ToASCII(name); err == nil {
+		return ascii
+	}
+	return strings.ToLower(name)
+}
+
+// Returns the Unicode form of a normalized name, or the name itself if it can not be converted.
+func ToUnicode(name string) string {
+	if u, err := profile.ToUnicode(name); err == nil {
+		return u
+	}
+	return name
+}
+
+// Returns the Unicode form of a CN which is a hostname, other CNs are returned as they are.
+func UnicodeCN(cn string) string {
+	if !IsHostname(cn) {
+		return cn
+	}
+	return ToUnicode(Normalize(cn))
+}
+
+// Reports whether the name looks like a hostname, unlike organization names in CNs or IP addresses.
+func IsHostname(name string) bool {
+	name = strings.TrimSpace(name)
+	return name != "" && !strings.ContainsAny(name, " :@/") && net.ParseIP(name) == nil
+}
+
+// Returns the domain of an email address SAN, or an empty string.
+func EmailDomain(email string) string {
+	if i := strings.LastIndexByte(email, '@'); i >= 0 && IsHostname(email[i+1:]) {
+		return Normalize(email[i+1:])
+	}
+	return ""
+}
+
+// Returns the host of a URI SAN if it is a hostname, or an empty string.
+func URIHost(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || !IsHostname(u.Hostname()) {
+		return ""
+	}
+	return Normalize(u.Hostname())
+}
+
+// Validates a domain to be monitored, given in either form, and returns its ASCII and Unicode forms.
+func ParseDomain(domain string) (ascii string, unicode string, err error) {
+	ascii, err = idna.Lookup.ToASCII(strings.TrimSuffix(strings.TrimSpace(domain), "."))
+	if err != nil {
+		return "", "", err
+	}
+	if !strings.Contains(ascii, ".") {
+		return "", "", errors.New("domain has to have at least two labels")
+	}
+
+	unicode, err = idna.Lookup.ToUnicode(ascii)
+	if err != nil {
+		return "", "", err
+	}
+	return ascii, unicode, nil
+}
+
+// Reports whether name is domain or lies below it.
+func isSubdomain(name string, domain string) bool {
+	return name == domain || strings.HasSuffix(name, "."+domain)
+}
+
+// Returns the domain without its leftmost label, or an empty string for a single label.
+func parent(domain string) string {
+	if i := strings.IndexByte(domain, '.'); i >= 0 {
+		return domain[i+1:]
+	}
+	return ""
+}
+
+// Reports whether the certificate name matches domain in the given mode.
+func Name(name string, domain string, mode Mode) bool {
+	name = Normalize(name)
+	domain = Normalize(domain)
+	if name == "" || domain == "" {
+		return false
+	}
+
+	// For a wildcard name, base is the part the wildcard is attached to
+	base := ""
+	if strings.HasPrefix(name, "*.") {
+		base = name[2:]
+	}
+
+	switch mode {
+	case Exact:
+		if base != "" {
+			return base == parent(domain)
+		}
+		return name == domain
+
+	case Subdomain, Wildcard:
+		if base != "" {
+			return isSubdomain(base, domain) || base == parent(domain)
+		}
+		return mode == Subdomain && isSubdomain(name, domain)
+	}
+
+	return false
+}
+
+// Reports whether any of the names matches the rule.
+func (r Rule) Match(names []string) bool {
+	for _, n := range names {
+		if Name(n, r.Domain, r.Mode) {
+			return true
+		}
+	}
+	return false
+}
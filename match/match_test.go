@@ -0,0 +1,111 @@
+package match
+
+import "testing"
+
+func TestRuleMatch(t *testing.T) {
+	tests := []struct {
+		domain string
+		mode   Mode
+		name   string
+		want   bool
+	}{
+		// exact
+		{"www.example.com", Exact, "www.example.com", true},
+		{"www.example.com", Exact, "WWW.Example.COM", true},
+		{"www.example.com", Exact, "www.example.com.", true},
+		{"www.example.com.", Exact, "www.example.com", true},
+		{"www.example.com", Exact, " www.example.com ", true},
+		{"www.example.com", Exact, "*.example.com", true},
+		{"www.example.com", Exact, "*.EXAMPLE.com.", true},
+		{"www.example.com", Exact, "example.com", false},
+		{"www.example.com", Exact, "a.www.example.com", false},
+		{"www.example.com", Exact, "*.www.example.com", false},
+		{"www.example.com", Exact, "badwww.example.com", false},
+		// A wildcard covers exactly one label
+		{"a.b.example.com", Exact, "*.example.com", false},
+		{"www.example.com", Exact, "*.*.example.com", false},
+		{"www.example.com", Exact, "*.com", false},
+
+		// subdomain
+		{"example.com", Subdomain, "example.com", true},
+		{"example.com", Subdomain, "Example.Com.", true},
+		{"example.com", Subdomain, "a.b.example.com", true},
+		{"example.com", Subdomain, "*.example.com", true},
+		{"example.com", Subdomain, "*.a.example.com", true},
+		{"example.com", Subdomain, "*.com", true},
+		{"example.com", Subdomain, "badexample.com", false},
+		{"example.com", Subdomain, "example.com.evil.net", false},
+		{"example.com", Subdomain, "*.evil.net", false},
+		{"example.com", Subdomain, "*.org", false},
+		{"example.com", Subdomain, "com", false},
+		{"čeština.cz", Subdomain, "xn--etina-gya30d.cz", true},
+		{"xn--etina-gya30d.cz", Subdomain, "www.čeština.cz", true},
+		{"example.com", Subdomain, "", false},
+
+		// wildcard
+		{"example.com", Wildcard, "*.example.com", true},
+		{"example.com", Wildcard, "*.A.example.com.", true},
+		{"example.com", Wildcard, "*.com", true},
+		{"example.com", Wildcard, "example.com", false},
+		{"example.com", Wildcard, "www.example.com", false},
+		{"example.com", Wildcard, "*.badexample.com", false},
+
+		{"example.com", Mode("regex"), "example.com", false},
+	}
+
+	for _, tt := range tests {
+		r := Rule{Domain: tt.domain, Mode: tt.mode}
+		if got := r.Match([]string{tt.name}); got != tt.want {
+			t.Errorf("Rule{%q, %s}.Match(%q) = %v, want %v", tt.domain, tt.mode, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRuleMatchAnyName(t *testing.T) {
+	r := Rule{Domain: "example.com", Mode: Exact}
+	if !r.Match([]string{"other.org", "example.com"}) {
+		t.Error("a rule did not match when only its second name matches")
+	}
+	if r.Match(nil) {
+		t.Error("a rule matched no names")
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Mode
+		wantErr bool
+	}{
+		{"", DefaultMode, false},
+		{"exact", Exact, false},
+		{" Subdomain ", Subdomain, false},
+		{"WILDCARD", Wildcard, false},
+		{"wildcards", "", true},
+		{"regex", "", true},
+		{"*", "", true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseMode(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseMode(%q) = %q, %v, want %q, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestUnicodeCN(t *testing.T) {
+	tests := map[string]string{
+		"xn--etina-gya30d.cz":   "čeština.cz",
+		"WWW.Example.com.":      "www.example.com",
+		"*.xn--etina-gya30d.cz": "*.čeština.cz",
+		"Example Org":           "Example Org",
+		"192.0.2.1":             "192.0.2.1",
+		"":                      "",
+	}
+	for cn, want := range tests {
+		if got := UnicodeCN(cn); got != want {
+			t.Errorf("UnicodeCN(%q) = %q, want %q", cn, got, want)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package match
+
+import "strings"
+
+// Index of monitored domains by their labels in reverse order (www.example.com -> com, example, www),
+// so the domains a name may belong to are found by walking the labels of the name from the TLD.
+// The zero value is an empty trie.
+type Trie struct {
+	root trieNode
+}
+
+type trieNode struct {
+	children map[string]*trieNode
+	// Values of the domains ending at the node
+	values []int
+}
+
+func reversedLabels(name string) []string {
+	labels := strings.Split(strings.ToLower(strings.TrimSuffix(name, ".")), ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return labels
+}
+
+// Adds the value of the domain, given in its ASCII form.
+func (t *Trie) Add(domain string, value int) {
+	node := &t.root
+	for _, label := range reversedLabels(domain) {
+		if node.children == nil {
+			node.children = make(map[string]*trieNode)
+		}
+		child, ok := node.children[label]
+		if !ok {
+			child = &trieNode{}
+			node.children[label] = child
+		}
+		node = child
+	}
+	node.values = append(node.values, value)
+}
+
+// Returns the values of the domains the name may match: the name itself, the domains it is below
+// and, for a wildcard name, the domains it covers. Whether the name really matches is decided by the Rule of the domain.
+func (t *Trie) Lookup(name string) []int {
+	var values []int
+	labels := reversedLabels(name)
+	node := &t.root
+	for i, label := range labels {
+		if label == "*" && i == len(labels)-1 {
+			for _, child := range node.children {
+				values = append(values, child.values...)
+			}
+			break
+		}
+
+		node = node.children[label]
+		if node == nil {
+			break
+		}
+		values = append(values, node.values...)
+	}
+	return values
+}
@@ -0,0 +1,52 @@
+package match
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestTrieLookup(t *testing.T) {
+	var trie Trie
+	trie.Add("example.com", 1)
+	trie.Add("www.example.com", 2)
+	trie.Add("a.b.example.com", 3)
+	trie.Add("example.org", 4)
+	trie.Add("Example.COM.", 5)
+
+	tests := []struct {
+		name string
+		want []int
+	}{
+		// exact
+		{"example.com", []int{1, 5}},
+		{"EXAMPLE.com.", []int{1, 5}},
+		{"example.org", []int{4}},
+		// subdomain
+		{"www.example.com", []int{1, 2, 5}},
+		{"x.www.example.com", []int{1, 2, 5}},
+		{"a.b.example.com", []int{1, 3, 5}},
+		// A wildcard covers the domains one label below its base, and the base is below the domains above it
+		{"*.example.com", []int{1, 2, 5}},
+		{"*.b.example.com", []int{1, 3, 5}},
+		{"*.com", []int{1, 5}},
+		// no match
+		{"example.net", nil},
+		{"badexample.com", nil},
+		{"com", nil},
+		{"b.example.org.evil", nil},
+		{"*.net", nil},
+	}
+
+	for _, tt := range tests {
+		got := trie.Lookup(tt.name)
+		slices.Sort(got)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("Lookup(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	var empty Trie
+	if got := empty.Lookup("example.com"); got != nil {
+		t.Errorf("Lookup() of an empty trie = %v", got)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	sqldb "ctlog/db"
+	"log/slog"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	metricDownloaded = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ctlog_entries_downloaded_total",
+		Help: "Entries downloaded from a log.",
+	}, []string{"log"})
+
+	metricHTTPErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ctlog_http_errors_total",
+		Help: "Failed requests to a log by HTTP status, \"none\" if no response was received.",
+	}, []string{"log", "status"})
+
+	metricRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ctlog_download_retries_total",
+		Help: "Retried get-entries requests to a log.",
+	}, []string{"log"})
+
+	metricParseErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ctlog_parse_errors_total",
+		Help: "Entries which could not be parsed, by the kind of the error.",
+	}, []string{"type"})
+
+	metricNonFatalParseErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ctlog_nonfatal_parse_errors_total",
+		Help: "Entries parsed despite malformed fields, by the kind of the entry.",
+	}, []string{"type"})
+
+	metricInsertDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "ctlog_insert_duration_seconds",
+		Help:    "Time to insert a batch of certificates into the database.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+	})
+
+	metricNotifications = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ctlog_notifications_sent_total",
+		Help: "Notification emails sent.",
+	})
+)
+
+// Channels of the running pipeline, their lengths are exported as gauges
+var queues struct {
+	sync.Mutex
+	parse  chan CTEntry
+	insert chan sqldb.CertInfo
+}
+
+func init() {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "ctlog_channel_depth",
+		Help:        "Entries waiting in a channel of the pipeline.",
+		ConstLabels: prometheus.Labels{"channel": "parse"},
+	}, func() float64 {
+		queues.Lock()
+		defer queues.Unlock()
+		return float64(len(queues.parse))
+	})
+
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "ctlog_channel_depth",
+		Help:        "Entries waiting in a channel of the pipeline.",
+		ConstLabels: prometheus.Labels{"channel": "insert"},
+	}, func() float64 {
+		queues.Lock()
+		defer queues.Unlock()
+		return float64(len(queues.insert))
+	})
+}
+
+// Makes the channels of the pipeline visible to the channel depth gauges
+func setQueues(c_parse chan CTEntry, c_insert chan sqldb.CertInfo) {
+	queues.Lock()
+	defer queues.Unlock()
+	queues.parse = c_parse
+	queues.insert = c_insert
+}
+
+// Serves the metrics on /metrics of the address in the background
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			slog.Error("Metrics server failed", "addr", addr, "err", err)
+		}
+	}()
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	sqldb "ctlog/db"
+	"ctlog/match"
+	"ctlog/verify"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// Largest accepted request body
+const API_MAX_BODY = 64 << 10
+
+// A monitor as returned by the API
+type apiMonitor struct {
+	Email     string `json:"email"`
+	Kind      string `json:"kind"`
+	Value     string `json:"value"`
+	Display   string `json:"display"`
+	Mode      string `json:"mode"`
+	Lookalike string `json:"lookalike"`
+	// False until the email confirms the monitor by the link sent there
+	Confirmed bool `json:"confirmed"`
+	// How the monitor was verified, empty until it is
+	VerifiedBy string `json:"verified_by"`
+	// Where the owner of the domain publishes the token, until the monitor is verified
+	Verification *apiVerification `json:"verification,omitempty"`
+}
+
+// Where the verification record of a domain monitor is published, in either place
+type apiVerification struct {
+	TXTName string `json:"txt_name"`
+	HTTPURL string `json:"http_url"`
+	Record  string `json:"record"`
+}
+
+// Body of monitor requests, kind and value identify the monitor
+type apiMonitorRequest struct {
+	Kind      string `json:"kind"`
+	Value     string `json:"value"`
+	Mode      string `json:"mode"`
+	Lookalike string `json:"lookalike"`
+}
+
+func toAPIMonitor(m sqldb.Monitor) apiMonitor {
+	a := apiMonitor{
+		Email:      m.Email,
+		Kind:       string(m.Kind),
+		Value:      m.Value,
+		Display:    m.Display,
+		Mode:       string(m.Mode),
+		Lookalike:  string(m.Lookalike),
+		Confirmed:  m.Confirmed,
+		VerifiedBy: string(m.VerifiedBy),
+	}
+	if m.VerifiedBy == "" && m.Kind == match.KindDomain {
+		a.Verification = &apiVerification{
+			TXTName: verify.TXTLabel + "." + m.Value,
+			HTTPURL: "http://" + m.Value + verify.WellKnownPath,
+			Record:  verify.Record(m.VerificationToken),
+		}
+	}
+	return a
+}
+
+// Registers the self-service monitor API. publicURL is the address the API is reachable at
+// in the emailed links, without it no links are sent. The verifier checks the tokens of domains.
+func handleMonitorAPI(mux *http.ServeMux, store sqldb.Store, publicURL string, verifier *verify.Verifier) {
+	mux.HandleFunc("/api/keys", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodPost) || !requirePublicURL(w, publicURL) {
+			return
+		}
+		requestAPIKey(w, r, store, publicURL+"/login")
+	})
+
+	mux.HandleFunc("/api/monitors", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodGet, http.MethodPost, http.MethodPatch, http.MethodDelete) {
+			return
+		}
+		email, ok := authenticate(w, r, store)
+		if !ok {
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			listMonitors(w, r, store, email)
+		case http.MethodPost:
+			if requirePublicURL(w, publicURL) {
+				createMonitor(w, r, store, email, publicURL+"/api/monitors/confirm")
+			}
+		case http.MethodPatch:
+			updateMonitor(w, r, store, email)
+		case http.MethodDelete:
+			deleteMonitor(w, r, store, email)
+		}
+	})
+
+	mux.HandleFunc("/api/monitors/verify", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodPost) {
+			return
+		}
+		email, ok := authenticate(w, r, store)
+		if !ok {
+			return
+		}
+		verifyMonitor(w, r, store, email, verifier)
+	})
+
+	// Opened from the confirmation email, so it is a GET without authentication
+	mux.HandleFunc("/api/monitors/confirm", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodGet) {
+			return
+		}
+		m, found, err := sqldb.ConfirmMonitor(r.Context(), r.URL.Query().Get("token"), store)
+		if err != nil {
+			slog.Error("Failed confirming monitor", "err", err)
+			writeJSONError(w, http.StatusInternalServerError, "confirmation failed")
+			return
+		}
+		if !found {
+			writeJSONError(w, http.StatusNotFound, "unknown or already used confirmation token")
+			return
+		}
+		slog.Info("Confirmed monitor", "email", m.Email, "kind", m.Kind, "value", m.Value)
+		writeJSON(w, http.StatusOK, toAPIMonitor(m))
+	})
+}
+
+// Answers 405 unless the request has one of the methods
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	return false
+}
+
+// Returns the email of the bearer API key of the request, answers 401 if there is none
+func authenticate(w http.ResponseWriter, r *http.Request, store sqldb.Store) (string, bool) {
+	key, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	email, ok, err := sqldb.Authenticate(r.Context(), strings.TrimSpace(key), store)
+	if err != nil {
+		slog.Error("Failed authenticating API key", "err", err)
+		writeJSONError(w, http.StatusInternalServerError, "authentication failed")
+		return "", false
+	}
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="ctlog"`)
+		writeJSONError(w, http.StatusUnauthorized, "missing or invalid API key")
+		return "", false
+	}
+	return email, true
+}
+
+// Answers 503 unless the public URL links are built from is configured. Links are never built from
+// the Host header, which whoever sends the request controls.
+func requirePublicURL(w http.ResponseWriter, publicURL string) bool {
+	if publicURL == "" {
+		writeJSONError(w, http.StatusServiceUnavailable, "emailed links are disabled, the server has no public URL")
+		return false
+	}
+	return true
+}
+
+// Decodes the JSON body of the request into v, answers 400 if it is not valid
+func decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, API_MAX_BODY))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// Answers POST /api/keys by sending a new API key to the email of the body, the key is only given
+// to whoever reads the email.
+func requestAPIKey(w http.ResponseWriter, r *http.Request, store sqldb.Store, loginURL string) {
+	var body struct {
+		Email string `json:"email"`
+	}
+	if !decodeBody(w, r, &body) {
+		return
+	}
+
+	if err := sqldb.IssueAPIKey(r.Context(), strings.TrimSpace(body.Email), loginURL, store); err != nil {
+		if errors.Is(err, sqldb.ErrInvalidEmail) {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		slog.Error("Failed issuing API key", "email", body.Email, "err", err)
+		writeJSONError(w, http.StatusInternalServerError, "sending the API key failed")
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "API key sent to " + body.Email})
+}
+
+func listMonitors(w http.ResponseWriter, r *http.Request, store sqldb.Store, email string) {
+	monitors, err := store.MonitorsOf(r.Context(), email)
+	if err != nil {
+		slog.Error("Failed listing monitors", "email", email, "err", err)
+		writeJSONError(w, http.StatusInternalServerError, "listing monitors failed")
+		return
+	}
+
+	list := make([]apiMonitor, 0, len(monitors))
+	for _, m := range monitors {
+		list = append(list, toAPIMonitor(m))
+	}
+	writeJSON(w, http.StatusOK, map[string][]apiMonitor{"monitors": list})
+}
+
+// Parses the kind of the request, the mode and lookalike sensitivity are given defaults if they are required
+func parseMonitorRequest(req apiMonitorRequest, defaults bool) (match.Kind, match.Mode, match.Sensitivity, error) {
+	kind, err := match.ParseKind(req.Kind)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	var mode match.Mode
+	if req.Mode != "" {
+		if mode, err = match.ParseMode(req.Mode); err != nil {
+			return "", "", "", err
+		}
+	} else if defaults {
+		mode = match.DefaultMode
+	}
+
+	var lookalike match.Sensitivity
+	if req.Lookalike != "" {
+		if lookalike, err = match.ParseSensitivity(req.Lookalike); err != nil {
+			return "", "", "", err
+		}
+	} else if defaults {
+		lookalike = match.Off
+	}
+	return kind, mode, lookalike, nil
+}
+
+// Answers POST /api/monitors. A new monitor waits for the confirmation of the email and is answered with 202.
+func createMonitor(w http.ResponseWriter, r *http.Request, store sqldb.Store, email string, confirmURL string) {
+	var req apiMonitorRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	kind, mode, lookalike, err := parseMonitorRequest(req, true)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	m, err := sqldb.RequestMonitor(r.Context(), email, kind, req.Value, mode, lookalike, confirmURL, store)
+	if err != nil {
+		writeMonitorError(w, email, err)
+		return
+	}
+
+	status := http.StatusOK
+	if !m.Confirmed {
+		slog.Info("Requested monitor", "email", email, "kind", kind, "value", m.Value)
+		status = http.StatusAccepted
+	}
+	writeJSON(w, status, toAPIMonitor(m))
+}
+
+// Answers PATCH /api/monitors, the mode and lookalike sensitivity left out are kept
+func updateMonitor(w http.ResponseWriter, r *http.Request, store sqldb.Store, email string) {
+	var req apiMonitorRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	kind, mode, lookalike, err := parseMonitorRequest(req, false)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	m, err := sqldb.UpdateMonitor(r.Context(), email, kind, req.Value, mode, lookalike, store)
+	if err != nil {
+		writeMonitorError(w, email, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, toAPIMonitor(m))
+}
+
+// Answers POST /api/monitors/verify by checking the verification record of the domain of the monitor,
+// 422 if it is not published
+func verifyMonitor(w http.ResponseWriter, r *http.Request, store sqldb.Store, email string, verifier *verify.Verifier) {
+	var req apiMonitorRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	kind, err := match.ParseKind(req.Kind)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	m, err := sqldb.VerifyMonitor(r.Context(), email, kind, req.Value, verifier, store)
+	if err != nil {
+		if errors.Is(err, verify.ErrNotVerified) {
+			writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		writeMonitorError(w, email, err)
+		return
+	}
+	slog.Info("Verified monitor", "email", email, "kind", kind, "value", m.Value, "method", m.VerifiedBy)
+	writeJSON(w, http.StatusOK, toAPIMonitor(m))
+}
+
+// Answers DELETE /api/monitors?kind=...&value=...
+func deleteMonitor(w http.ResponseWriter, r *http.Request, store sqldb.Store, email string) {
+	kind, err := match.ParseKind(r.URL.Query().Get("kind"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := sqldb.RemoveMonitor(r.Context(), email, kind, r.URL.Query().Get("value"), store); err != nil {
+		writeMonitorError(w, email, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Answers a failed change of a monitor: 404 if it does not exist, 400 if it is not valid, 500 otherwise
+func writeMonitorError(w http.ResponseWriter, email string, err error) {
+	switch {
+	case errors.Is(err, sqldb.ErrNoMonitor):
+		writeJSONError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, sqldb.ErrInvalidMonitor):
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+	default:
+		slog.Error("Failed changing monitor", "email", email, "err", err)
+		writeJSONError(w, http.StatusInternalServerError, "changing the monitor failed")
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	sqldb "ctlog/db"
+	"ctlog/verify"
+	"errors"
+	"io"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+const testPublicURL = "https://ctlog.example"
+
+// Replaces sendmail by a script which keeps the emails in a directory. Returns a function which
+// takes the decoded bodies of the emails sent since it was called last.
+func testMailbox(t *testing.T) func() []string {
+	t.Helper()
+	dir := t.TempDir()
+	script := filepath.Join(dir, "sendmail")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\ncat > \"$(mktemp "+dir+"/mail.XXXXXX)\"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	sendmail := sqldb.Sendmail
+	sqldb.Sendmail = script
+	t.Cleanup(func() { sqldb.Sendmail = sendmail })
+
+	return func() []string {
+		t.Helper()
+		files, err := filepath.Glob(filepath.Join(dir, "mail.*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var bodies []string
+		for _, f := range files {
+			raw, err := os.ReadFile(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			os.Remove(f)
+			msg, err := mail.ReadMessage(bytes.NewReader(raw))
+			if err != nil {
+				t.Fatal(err)
+			}
+			body := msg.Body
+			if strings.EqualFold(msg.Header.Get("Content-Transfer-Encoding"), "quoted-printable") {
+				body = quotedprintable.NewReader(body)
+			}
+			b, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bodies = append(bodies, string(b))
+		}
+		return bodies
+	}
+}
+
+// Returns the token following the prefix in the only email sent
+func tokenInMail(t *testing.T, mails []string, prefix string) string {
+	t.Helper()
+	if len(mails) != 1 {
+		t.Fatalf("%d emails sent, want 1", len(mails))
+	}
+	m := regexp.MustCompile(regexp.QuoteMeta(prefix) + `([A-Za-z0-9_-]+)`).FindStringSubmatch(mails[0])
+	if m == nil {
+		t.Fatalf("no %q in the email %q", prefix, mails[0])
+	}
+	return m[1]
+}
+
+// Returns a request of the API key with the JSON body
+func apiRequest(method string, target string, key string, body string) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if key != "" {
+		r.Header.Set("Authorization", "Bearer "+key)
+	}
+	return r
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// Returns a verifier which resolves nothing and finds the record served by HTTP, if there is one
+func testVerifier(record *string) *verify.Verifier {
+	return &verify.Verifier{
+		Resolver: &net.Resolver{PreferGo: true, Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return nil, errors.New("no DNS in tests")
+		}},
+		Client: &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			w := httptest.NewRecorder()
+			if *record == "" {
+				http.NotFound(w, r)
+			} else {
+				w.WriteString(*record + "\n")
+			}
+			return w.Result(), nil
+		})},
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	store := newTestStore(t)
+	mails := testMailbox(t)
+
+	h := apiHandler(store, "", &verify.Verifier{}, nil)
+	if code := serveTestRequest(t, h, apiRequest(http.MethodPost, "/api/keys", "", `{"email": "user@example.com"}`), nil); code != http.StatusServiceUnavailable {
+		t.Errorf("without a public URL: %d, want %d", code, http.StatusServiceUnavailable)
+	}
+
+	h = apiHandler(store, testPublicURL, &verify.Verifier{}, nil)
+	if code := serveTestRequest(t, h, apiRequest(http.MethodGet, "/api/keys", "", ""), nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: %d, want %d", code, http.StatusMethodNotAllowed)
+	}
+	if code := serveTestRequest(t, h, apiRequest(http.MethodPost, "/api/keys", "", `{"email": "not an email"}`), nil); code != http.StatusBadRequest {
+		t.Errorf("invalid email: %d, want %d", code, http.StatusBadRequest)
+	}
+	if code := serveTestRequest(t, h, apiRequest(http.MethodPost, "/api/keys", "", `{"email": "user@example.com", "admin": true}`), nil); code != http.StatusBadRequest {
+		t.Errorf("unknown field: %d, want %d", code, http.StatusBadRequest)
+	}
+	if len(mails()) != 0 {
+		t.Error("refused requests sent emails")
+	}
+
+	if code := serveTestRequest(t, h, apiRequest(http.MethodPost, "/api/keys", "", `{"email": "user@example.com"}`), nil); code != http.StatusAccepted {
+		t.Fatalf("POST /api/keys: %d, want %d", code, http.StatusAccepted)
+	}
+	sent := mails()
+	key := tokenInMail(t, sent, "Authorization: Bearer ")
+	if strings.Contains(sent[0], "token="+key) {
+		t.Error("the sign-in link carries the API key")
+	}
+	var list map[string][]apiMonitor
+	if code := serveTestRequest(t, h, apiRequest(http.MethodGet, "/api/monitors", key, ""), &list); code != http.StatusOK {
+		t.Errorf("GET /api/monitors with the emailed key: %d, want %d", code, http.StatusOK)
+	}
+}
+
+func TestMonitorAPI(t *testing.T) {
+	store := newTestStore(t)
+	mails := testMailbox(t)
+	var record string
+	h := apiHandler(store, testPublicURL, testVerifier(&record), nil)
+	saveTestKey(t, store, "key", "user@example.com")
+	saveTestKey(t, store, "other", "other@example.org")
+
+	if code := serveTestRequest(t, h, apiRequest(http.MethodGet, "/api/monitors", "", ""), nil); code != http.StatusUnauthorized {
+		t.Errorf("without a key: %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := serveTestRequest(t, h, apiRequest(http.MethodPost, "/api/monitors", "key", `{"kind": "domain", "value": "example.com", "mode": "regex"}`), nil); code != http.StatusBadRequest {
+		t.Errorf("invalid mode: %d, want %d", code, http.StatusBadRequest)
+	}
+	if code := serveTestRequest(t, h, apiRequest(http.MethodPost, "/api/monitors", "key", `{"kind": "domain", "value": "not a domain"}`), nil); code != http.StatusBadRequest {
+		t.Errorf("invalid domain: %d, want %d", code, http.StatusBadRequest)
+	}
+
+	// A new monitor waits for the confirmation and the verification
+	var m apiMonitor
+	if code := serveTestRequest(t, h, apiRequest(http.MethodPost, "/api/monitors", "key", `{"kind": "domain", "value": "Example.COM"}`), &m); code != http.StatusAccepted {
+		t.Fatalf("POST /api/monitors: %d, want %d", code, http.StatusAccepted)
+	}
+	if m.Value != "example.com" || m.Mode != "subdomain" || m.Lookalike != "off" || m.Confirmed || m.VerifiedBy != "" || m.Verification == nil {
+		t.Errorf("created monitor %+v", m)
+	}
+	confirmation := tokenInMail(t, mails(), "/api/monitors/confirm?token=")
+
+	if code := serveTestRequest(t, h, apiRequest(http.MethodGet, "/api/monitors/confirm?token=wrong", "", ""), nil); code != http.StatusNotFound {
+		t.Errorf("wrong confirmation token: %d, want %d", code, http.StatusNotFound)
+	}
+	if code := serveTestRequest(t, h, apiRequest(http.MethodGet, "/api/monitors/confirm?token="+confirmation, "", ""), &m); code != http.StatusOK || !m.Confirmed {
+		t.Errorf("confirmation: %d, %+v", code, m)
+	}
+	if code := serveTestRequest(t, h, apiRequest(http.MethodGet, "/api/monitors/confirm?token="+confirmation, "", ""), nil); code != http.StatusNotFound {
+		t.Errorf("used confirmation token: %d, want %d", code, http.StatusNotFound)
+	}
+
+	// Only the owner of the domain publishes the record
+	verifyBody := `{"kind": "domain", "value": "example.com"}`
+	if code := serveTestRequest(t, h, apiRequest(http.MethodPost, "/api/monitors/verify", "key", verifyBody), nil); code != http.StatusUnprocessableEntity {
+		t.Errorf("unpublished record: %d, want %d", code, http.StatusUnprocessableEntity)
+	}
+	if code := serveTestRequest(t, h, apiRequest(http.MethodPost, "/api/monitors/verify", "other", verifyBody), nil); code != http.StatusNotFound {
+		t.Errorf("monitor of another email: %d, want %d", code, http.StatusNotFound)
+	}
+	record = m.Verification.Record
+	if code := serveTestRequest(t, h, apiRequest(http.MethodPost, "/api/monitors/verify", "key", verifyBody), &m); code != http.StatusOK || m.VerifiedBy != string(verify.HTTP) {
+		t.Errorf("published record: %d, %+v", code, m)
+	}
+
+	if code := serveTestRequest(t, h, apiRequest(http.MethodPatch, "/api/monitors", "key", `{"kind": "domain", "value": "example.com", "lookalike": "high"}`), &m); code != http.StatusOK {
+		t.Errorf("PATCH /api/monitors: %d, want %d", code, http.StatusOK)
+	}
+	if m.Mode != "subdomain" || m.Lookalike != "high" || !m.Confirmed || m.VerifiedBy == "" {
+		t.Errorf("updated monitor %+v", m)
+	}
+	if code := serveTestRequest(t, h, apiRequest(http.MethodPatch, "/api/monitors", "other", `{"kind": "domain", "value": "example.com", "mode": "exact"}`), nil); code != http.StatusNotFound {
+		t.Errorf("PATCH of another email: %d, want %d", code, http.StatusNotFound)
+	}
+
+	var list map[string][]apiMonitor
+	if code := serveTestRequest(t, h, apiRequest(http.MethodGet, "/api/monitors", "key", ""), &list); code != http.StatusOK || len(list["monitors"]) != 1 {
+		t.Errorf("GET /api/monitors: %d, %+v", code, list)
+	}
+	if code := serveTestRequest(t, h, apiRequest(http.MethodGet, "/api/monitors", "other", ""), &list); code != http.StatusOK || len(list["monitors"]) != 0 {
+		t.Errorf("GET /api/monitors of another email: %d, %+v", code, list)
+	}
+
+	if code := serveTestRequest(t, h, apiRequest(http.MethodDelete, "/api/monitors?kind=domain&value=example.com", "other", ""), nil); code != http.StatusNotFound {
+		t.Errorf("DELETE of another email: %d, want %d", code, http.StatusNotFound)
+	}
+	if code := serveTestRequest(t, h, apiRequest(http.MethodDelete, "/api/monitors?kind=domain&value=example.com", "key", ""), nil); code != http.StatusNoContent {
+		t.Errorf("DELETE /api/monitors: %d, want %d", code, http.StatusNoContent)
+	}
+	if code := serveTestRequest(t, h, apiRequest(http.MethodDelete, "/api/monitors?kind=domain&value=example.com", "key", ""), nil); code != http.StatusNotFound {
+		t.Errorf("DELETE of a removed monitor: %d, want %d", code, http.StatusNotFound)
+	}
+}
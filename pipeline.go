@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	sqldb "ctlog/db"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// Downloads, parses and inserts the entries of a run.
+//
+// Downloaders of each log feed the parse channel, parsers match the certificates against the monitors and,
+// when the downloaded certificates are kept for a dump, feed the insert channel and inserters write it to
+// the database in batches. Cancelling the context only stops the downloads, the queued entries are
+// still parsed and inserted. A failing parser or inserter stops the whole pipeline and its error
+// is returned by Wait, a log whose entries could not be downloaded only records the error in its stats.
+type Pipeline struct {
+	store   sqldb.Store
+	matcher *sqldb.Matcher
+	logger  *slog.Logger
+	// Whether every parsed certificate is written to Downloaded
+	keepDownloaded bool
+
+	parse  chan CTEntry
+	insert chan sqldb.CertInfo
+
+	// Stats of the downloaded logs, fixed when the pipeline is created
+	logs map[string]*logStats
+
+	// Downloads stop when the run is stopped or the workers fail
+	downloadCtx    context.Context
+	cancelDownload context.CancelFunc
+	downloaders    errgroup.Group
+
+	// Parsers and the inserter, their context is cancelled by the first error
+	workerCtx context.Context
+	workers   *errgroup.Group
+
+	started  time.Time
+	parsed   int64
+	matched  int64
+	inserted int64
+
+	// Quarantined entries which parsed, they are released once their matches are saved
+	mu       sync.Mutex
+	released []sqldb.QuarantinedEntry
+}
+
+// Creates a pipeline and starts downloading the entries between the old and new heads of the logs.
+// Without any logs, entries are given to the pipeline by Queue. Matched certificates are kept by the matcher,
+// inserters are only started if the downloaded certificates are kept.
+func NewPipeline(ctx context.Context, logInfos map[string]sqldb.CTLogInfo, logger *slog.Logger, store sqldb.Store,
+	matcher *sqldb.Matcher, keepDownloaded bool) *Pipeline {
+	p := &Pipeline{
+		store:          store,
+		matcher:        matcher,
+		logger:         logger,
+		keepDownloaded: keepDownloaded,
+		parse:          make(chan CTEntry, PARSE_BUFFER_SIZE),
+		insert:         make(chan sqldb.CertInfo, INSERT_BUFFER_SIZE),
+		logs:           make(map[string]*logStats),
+		started:        time.Now(),
+	}
+	for url := range logInfos {
+		p.logs[url] = &logStats{}
+	}
+	setQueues(p.parse, p.insert)
+
+	// The workers outlive a stopped run to process what was downloaded
+	workers, workerCtx := errgroup.WithContext(context.WithoutCancel(ctx))
+	p.workerCtx = workerCtx
+	p.downloadCtx, p.cancelDownload = context.WithCancel(ctx)
+	context.AfterFunc(workerCtx, p.cancelDownload)
+
+	p.workers = workers
+
+	// The insert channel is closed once all parsers are done
+	var parsers sync.WaitGroup
+	parsers.Add(PARSER_COUNT)
+	for i := 0; i < PARSER_COUNT; i++ {
+		p.workers.Go(func() error {
+			defer parsers.Done()
+			return p.parser()
+		})
+	}
+	p.workers.Go(func() error {
+		parsers.Wait()
+		p.logger.Info("Finished parsing")
+		close(p.insert)
+		return nil
+	})
+	if keepDownloaded {
+		for i := 0; i < INSERTER_COUNT; i++ {
+			p.workers.Go(p.inserter)
+		}
+	}
+
+	for url, info := range logInfos {
+		url, info := url, info
+		p.downloaders.Go(func() error {
+			p.downloadLog(url, info.OldHeadIndex, info.NewHeadIndex, DOWNLOADER_COUNT)
+			return nil
+		})
+	}
+
+	return p
+}
+
+// Queues an entry for parsing, returns false once the downloads are stopped. Entries are queued before Wait is called.
+func (p *Pipeline) Queue(e CTEntry) bool {
+	// A select with room in the channel could still pick the send
+	if p.downloadCtx.Err() != nil {
+		return false
+	}
+	select {
+	case p.parse <- e:
+		return true
+	case <-p.downloadCtx.Done():
+		return false
+	}
+}
+
+// Waits for the downloads to finish, then for the queued entries to be parsed, matched and inserted.
+// Returns the first error of a parser or the inserter.
+func (p *Pipeline) Wait() error {
+	p.downloaders.Wait()
+	p.logger.Info("Finished downloading", "duration", time.Since(p.started))
+	close(p.parse)
+
+	err := p.workers.Wait()
+	p.cancelDownload()
+	return err
+}
+
+// Returns the stats of a downloaded log
+func (p *Pipeline) Log(url string) *logStats {
+	return p.logs[url]
+}
+
+// Returns the number of certificates parsed, matched and inserted
+func (p *Pipeline) Counts() (int64, int64, int64) {
+	return atomic.LoadInt64(&p.parsed), atomic.LoadInt64(&p.matched), atomic.LoadInt64(&p.inserted)
+}
+
+// Returns the log and index of the quarantined entries which parsed
+func (p *Pipeline) ParsedQuarantined() []sqldb.QuarantinedEntry {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.released
+}
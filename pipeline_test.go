@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	ct "ctlog/ct"
+	sqldb "ctlog/db"
+	"ctlog/match"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	ct_tls "github.com/google/certificate-transparency-go/tls"
+)
+
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// Returns a migrated SQLite store which is removed with the test
+func newTestStore(t *testing.T) sqldb.Store {
+	t.Helper()
+	ctx := context.Background()
+	store, err := sqldb.OpenSQLite(ctx, t.TempDir()+"/ctlog.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	if err := store.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// Returns a log entry of a new self-signed certificate of the names
+func testEntry(t *testing.T, serial int64, names ...string) CTEntry {
+	t.Helper()
+	return testEntryOf(t, &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+	})
+}
+
+// Returns a log entry of a new self-signed certificate of the template
+func testEntryOf(t *testing.T, template *x509.Certificate) CTEntry {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := ct_tls.Marshal(ct.MerkleTreeLeaf{
+		Version:  ct.V1,
+		LeafType: ct.TimestampedEntryLeafType,
+		TimestampedEntry: &ct.TimestampedEntry{
+			Timestamp: uint64(time.Now().UnixMilli()),
+			EntryType: ct.X509LogEntryType,
+			X509Entry: &ct.ASN1Cert{Data: der},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return CTEntry{LeafInput: leaf, ExtraData: []byte{}}
+}
+
+// Returns a matcher of a monitor of example.com
+func testMatcher(t *testing.T, store sqldb.Store) *sqldb.Matcher {
+	t.Helper()
+	ctx := context.Background()
+	if err := sqldb.AddMonitor(ctx, "user@example.com", match.KindDomain, []string{"example.com"}, match.DefaultMode, match.Off, store); err != nil {
+		t.Fatal(err)
+	}
+	matcher, err := sqldb.LoadMatcher(ctx, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return matcher
+}
+
+// Serves get-entries of the entries like a CT log, at most two entries per request
+func testLog(t *testing.T, entries []CTEntry) string {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start, err := strconv.Atoi(r.URL.Query().Get("start"))
+		if r.URL.Path != "/ct/v1/get-entries" || err != nil || start < 0 || start >= len(entries) {
+			http.Error(w, `{"error_message": "bad request", "success": false}`, http.StatusBadRequest)
+			return
+		}
+		end := start + 2
+		if end > len(entries) {
+			end = len(entries)
+		}
+		json.NewEncoder(w).Encode(CTEntries{Entries: entries[start:end]})
+	}))
+	t.Cleanup(server.Close)
+	CreateClient()
+	return server.URL + "/"
+}
+
+// A store whose inserters fail
+type failingInserterStore struct {
+	sqldb.Store
+}
+
+var errInsert = errors.New("insert failed")
+
+func (failingInserterStore) NewInserter(ctx context.Context) (sqldb.Inserter, error) {
+	return nil, errInsert
+}
+
+func TestPipelineQueue(t *testing.T) {
+	store := newTestStore(t)
+	p := NewPipeline(context.Background(), nil, discardLogger, store, testMatcher(t, store), true)
+
+	entries := []CTEntry{
+		testEntry(t, 1, "www.example.com"),
+		testEntry(t, 2, "example.com"),
+		testEntry(t, 3, "other.org"),
+		{LeafInput: []byte("not a leaf"), ExtraData: []byte{}, LogUrl: "https://log.example/", Index: 7},
+	}
+	for _, e := range entries {
+		if !p.Queue(e) {
+			t.Fatal("Queue refused an entry of a running pipeline")
+		}
+	}
+	if err := p.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, matched, inserted := p.Counts()
+	if parsed != 3 || matched != 2 || inserted != 3 {
+		t.Errorf("parsed, matched, inserted = %d, %d, %d, want 3, 2, 3", parsed, matched, inserted)
+	}
+	quarantined, err := store.LoadQuarantine(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(quarantined) != 1 || quarantined[0].Index != 7 {
+		t.Errorf("quarantined %+v, want the entry of index 7", quarantined)
+	}
+}
+
+func TestPipelineCancel(t *testing.T) {
+	store := newTestStore(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	p := NewPipeline(ctx, nil, discardLogger, store, testMatcher(t, store), false)
+
+	for i := int64(1); i <= 5; i++ {
+		if !p.Queue(testEntry(t, i, "example.com")) {
+			t.Fatal("Queue refused an entry before the cancellation")
+		}
+	}
+	cancel()
+	if p.Queue(testEntry(t, 6, "example.com")) {
+		t.Error("Queue accepted an entry after the cancellation")
+	}
+
+	// Entries queued before the cancellation are still processed
+	if err := p.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if parsed, matched, _ := p.Counts(); parsed != 5 || matched != 5 {
+		t.Errorf("parsed, matched = %d, %d, want 5, 5", parsed, matched)
+	}
+}
+
+func TestPipelineDownload(t *testing.T) {
+	store := newTestStore(t)
+	entries := []CTEntry{testEntry(t, 1, "a.example.com"), testEntry(t, 2, "b.example.com"), testEntry(t, 3, "c.other.org")}
+	url := testLog(t, entries)
+
+	started := time.Now()
+	p := NewPipeline(context.Background(), map[string]sqldb.CTLogInfo{url: {OldHeadIndex: -1, NewHeadIndex: 2}},
+		discardLogger, store, testMatcher(t, store), false)
+	if err := p.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	// A small range is one batch, started without spacing, which pauses only between its two requests
+	if took := time.Since(started); took > 1900*time.Millisecond {
+		t.Errorf("downloading 3 entries took %s", took)
+	}
+
+	st := p.Log(url)
+	if head := st.completedHead(-1); head != 2 || st.downloaded != 3 || st.err != nil {
+		t.Errorf("completed head %d, downloaded %d, err %v, want 2, 3, nil", head, st.downloaded, st.err)
+	}
+	if parsed, matched, _ := p.Counts(); parsed != 3 || matched != 2 {
+		t.Errorf("parsed, matched = %d, %d, want 3, 2", parsed, matched)
+	}
+}
+
+func TestPipelineShutdownOnInserterFailure(t *testing.T) {
+	store := failingInserterStore{newTestStore(t)}
+	p := NewPipeline(context.Background(), nil, discardLogger, store, testMatcher(t, store), true)
+
+	// More entries than the channels hold, Queue stops accepting them once the inserters failed
+	entry := testEntry(t, 1, "example.com")
+	for i := 0; i < INSERT_BUFFER_SIZE+PARSE_BUFFER_SIZE+PARSER_COUNT+1; i++ {
+		if !p.Queue(entry) {
+			break
+		}
+	}
+
+	done := make(chan error)
+	go func() { done <- p.Wait() }()
+	select {
+	case err := <-done:
+		if !errors.Is(err, errInsert) {
+			t.Errorf("Wait() = %v, want %v", err, errInsert)
+		}
+	case <-time.After(time.Minute):
+		t.Fatal("pipeline did not shut down after the inserters failed")
+	}
+	if p.Queue(testEntry(t, 2, "example.com")) {
+		t.Error("Queue accepted an entry after the pipeline failed")
+	}
+}
+
+func TestProcessFinishesFailedRun(t *testing.T) {
+	ctx := context.Background()
+	store := failingInserterStore{newTestStore(t)}
+	url := testLog(t, []CTEntry{testEntry(t, 1, "example.com")})
+	testMatcher(t, store)
+
+	unsubscriber, err := sqldb.NewUnsubscriber(ctx, store, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = process(ctx, map[string]sqldb.CTLogInfo{url: {OldHeadIndex: -1, NewHeadIndex: 0}}, true, store, unsubscriber)
+	if !errors.Is(err, errInsert) {
+		t.Fatalf("process() = %v, want %v", err, errInsert)
+	}
+
+	runs, err := store.ListRuns(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 1 || runs[0].Status != sqldb.RunFailed || runs[0].FinishedAt == nil {
+		t.Fatalf("runs %+v, want one finished failed run", runs)
+	}
+	_, logs, err := store.GetRun(ctx, runs[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 1 || logs[0].Status != sqldb.LogFailed || logs[0].CompletedHeadIndex != -1 {
+		t.Errorf("logs %+v, want the log failed at its old head", logs)
+	}
+}
+
+// A store which fails saving matched certificates
+type failingSaveStore struct {
+	sqldb.Store
+}
+
+var errSave = errors.New("save failed")
+
+func (failingSaveStore) SaveMatches(ctx context.Context, matches []sqldb.Match) (int, error) {
+	return 0, errSave
+}
+
+func TestReprocessKeepsEntriesUntilSaved(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	testMailbox(t)
+	testMatcher(t, store)
+	entry := testEntry(t, 1, "www.example.com")
+	err := store.QuarantineEntry(ctx, sqldb.QuarantinedEntry{LogUrl: "https://log.example/", Index: 3, LeafInput: entry.LeafInput, Error: "earlier failure"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := reprocess(ctx, failingSaveStore{store}, nil); !errors.Is(err, errSave) {
+		t.Fatalf("reprocess() = %v, want %v", err, errSave)
+	}
+	if quarantined, err := store.LoadQuarantine(ctx); err != nil || len(quarantined) != 1 {
+		t.Fatalf("quarantine after a failed save %+v, %v, want the entry kept", quarantined, err)
+	}
+
+	if err := reprocess(ctx, store, nil); err != nil {
+		t.Fatal(err)
+	}
+	if quarantined, err := store.LoadQuarantine(ctx); err != nil || len(quarantined) != 0 {
+		t.Errorf("quarantine after reprocessing %+v, %v, want it empty", quarantined, err)
+	}
+	certs, err := store.SearchCertificates(ctx, sqldb.CertificateQuery{Limit: 10})
+	if err != nil || len(certs) != 1 {
+		t.Errorf("saved certificates %+v, %v, want the match", certs, err)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+)
+
+// The signal which stopped the process, if any
+var stopSignal atomic.Value
+
+// Returns a context cancelled by the first SIGINT or SIGTERM. Downloads stop, what was downloaded
+// is still processed. A second signal kills the process.
+func shutdownContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-c
+		stopSignal.Store(sig)
+		signal.Reset(syscall.SIGINT, syscall.SIGTERM)
+		slog.Warn("Stopping, processing what was downloaded, signal again to kill", "signal", sig)
+		cancel()
+	}()
+
+	return ctx
+}
+
+// Returns the signal which stopped the process, nil if none did
+func stopped() os.Signal {
+	sig, _ := stopSignal.Load().(os.Signal)
+	return sig
+}
+
+// Returns 128 plus the number of the signal which stopped the process, as a shell reports it, otherwise 1
+func exitStatus() int {
+	if sig, ok := stopped().(syscall.Signal); ok {
+		return 128 + int(sig)
+	}
+	return 1
+}
@@ -0,0 +1,180 @@
+// Package verify checks that whoever monitors a domain controls it, by a token they publish for the domain.
+//
+// The record "ctlog-verification=<token>" is published in either of
+//
+//	dns  - a TXT record of _ctlog-challenge.<domain>
+//	http - a line of http://<domain>/.well-known/ctlog-verification, redirects are only followed within the domain
+//
+// Whoever requests the verification picks the domain, so the HTTP check never connects to loopback, private,
+// link-local or other non-public addresses, and the reasons a check failed are only logged, never returned.
+// Monitors can also be verified by an administrator, which is recorded as the method admin.
+package verify
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// How a monitor was verified
+type Method string
+
+const (
+	DNS   Method = "dns"
+	HTTP  Method = "http"
+	Admin Method = "admin"
+)
+
+// Name below the domain whose TXT records are checked
+const TXTLabel = "_ctlog-challenge"
+
+// Path of the file checked on the domain
+const WellKnownPath = "/.well-known/ctlog-verification"
+
+// Largest well-known file read
+const maxFileSize = 64 << 10
+
+// Most redirects followed within the domain
+const maxRedirects = 5
+
+// Timeout of the default HTTP client
+const httpTimeout = 10 * time.Second
+
+// Returned when the token is published neither in DNS nor over HTTP
+var ErrNotVerified = errors.New("domain not verified")
+
+// Returns the record the token is published as.
+func Record(token string) string {
+	return "ctlog-verification=" + token
+}
+
+// Looks up the token of a domain. The zero value uses the default resolver and an HTTP client with
+// a 10 second timeout which only connects to public addresses, tests point them at stub servers.
+type Verifier struct {
+	Resolver *net.Resolver
+	Client   *http.Client
+}
+
+// Checks DNS first, then HTTP, and returns the method the token was found by.
+// A token found by neither gives an error wrapping ErrNotVerified, the reason of each is logged.
+func (v *Verifier) Check(ctx context.Context, domain string, token string) (Method, error) {
+	if token == "" {
+		return "", fmt.Errorf("%w: no token", ErrNotVerified)
+	}
+
+	dnsErr := v.checkDNS(ctx, domain, token)
+	if dnsErr == nil {
+		return DNS, nil
+	}
+	httpErr := v.checkHTTP(ctx, domain, token)
+	if httpErr == nil {
+		return HTTP, nil
+	}
+	slog.Info("Domain not verified", "domain", domain, "dns_err", dnsErr, "http_err", httpErr)
+	return "", fmt.Errorf("%w: the record was found neither in the TXT records of %s nor in %s",
+		ErrNotVerified, TXTLabel+"."+domain, "http://"+domain+WellKnownPath)
+}
+
+// Refuses connections to addresses which are not public, checked on the address actually dialed,
+// so names resolving to internal addresses, or changing to them, are refused too
+func publicOnly(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isPublic(ip) {
+		return fmt.Errorf("refusing to connect to the non-public address %s", host)
+	}
+	return nil
+}
+
+// Shared address space of carrier-grade NAT, not covered by net.IP.IsPrivate
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+func isPublic(ip net.IP) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !sharedAddressSpace.Contains(ip)
+}
+
+// Returns the client used without one given, which only connects to public addresses
+func (v *Verifier) defaultClient() *http.Client {
+	dialer := &net.Dialer{Timeout: httpTimeout, Resolver: v.Resolver, Control: publicOnly}
+	return &http.Client{
+		Timeout:   httpTimeout,
+		Transport: &http.Transport{DialContext: dialer.DialContext},
+	}
+}
+
+// Returns the policy which only follows redirects to the domain or below it on the default port
+func redirectPolicy(domain string) func(*http.Request, []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxRedirects {
+			return errors.New("too many redirects")
+		}
+		host := strings.ToLower(req.URL.Hostname())
+		if (host != domain && !strings.HasSuffix(host, "."+domain)) || req.URL.Port() != "" {
+			return fmt.Errorf("refusing to follow a redirect to %s off the domain", req.URL.Host)
+		}
+		return nil
+	}
+}
+
+func (v *Verifier) checkDNS(ctx context.Context, domain string, token string) error {
+	resolver := v.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	records, err := resolver.LookupTXT(ctx, TXTLabel+"."+domain)
+	if err != nil {
+		return err
+	}
+	for _, r := range records {
+		if strings.TrimSpace(r) == Record(token) {
+			return nil
+		}
+	}
+	return errors.New("no TXT record with the token")
+}
+
+func (v *Verifier) checkHTTP(ctx context.Context, domain string, token string) error {
+	client := v.Client
+	if client == nil {
+		client = v.defaultClient()
+	}
+	// A copy, the redirect policy depends on the domain
+	c := *client
+	c.CheckRedirect = redirectPolicy(domain)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+domain+WellKnownPath, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	scanner := bufio.NewScanner(io.LimitReader(resp.Body, maxFileSize))
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == Record(token) {
+			return nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return errors.New("no line with the token")
+}
@@ -0,0 +1,227 @@
+package verify
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const testToken = "abc123"
+
+// Serves the TXT records and IPv4 addresses of the names over UDP, names are fully qualified
+// and lowercase. Returns a resolver which asks only the stub.
+func stubResolver(t *testing.T, txt map[string][]string, a map[string]net.IP) *net.Resolver {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var p dnsmessage.Parser
+			header, err := p.Start(buf[:n])
+			if err != nil {
+				continue
+			}
+			q, err := p.Question()
+			if err != nil {
+				continue
+			}
+
+			name := strings.ToLower(q.Name.String())
+			_, hasTXT := txt[name]
+			_, hasA := a[name]
+			rcode := dnsmessage.RCodeSuccess
+			if !hasTXT && !hasA {
+				rcode = dnsmessage.RCodeNameError
+			}
+			b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: header.ID, Response: true, Authoritative: true, RCode: rcode})
+			b.EnableCompression()
+			b.StartQuestions()
+			b.Question(q)
+			b.StartAnswers()
+			rh := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60}
+			switch q.Type {
+			case dnsmessage.TypeTXT:
+				for _, r := range txt[name] {
+					b.TXTResource(rh, dnsmessage.TXTResource{TXT: []string{r}})
+				}
+			case dnsmessage.TypeA:
+				if ip := a[name].To4(); ip != nil {
+					var res dnsmessage.AResource
+					copy(res.A[:], ip)
+					b.AResource(rh, res)
+				}
+			}
+			msg, err := b.Finish()
+			if err != nil {
+				continue
+			}
+			conn.WriteTo(msg, addr)
+		}
+	}()
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "udp", conn.LocalAddr().String())
+		},
+	}
+}
+
+// Returns a client which connects to the server whatever the address asked for
+func stubClient(server *httptest.Server) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server.Listener.Addr().String())
+		},
+	}}
+}
+
+// Resolves nothing, so the DNS check fails
+func emptyResolver(t *testing.T) *net.Resolver {
+	return stubResolver(t, nil, nil)
+}
+
+func TestCheckDNS(t *testing.T) {
+	resolver := stubResolver(t, map[string][]string{
+		"_ctlog-challenge.example.com.": {"other=record", " " + Record(testToken) + " "},
+		"_ctlog-challenge.example.org.": {Record("other")},
+	}, nil)
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	v := &Verifier{Resolver: resolver, Client: stubClient(server)}
+
+	method, err := v.Check(context.Background(), "example.com", testToken)
+	if err != nil || method != DNS {
+		t.Errorf("Check(example.com) = %q, %v, want %q", method, err, DNS)
+	}
+	if _, err := v.Check(context.Background(), "example.org", testToken); !errors.Is(err, ErrNotVerified) {
+		t.Errorf("Check(example.org) = %v, want %v", err, ErrNotVerified)
+	}
+}
+
+func TestCheckHTTP(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(WellKnownPath, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Host {
+		case "example.com":
+			w.Write([]byte("first line\n" + Record(testToken) + "\n"))
+		case "moved.example.com":
+			http.Redirect(w, r, "http://www.moved.example.com/verification.txt", http.StatusFound)
+		case "leaving.example.com":
+			http.Redirect(w, r, "http://evil.example.net"+WellKnownPath, http.StatusFound)
+		case "port.example.com":
+			http.Redirect(w, r, "http://port.example.com:8080"+WellKnownPath, http.StatusFound)
+		case "loop.example.com":
+			http.Redirect(w, r, WellKnownPath, http.StatusFound)
+		case "evil.example.net", "port.example.com:8080":
+			w.Write([]byte(Record(testToken)))
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	mux.HandleFunc("/verification.txt", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(Record(testToken)))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	v := &Verifier{Resolver: emptyResolver(t), Client: stubClient(server)}
+
+	tests := []struct {
+		domain string
+		want   bool
+	}{
+		{"example.com", true},
+		{"moved.example.com", true},
+		{"leaving.example.com", false},
+		{"port.example.com", false},
+		{"loop.example.com", false},
+		{"missing.example.com", false},
+	}
+	for _, tt := range tests {
+		method, err := v.Check(context.Background(), tt.domain, testToken)
+		if tt.want && (err != nil || method != HTTP) {
+			t.Errorf("Check(%s) = %q, %v, want %q", tt.domain, method, err, HTTP)
+		}
+		if !tt.want && !errors.Is(err, ErrNotVerified) {
+			t.Errorf("Check(%s) = %q, %v, want %v", tt.domain, method, err, ErrNotVerified)
+		}
+	}
+}
+
+func TestCheckGenericError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "internal details", http.StatusTeapot)
+	}))
+	defer server.Close()
+	v := &Verifier{Resolver: emptyResolver(t), Client: stubClient(server)}
+
+	_, err := v.Check(context.Background(), "example.com", testToken)
+	if !errors.Is(err, ErrNotVerified) {
+		t.Fatalf("Check() = %v, want %v", err, ErrNotVerified)
+	}
+	for _, leak := range []string{"418", "internal details", "127.0.0.1", "no such host"} {
+		if strings.Contains(err.Error(), leak) {
+			t.Errorf("Check() = %q, which reveals %q", err, leak)
+		}
+	}
+}
+
+func TestCheckRefusesNonPublicAddresses(t *testing.T) {
+	resolver := stubResolver(t, nil, map[string]net.IP{
+		"loopback.example.com.":   net.IPv4(127, 0, 0, 1),
+		"private.example.com.":    net.IPv4(10, 1, 2, 3),
+		"link-local.example.com.": net.IPv4(169, 254, 169, 254),
+	})
+	v := &Verifier{Resolver: resolver}
+
+	for _, domain := range []string{"loopback.example.com", "private.example.com", "link-local.example.com", "127.0.0.1"} {
+		err := v.checkHTTP(context.Background(), domain, testToken)
+		if err == nil || !strings.Contains(err.Error(), "non-public address") {
+			t.Errorf("checkHTTP(%s) = %v, want a refused connection", domain, err)
+		}
+	}
+}
+
+func TestIsPublic(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.0.0.1", false},
+		{"172.16.5.4", false},
+		{"192.168.1.1", false},
+		{"100.64.0.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"0.0.0.0", false},
+		{"224.0.0.1", false},
+		{"::ffff:127.0.0.1", false},
+	}
+	for _, tt := range tests {
+		if got := isPublic(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("isPublic(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
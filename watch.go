@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	sqldb "ctlog/db"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Bounds of the interval a log's STH is polled at in the watch mode
+const MIN_POLL_INTERVAL = 30 * time.Second
+const MAX_POLL_INTERVAL = 10 * time.Minute
+
+// Returns how often the STH of a log with the maximum merge delay is polled.
+// A 24 hour MMD is polled every minute, new entries are usually merged long before the MMD.
+func pollInterval(mmd time.Duration) time.Duration {
+	interval := mmd / 1440
+	if interval < MIN_POLL_INTERVAL {
+		return MIN_POLL_INTERVAL
+	}
+	if interval > MAX_POLL_INTERVAL {
+		return MAX_POLL_INTERVAL
+	}
+	return interval
+}
+
+// A log tailed by the watch mode
+type watchedLog struct {
+	headIndex int64
+	interval  time.Duration
+}
+
+// Returns the logs to tail, their heads and poll intervals
+func loadWatchedLogs(ctx context.Context, store sqldb.Store) (map[string]watchedLog, error) {
+	ctLogs, err := store.Logs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	logs := make(map[string]watchedLog)
+	for _, l := range ctLogs {
+		logs[l.Url] = watchedLog{l.HeadIndex, pollInterval(time.Duration(l.MMD) * time.Second)}
+	}
+	return logs, nil
+}
+
+// Tails the logs until the context is cancelled. Every log whose poll interval elapsed has its STH
+// downloaded, the new entries of all such logs are processed together as one run, so matches
+// are sent out within minutes. Logs are reloaded every round, added logs are picked up.
+// A failed run is logged and its logs are downloaded again from their old heads once they are due.
+func watch(ctx context.Context, store sqldb.Store, unsubscriber *sqldb.Unsubscriber) error {
+	next := make(map[string]time.Time)
+
+	for ctx.Err() == nil {
+		logs, err := loadWatchedLogs(ctx, store)
+		if err != nil {
+			return fmt.Errorf("loading logs -> %w", err)
+		}
+
+		now := time.Now()
+		logInfos := make(map[string]sqldb.CTLogInfo)
+		for url, l := range logs {
+			if next[url].After(now) {
+				continue
+			}
+			next[url] = now.Add(l.interval)
+
+			sth, err := DownloadSTH(ctx, url)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				slog.Warn("Failed to download STH", "log_url", url, "err", err)
+				continue
+			}
+			if sth.TreeSize-1 > l.headIndex {
+				logInfos[url] = sqldb.CTLogInfo{OldHeadIndex: l.headIndex, NewHeadIndex: sth.TreeSize - 1}
+			}
+		}
+
+		if len(logInfos) > 0 {
+			if err := process(ctx, logInfos, false, store, unsubscriber); err != nil {
+				slog.Error("Run failed", "err", err)
+			}
+		}
+
+		// Sleep until the next log is due
+		wake := time.Now().Add(MAX_POLL_INTERVAL)
+		for url := range logs {
+			if next[url].Before(wake) {
+				wake = next[url]
+			}
+		}
+		slog.Debug("Waiting for the next poll", "until", wake)
+		sleepContext(ctx, time.Until(wake))
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPollInterval(t *testing.T) {
+	tests := []struct {
+		mmd  time.Duration
+		want time.Duration
+	}{
+		{0, MIN_POLL_INTERVAL},
+		{time.Hour, MIN_POLL_INTERVAL},
+		{12 * time.Hour, MIN_POLL_INTERVAL},
+		{24 * time.Hour, time.Minute},
+		{48 * time.Hour, 2 * time.Minute},
+		{240 * time.Hour, MAX_POLL_INTERVAL},
+		{1000 * 24 * time.Hour, MAX_POLL_INTERVAL},
+	}
+
+	for _, tt := range tests {
+		if got := pollInterval(tt.mmd); got != tt.want {
+			t.Errorf("pollInterval(%s) = %s, want %s", tt.mmd, got, tt.want)
+		}
+	}
+}
+
+func TestWatchStops(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The log has no new entries, the watch only polls its STH
+	polled := make(chan struct{}, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ct/v1/get-sth" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(CTHead{TreeSize: 10})
+		polled <- struct{}{}
+	}))
+	t.Cleanup(server.Close)
+	CreateClient()
+
+	store := newTestStore(t)
+	if err := store.SaveLog(ctx, server.URL+"/", 86400); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetHead(ctx, server.URL+"/", 9); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() { done <- watch(ctx, store, nil) }()
+
+	select {
+	case <-polled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the STH was not polled")
+	}
+	// The next poll is a minute away, cancelling wakes the watch up
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("watch() = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch() did not stop")
+	}
+	if runs, err := store.ListRuns(context.Background(), 10); err != nil || len(runs) != 0 {
+		t.Errorf("ListRuns() = %+v, %v, want no runs without new entries", runs, err)
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	sqldb "ctlog/db"
+	"ctlog/match"
+	"errors"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// Number of matched certificates shown
+const UI_MATCH_LIMIT = 50
+
+// Cookie holding the session token of a signed in user
+const sessionCookie = "ctlog_session"
+
+var uiTemplates = template.Must(template.New("layout").Funcs(template.FuncMap{
+	"join": strings.Join,
+	"time": apiTime,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<title>CTLog</title>
+	<style>
+		body { font-family: monospace; margin: 2em; }
+		table { border-collapse: collapse; margin-bottom: 2em; }
+		th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; vertical-align: top; }
+		.violation { color: #b00; font-weight: bold; }
+		.message { background: #eef; padding: 0.5em; }
+		form.inline { display: inline; }
+	</style>
+</head>
+<body>
+<h1>CTLog</h1>
+{{if .Message}}<p class="message">{{.Message}}</p>{{end}}
+{{if .Unsubscribe}}{{template "unsubscribe" .Unsubscribe}}{{else if .LoginToken}}{{template "signin" .LoginToken}}{{else if .Email}}{{template "overview" .}}{{else}}{{template "login" .}}{{end}}
+</body>
+</html>
+
+{{define "login"}}
+<p>Přihlašovací odkaz vám přijde emailem. / A sign-in link will be sent to your email.</p>
+<form method="post" action="/login">
+	<input type="email" name="email" placeholder="email" required>
+	<button type="submit">Odeslat / Send</button>
+</form>
+{{end}}
+
+{{define "signin"}}
+<form method="post" action="/session">
+	<input type="hidden" name="token" value="{{.}}">
+	<button type="submit">Přihlásit / Sign in</button>
+</form>
+{{end}}
+
+{{define "unsubscribe"}}
+<p>Zrušit odběr adresy {{.Email}} / Unsubscribe {{.Email}} from:</p>
+<ul>
+	{{range .Monitors}}<li>{{.Kind}} {{.Display}}</li>{{end}}
+</ul>
+<form method="post" action="{{.Action}}">
+	<input type="hidden" name="token" value="{{.Token}}">
+	<button type="submit">Odhlásit odběr / Unsubscribe</button>
+</form>
+{{end}}
+
+{{define "overview"}}
+<p>{{.Email}}
+	<form class="inline" method="post" action="/logout"><button type="submit">Odhlásit / Sign out</button></form>
+</p>
+
+<h2>Monitory / Monitors</h2>
+{{if .Monitors}}
+<table>
+	<tr><th>Druh / Kind</th><th>Hodnota / Value</th><th>Porovnání / Mode</th><th>Podobná jména / Lookalike</th><th>Stav / Status</th><th></th></tr>
+	{{range .Monitors}}
+	<tr>
+		<td>{{.Kind}}</td>
+		<td>{{.Display}}</td>
+		<td>{{if eq .Kind "domain"}}{{.Mode}}{{end}}</td>
+		<td>{{if eq .Kind "domain"}}{{.Lookalike}}{{end}}</td>
+		<td>
+			{{if not .Confirmed}}nepotvrzený / not confirmed<br>{{end}}
+			{{if .VerifiedBy}}ověřený / verified ({{.VerifiedBy}}){{else}}neověřený / not verified{{end}}
+		</td>
+		<td>
+			<form class="inline" method="post" action="/unsubscribe">
+				<input type="hidden" name="kind" value="{{.Kind}}">
+				<input type="hidden" name="value" value="{{.Value}}">
+				<button type="submit">Odhlásit odběr / Unsubscribe</button>
+			</form>
+		</td>
+	</tr>
+	{{end}}
+</table>
+{{else}}
+<p>Žádné monitory. / No monitors.</p>
+{{end}}
+
+<h2>Nalezené certifikáty / Found certificates</h2>
+{{if .Matches.Certificates}}
+<table>
+	<tr><th>CN</th><th>Jména / Names</th><th>Vydavatel / Issuer</th><th>Platnost / Validity</th><th>Detail</th></tr>
+	{{range .Matches.Certificates}}
+	<tr>
+		<td>{{.UnicodeCN}}{{if ne .Reason "match"}}<br><span class="{{if eq .Reason "policy-violation"}}violation{{end}}">{{.Reason}}</span>{{end}}</td>
+		<td>{{join .UnicodeSAN ", "}}{{if .IPAddresses}}<br>IP: {{join .IPAddresses ", "}}{{end}}</td>
+		<td>{{.Issuer}}</td>
+		<td>{{time .NotBefore}}<br>{{time .NotAfter}}</td>
+		<td>
+			Serial: {{.SerialNumber}}<br>
+			{{if .Fingerprint}}SHA-256: <a href="/api/certificates?fingerprint={{.Fingerprint}}">{{.Fingerprint}}</a><br>{{end}}
+			{{range .Lint}}Problém / Lint: {{.}}<br>{{end}}
+		</td>
+	</tr>
+	{{end}}
+</table>
+{{else}}
+<p>Zatím nic nenalezeno. / Nothing found yet.</p>
+{{end}}
+{{end}}
+`))
+
+// Data of the page
+type uiPage struct {
+	Message  string
+	Email    string
+	Monitors []sqldb.Monitor
+	Matches  sqldb.MonitoredCerts
+
+	// Sign-in token of the link opened, which is used up by the button
+	LoginToken  string
+	Unsubscribe *uiUnsubscribe
+}
+
+// Confirmation of an unsubscribe link opened in a browser
+type uiUnsubscribe struct {
+	Email    string
+	Monitors []sqldb.Monitor
+	Action   string
+	Token    string
+}
+
+// Registers the web interface, where users signed in by the link in their API key email see their monitors
+// and the certificates found for them. publicURL is the address of the server in the sign-in links,
+// without it no links are sent. The unsubscribe links of the notification emails are handled here too.
+func handleWebUI(mux *http.ServeMux, store sqldb.Store, publicURL string, unsubscriber *sqldb.Unsubscriber) {
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
+			return
+		}
+		showOverview(w, r, store, "")
+	})
+
+	// The sign-in link only shows a button, so link scanners fetching it do not use up the token
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodGet, http.MethodPost) {
+			return
+		}
+		if r.Method == http.MethodPost {
+			if publicURL == "" {
+				renderPage(w, http.StatusServiceUnavailable, uiPage{Message: "Odesílání odkazů je vypnuté / Sending links is disabled"})
+				return
+			}
+			sendLoginLink(w, r, store, publicURL+"/login")
+			return
+		}
+		renderPage(w, http.StatusOK, uiPage{LoginToken: r.URL.Query().Get("token")})
+	})
+
+	mux.HandleFunc("/session", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodPost) {
+			return
+		}
+		signIn(w, r, store, strings.HasPrefix(publicURL, "https://"))
+	})
+
+	mux.HandleFunc("/logout", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodPost) {
+			return
+		}
+		if cookie, err := r.Cookie(sessionCookie); err == nil {
+			if err := sqldb.SignOut(r.Context(), cookie.Value, store); err != nil {
+				slog.Error("Failed signing out", "err", err)
+			}
+		}
+		http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1})
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	})
+
+	mux.HandleFunc("/unsubscribe", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodPost) {
+			return
+		}
+		unsubscribe(w, r, store)
+	})
+
+	// Mail clients POST the link itself (RFC 8058), a link opened in a browser only asks to confirm,
+	// so link scanners fetching it do not unsubscribe
+	mux.HandleFunc(sqldb.UnsubscribePath, func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodGet, http.MethodPost) {
+			return
+		}
+		if r.Method == http.MethodPost {
+			oneClickUnsubscribe(w, r, store, unsubscriber)
+			return
+		}
+		confirmUnsubscribe(w, r, store, unsubscriber)
+	})
+}
+
+func renderPage(w http.ResponseWriter, status int, page uiPage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := uiTemplates.Execute(w, page); err != nil {
+		slog.Error("Failed rendering page", "err", err)
+	}
+}
+
+// Returns the email of the signed in user, empty if there is none
+func sessionEmail(r *http.Request, store sqldb.Store) (string, error) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return "", nil
+	}
+	email, _, err := sqldb.SessionEmail(r.Context(), cookie.Value, store)
+	return email, err
+}
+
+// Shows the monitors of the signed in user and the certificates found for them, or the sign-in form
+func showOverview(w http.ResponseWriter, r *http.Request, store sqldb.Store, message string) {
+	page := uiPage{Message: message}
+
+	email, err := sessionEmail(r, store)
+	if err != nil {
+		slog.Error("Failed authenticating session", "err", err)
+		renderPage(w, http.StatusInternalServerError, uiPage{Message: "Chyba / Error"})
+		return
+	}
+	if email == "" {
+		renderPage(w, http.StatusOK, page)
+		return
+	}
+
+	page.Email = email
+	if page.Monitors, err = store.MonitorsOf(r.Context(), email); err == nil {
+		page.Matches, err = sqldb.RecentMatches(r.Context(), email, UI_MATCH_LIMIT, store)
+	}
+	if err != nil {
+		slog.Error("Failed loading overview", "email", email, "err", err)
+		renderPage(w, http.StatusInternalServerError, uiPage{Message: "Chyba / Error"})
+		return
+	}
+	renderPage(w, http.StatusOK, page)
+}
+
+// Sends an API key with the sign-in link to the email of the form
+func sendLoginLink(w http.ResponseWriter, r *http.Request, store sqldb.Store, loginURL string) {
+	email := strings.TrimSpace(r.PostFormValue("email"))
+	if err := sqldb.IssueAPIKey(r.Context(), email, loginURL, store); err != nil {
+		if errors.Is(err, sqldb.ErrInvalidEmail) {
+			renderPage(w, http.StatusBadRequest, uiPage{Message: err.Error()})
+			return
+		}
+		slog.Error("Failed issuing API key", "email", email, "err", err)
+		renderPage(w, http.StatusInternalServerError, uiPage{Message: "Odeslání selhalo / Sending failed"})
+		return
+	}
+	renderPage(w, http.StatusOK, uiPage{Message: "Odkaz byl odeslán na / The link was sent to " + email})
+}
+
+// Opens a session by the sign-in token of the link and keeps the session token in a cookie
+func signIn(w http.ResponseWriter, r *http.Request, store sqldb.Store, secure bool) {
+	session, _, ok, err := sqldb.SignIn(r.Context(), r.PostFormValue("token"), store)
+	if err != nil {
+		slog.Error("Failed signing in", "err", err)
+		renderPage(w, http.StatusInternalServerError, uiPage{Message: "Chyba / Error"})
+		return
+	}
+	if !ok {
+		renderPage(w, http.StatusUnauthorized, uiPage{Message: "Neplatný, prošlý nebo použitý odkaz / Invalid, expired or used link"})
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    session,
+		Path:     "/",
+		MaxAge:   int(sqldb.SessionDuration.Seconds()),
+		HttpOnly: true,
+		Secure:   secure,
+		// Forms posted from other sites do not carry the cookie
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// Removes a monitor of the signed in user
+func unsubscribe(w http.ResponseWriter, r *http.Request, store sqldb.Store) {
+	email, err := sessionEmail(r, store)
+	if err != nil || email == "" {
+		if err != nil {
+			slog.Error("Failed authenticating session", "err", err)
+		}
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	kind, err := match.ParseKind(r.PostFormValue("kind"))
+	if err == nil {
+		err = sqldb.RemoveMonitor(r.Context(), email, kind, r.PostFormValue("value"), store)
+	}
+	if err != nil {
+		renderPage(w, http.StatusBadRequest, uiPage{Message: err.Error()})
+		return
+	}
+	slog.Info("Unsubscribed monitor", "email", email, "kind", kind, "value", r.PostFormValue("value"))
+	showOverview(w, r, store, "Odběr byl zrušen / Unsubscribed "+r.PostFormValue("value"))
+}
+
+// Asks to confirm the unsubscribe link
+func confirmUnsubscribe(w http.ResponseWriter, r *http.Request, store sqldb.Store, unsubscriber *sqldb.Unsubscriber) {
+	token := r.URL.Query().Get("token")
+	email, monitors, err := unsubscriber.Monitors(r.Context(), token, store)
+	if err != nil {
+		if errors.Is(err, sqldb.ErrInvalidToken) {
+			renderPage(w, http.StatusBadRequest, uiPage{Message: "Neplatný odkaz / Invalid link"})
+			return
+		}
+		slog.Error("Failed loading monitors", "email", email, "err", err)
+		renderPage(w, http.StatusInternalServerError, uiPage{Message: "Chyba / Error"})
+		return
+	}
+	renderPage(w, http.StatusOK, uiPage{Unsubscribe: &uiUnsubscribe{Email: email, Monitors: monitors, Action: sqldb.UnsubscribePath, Token: token}})
+}
+
+// Removes the monitors of the unsubscribe token, which comes in the URL from mail clients and in the form otherwise
+func oneClickUnsubscribe(w http.ResponseWriter, r *http.Request, store sqldb.Store, unsubscriber *sqldb.Unsubscriber) {
+	email, removed, err := sqldb.Unsubscribe(r.Context(), r.FormValue("token"), unsubscriber, store)
+	if err != nil {
+		if errors.Is(err, sqldb.ErrInvalidToken) {
+			renderPage(w, http.StatusBadRequest, uiPage{Message: "Neplatný odkaz / Invalid link"})
+			return
+		}
+		slog.Error("Failed unsubscribing", "email", email, "err", err)
+		renderPage(w, http.StatusInternalServerError, uiPage{Message: "Chyba / Error"})
+		return
+	}
+
+	values := make([]string, 0, len(removed))
+	for _, m := range removed {
+		values = append(values, m.Display)
+		slog.Info("Unsubscribed monitor", "email", email, "kind", m.Kind, "value", m.Value)
+	}
+	message := "Odběr adresy " + email + " byl zrušen / " + email + " was unsubscribed"
+	if len(values) > 0 {
+		message += ": " + strings.Join(values, ", ")
+	}
+	renderPage(w, http.StatusOK, uiPage{Message: message})
+}
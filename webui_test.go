@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	sqldb "ctlog/db"
+	"ctlog/match"
+	"ctlog/verify"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// Serves the request and returns the answer
+func serveUI(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// Returns a form request, with the session cookie if there is one
+func formRequest(target string, form url.Values, session *http.Cookie) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if session != nil {
+		r.AddCookie(session)
+	}
+	return r
+}
+
+// Returns a GET request, with the session cookie if there is one
+func pageRequest(target string, session *http.Cookie) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	if session != nil {
+		r.AddCookie(session)
+	}
+	return r
+}
+
+func TestWebUISignIn(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	mails := testMailbox(t)
+	h := apiHandler(store, testPublicURL, &verify.Verifier{}, nil)
+	if err := sqldb.AddMonitor(ctx, "user@example.com", match.KindDomain, []string{"example.com"}, match.DefaultMode, match.Off, store); err != nil {
+		t.Fatal(err)
+	}
+	saveTestCert(t, store, 1, "www.example.com")
+	saveTestCert(t, store, 2, "www.other.org")
+
+	w := serveUI(h, pageRequest("/", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `action="/login"`) {
+		t.Fatalf("GET / without a session: %d, %s", w.Code, w.Body)
+	}
+	if w := serveUI(h, pageRequest("/missing", nil)); w.Code != http.StatusNotFound {
+		t.Errorf("GET /missing: %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	if w := serveUI(h, formRequest("/login", url.Values{"email": {"user@example.com"}}, nil)); w.Code != http.StatusOK {
+		t.Fatalf("POST /login: %d", w.Code)
+	}
+	token := tokenInMail(t, mails(), testPublicURL+"/login?token=")
+
+	// Opening the link only shows the button
+	w = serveUI(h, pageRequest("/login?token="+token, nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `value="`+token+`"`) {
+		t.Fatalf("GET /login: %d, %s", w.Code, w.Body)
+	}
+	w = serveUI(h, formRequest("/session", url.Values{"token": {token}}, nil))
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("POST /session: %d, want %d", w.Code, http.StatusSeeOther)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != sessionCookie || !cookies[0].HttpOnly || !cookies[0].Secure {
+		t.Fatalf("session cookies %+v", cookies)
+	}
+	session := cookies[0]
+	if w := serveUI(h, formRequest("/session", url.Values{"token": {token}}, nil)); w.Code != http.StatusUnauthorized {
+		t.Errorf("used sign-in token: %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	// The overview shows the monitors and matches of the email only
+	w = serveUI(h, pageRequest("/", session))
+	if body := w.Body.String(); w.Code != http.StatusOK || !strings.Contains(body, "user@example.com") ||
+		!strings.Contains(body, "www.example.com") || strings.Contains(body, "www.other.org") {
+		t.Errorf("overview: %d, %s", w.Code, body)
+	}
+	// The session also authenticates the certificate API the overview links to
+	var page apiPage
+	if code := serveTestRequest(t, h, pageRequest("/api/certificates", session), &page); code != http.StatusOK || len(page.Certificates) != 1 {
+		t.Errorf("GET /api/certificates with the session: %d, %+v", code, page)
+	}
+
+	if w := serveUI(h, formRequest("/unsubscribe", url.Values{"kind": {"domain"}, "value": {"example.com"}}, session)); w.Code != http.StatusOK {
+		t.Errorf("POST /unsubscribe: %d", w.Code)
+	}
+	if monitors, err := store.MonitorsOf(ctx, "user@example.com"); err != nil || len(monitors) != 0 {
+		t.Errorf("monitors after unsubscribing %+v, %v", monitors, err)
+	}
+
+	if w := serveUI(h, formRequest("/logout", nil, session)); w.Code != http.StatusSeeOther {
+		t.Errorf("POST /logout: %d, want %d", w.Code, http.StatusSeeOther)
+	}
+	if w := serveUI(h, pageRequest("/", session)); strings.Contains(w.Body.String(), "user@example.com") {
+		t.Error("the session is still open after signing out")
+	}
+}
+
+func TestWebUIUnsubscribeWithoutSession(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	h := apiHandler(store, testPublicURL, &verify.Verifier{}, nil)
+	if err := sqldb.AddMonitor(ctx, "user@example.com", match.KindDomain, []string{"example.com"}, match.DefaultMode, match.Off, store); err != nil {
+		t.Fatal(err)
+	}
+
+	w := serveUI(h, formRequest("/unsubscribe", url.Values{"kind": {"domain"}, "value": {"example.com"}}, nil))
+	if w.Code != http.StatusSeeOther {
+		t.Errorf("POST /unsubscribe without a session: %d, want %d", w.Code, http.StatusSeeOther)
+	}
+	if monitors, err := store.MonitorsOf(ctx, "user@example.com"); err != nil || len(monitors) != 1 {
+		t.Errorf("monitors %+v, %v, want the monitor kept", monitors, err)
+	}
+}
+
+func TestWebUIOneClickUnsubscribe(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	unsubscriber, err := sqldb.NewUnsubscriber(ctx, store, testPublicURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := apiHandler(store, testPublicURL, &verify.Verifier{}, unsubscriber)
+	if err := sqldb.AddMonitor(ctx, "user@example.com", match.KindDomain, []string{"example.com", "example.org"}, match.DefaultMode, match.Off, store); err != nil {
+		t.Fatal(err)
+	}
+	token := unsubscriber.AllToken("user@example.com")
+
+	if w := serveUI(h, pageRequest(sqldb.UnsubscribePath+"?token=forged", nil)); w.Code != http.StatusBadRequest {
+		t.Errorf("forged token: %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	// Opening the link only asks to confirm
+	w := serveUI(h, pageRequest(sqldb.UnsubscribePath+"?token="+token, nil))
+	if body := w.Body.String(); w.Code != http.StatusOK || !strings.Contains(body, "example.com") || !strings.Contains(body, "example.org") {
+		t.Errorf("GET %s: %d, %s", sqldb.UnsubscribePath, w.Code, body)
+	}
+	if monitors, err := store.MonitorsOf(ctx, "user@example.com"); err != nil || len(monitors) != 2 {
+		t.Fatalf("monitors after opening the link %+v, %v", monitors, err)
+	}
+
+	// Mail clients POST the link itself
+	r := formRequest(sqldb.UnsubscribePath+"?token="+url.QueryEscape(token), url.Values{"List-Unsubscribe": {"One-Click"}}, nil)
+	if w := serveUI(h, r); w.Code != http.StatusOK {
+		t.Errorf("POST %s: %d", sqldb.UnsubscribePath, w.Code)
+	}
+	if monitors, err := store.MonitorsOf(ctx, "user@example.com"); err != nil || len(monitors) != 0 {
+		t.Errorf("monitors after unsubscribing %+v, %v", monitors, err)
+	}
+}